@@ -0,0 +1,71 @@
+// Package auth identifies the callers of the API and what they are allowed to do.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Scopes that can be granted to an API key.
+const (
+	ScopeFilesRead   = "files:read"
+	ScopeFilesWrite  = "files:write"
+	ScopeFilesDelete = "files:delete"
+	// ScopeFilesAdmin lets a caller use every file, whoever owns it.
+	ScopeFilesAdmin = "files:admin"
+	// ScopeTenantsSelect lets a caller whose credentials belong to no tenant act for
+	// any tenant it names in the tenancy header.
+	ScopeTenantsSelect = "tenants:select"
+)
+
+// Scopes lists every scope that can be granted.
+var Scopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeFilesDelete, ScopeFilesAdmin, ScopeTenantsSelect}
+
+// ValidateScopes returns an error naming the first of scopes that is not known.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return fmt.Errorf("scope '%s' is not supported", scope)
+		}
+	}
+	return nil
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// ID identifies the caller: "apikey:" followed by the ID of the API key it
+	// presented, or the subject of its JWT.
+	ID     string
+	Name   string
+	Scopes []string
+	// Roles are the roles the identity provider gave a JWT caller.
+	Roles []string
+	// Groups are the teams the caller belongs to. Files a caller uploads are shared
+	// with its first group.
+	Groups []string
+	// Tenant is the customer the caller belongs to, or empty if it belongs to none.
+	Tenant string
+}
+
+// HasScope reports whether the principal was granted scope.
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx that carries principal.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal carried by ctx, or nil if the request
+// was not authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	keys, err := NewFileKeyStore(filepath.Join(t.TempDir(), "apikeys.yml"))
+	require.NoError(t, err)
+
+	token, key, err := NewAPIKey("ci", []string{ScopeFilesRead}, nil)
+	require.NoError(t, err)
+	assert.True(t, IsAPIKey(token))
+	assert.NotContains(t, key.Hash, token, "only the hash of the key is stored")
+	key.Tenant = "acme"
+	require.NoError(t, keys.CreateAPIKey(ctx, key))
+
+	principal, err := Authenticate(ctx, keys, token)
+	require.NoError(t, err)
+	assert.Equal(t, "apikey:"+key.ID, principal.ID)
+	assert.Equal(t, "acme", principal.Tenant)
+	assert.True(t, principal.HasScope(ScopeFilesRead))
+	assert.False(t, principal.HasScope(ScopeFilesWrite))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "malformed", token: "not-a-key"},
+		{name: "unknown ID", token: "fu_0000000000000000_secret"},
+		{name: "wrong secret", token: "fu_" + key.ID + "_secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Authenticate(ctx, keys, tt.token)
+			var appErr *types.AppError
+			require.ErrorAs(t, err, &appErr)
+			assert.Equal(t, 401, appErr.HTTPStatus)
+		})
+	}
+
+	require.NoError(t, keys.RevokeAPIKey(ctx, key.ID, time.Now().UTC()))
+	_, err = Authenticate(ctx, keys, token)
+	assert.Error(t, err, "a revoked key is rejected")
+}
+
+func TestNewAPIKey_InvalidScopes(t *testing.T) {
+	_, _, err := NewAPIKey("ci", []string{"files:everything"}, nil)
+	assert.Error(t, err)
+	_, _, err = NewAPIKey("ci", nil, nil)
+	assert.Error(t, err)
+}
+
+func TestFileKeyStore_ReloadsChangedFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "apikeys.yml")
+	server, err := NewFileKeyStore(path)
+	require.NoError(t, err)
+	_, err = server.GetAPIKey(ctx, "0123456789abcdef")
+	require.Error(t, err)
+
+	// The apikey command writes the file from another process.
+	command, err := NewFileKeyStore(path)
+	require.NoError(t, err)
+	_, key, err := NewAPIKey("ci", []string{ScopeFilesWrite}, nil)
+	require.NoError(t, err)
+	require.NoError(t, command.CreateAPIKey(ctx, key))
+
+	stored, err := server.GetAPIKey(ctx, key.ID)
+	require.NoError(t, err)
+	assert.Equal(t, key.Hash, stored.Hash)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "the key file is only readable by its owner")
+}
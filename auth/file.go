@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+	"gopkg.in/yaml.v3"
+)
+
+// FileKeyStore keeps API keys in a YAML file, for deployments without a metadata
+// database. The file is read again whenever it changes, so keys minted or revoked
+// by the apikey command take effect without a restart.
+type FileKeyStore struct {
+	path string
+
+	mu      sync.Mutex
+	keys    []types.APIKey
+	modTime time.Time
+	size    int64
+}
+
+var _ KeyStore = (*FileKeyStore)(nil)
+
+// keyFile is the layout of the file.
+type keyFile struct {
+	Keys []types.APIKey `yaml:"keys"`
+}
+
+// NewFileKeyStore creates a FileKeyStore for the file at path, which does not have
+// to exist until the first key is minted.
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	s := &FileKeyStore{path: path}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileKeyStore) CreateAPIKey(ctx context.Context, key *types.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if slices.ContainsFunc(s.keys, func(k types.APIKey) bool { return k.ID == key.ID }) {
+		return fmt.Errorf("API key %s already exists", key.ID)
+	}
+	return s.save(append(slices.Clone(s.keys), *key))
+}
+
+func (s *FileKeyStore) GetAPIKey(ctx context.Context, id string) (*types.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	for _, key := range s.keys {
+		if key.ID == id {
+			return &key, nil
+		}
+	}
+	return nil, types.NewNotFoundError(id)
+}
+
+func (s *FileKeyStore) RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	keys := slices.Clone(s.keys)
+	i := slices.IndexFunc(keys, func(k types.APIKey) bool { return k.ID == id })
+	if i < 0 {
+		return types.NewNotFoundError(id)
+	}
+	keys[i].RevokedAt = &revokedAt
+	return s.save(keys)
+}
+
+func (s *FileKeyStore) ListAPIKeys(ctx context.Context) ([]types.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.keys), nil
+}
+
+// load reads the file again if it has changed since it was last read.
+func (s *FileKeyStore) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.keys, s.modTime, s.size = nil, time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read API key file: %w", err)
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read API key file: %w", err)
+	}
+	var file keyFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse API key file %s: %w", s.path, err)
+	}
+	s.keys, s.modTime, s.size = file.Keys, info.ModTime(), info.Size()
+	return nil
+}
+
+// save replaces the file with keys. The new file is written alongside and renamed
+// into place, so the server never reads a partly written file.
+func (s *FileKeyStore) save(keys []types.APIKey) error {
+	data, err := yaml.Marshal(keyFile{Keys: keys})
+	if err != nil {
+		return fmt.Errorf("failed to encode API keys: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o750); err != nil {
+		return fmt.Errorf("failed to create API key file directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write API key file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write API key file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write API key file: %w", err)
+	}
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace API key file: %w", err)
+	}
+
+	s.keys = keys
+	// Read the file's new modification time next time, rather than trusting it now.
+	s.modTime, s.size = time.Time{}, 0
+	return nil
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJWKSSize bounds the key sets that are read.
+const maxJWKSSize = 1 << 20
+
+// JWKS is a JSON Web Key Set, read from a URL or a file and cached. The set is read
+// again once it is older than its TTL, or sooner when a token names a key it does
+// not hold, as happens when the identity provider rotates its signing keys.
+type JWKS struct {
+	source string
+	ttl    time.Duration
+	// minRefresh limits how often an unknown key ID can cause the set to be read
+	// again, so tokens with made up key IDs cannot flood the identity provider.
+	minRefresh time.Duration
+	client     *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// err is why the set could not be read, while keys is nil.
+	err error
+}
+
+// NewJWKS creates a JWKS read from source, an http(s) URL or a file path, that is
+// cached for ttl.
+func NewJWKS(source string, ttl time.Duration) *JWKS {
+	return &JWKS{
+		source:     source,
+		ttl:        ttl,
+		minRefresh: 30 * time.Second,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ErrKeySetUnavailable is returned, wrapped, when no key set has been read, so that
+// no token can be checked.
+var ErrKeySetUnavailable = errors.New("JSON Web Key Set is unavailable")
+
+// Key returns the public key with ID kid. A token without a key ID can only be
+// checked against a set holding a single key.
+func (s *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	age := time.Since(s.fetchedAt)
+	if age >= s.ttl || (s.keys == nil && age >= s.minRefresh) {
+		if err := s.refresh(ctx); err != nil {
+			// Keep using any keys we have until the identity provider is back.
+			slog.WarnContext(ctx, "Failed to refresh JSON Web Key Set", "source", s.source, "error", err)
+			s.err = err
+		}
+	}
+	if s.keys == nil {
+		return nil, fmt.Errorf("%w: %w", ErrKeySetUnavailable, s.err)
+	}
+
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	if kid != "" && time.Since(s.fetchedAt) >= s.minRefresh {
+		if err := s.refresh(ctx); err != nil {
+			slog.WarnContext(ctx, "Failed to refresh JSON Web Key Set", "source", s.source, "error", err)
+		}
+		if key, ok := s.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("signing key '%s' is not in the JSON Web Key Set", kid)
+}
+
+func (s *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// refresh reads the set from its source. fetchedAt is advanced even when reading
+// fails, so a failing source is not retried on every request.
+func (s *JWKS) refresh(ctx context.Context) error {
+	s.fetchedAt = time.Now()
+
+	data, err := s.read(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse JSON Web Key Set from %s: %w", s.source, err)
+	}
+	s.keys = keys
+	return nil
+}
+
+func (s *JWKS) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(s.source, "https://") && !strings.HasPrefix(s.source, "http://") {
+		data, err := os.ReadFile(s.source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JSON Web Key Set: %w", err)
+		}
+		return data, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JSON Web Key Set request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JSON Web Key Set: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JSON Web Key Set from %s: %s", s.source, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JSON Web Key Set: %w", err)
+	}
+	return data, nil
+}
+
+// jwk holds the members of a JSON Web Key (RFC 7517) that are needed to verify signatures.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of a key set by key ID. Keys of types that are
+// not supported, or that are only for encryption, are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if errors.Is(err, errors.ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKMember(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKMember(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA key is too small or malformed")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var checker ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, checker = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, checker = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, checker = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, errors.ErrUnsupported
+		}
+		x, err := decodeJWKMember(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKMember(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("EC key coordinates are the wrong size")
+		}
+		// ecdh rejects points that are not on the curve.
+		if _, err := checker.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, fmt.Errorf("EC key is invalid: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.ErrUnsupported
+		}
+		x, err := decodeJWKMember(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Ed25519 key is the wrong size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errors.ErrUnsupported
+	}
+}
+
+func decodeJWKMember(value string) ([]byte, error) {
+	if value == "" {
+		return nil, errors.New("key member is missing")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("key member is not base64url encoded: %w", err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// clockSkew is how far the clocks of the service and the identity provider may
+// disagree when checking a token's expiry.
+const clockSkew = 30 * time.Second
+
+// jwtAlgorithms are the signing algorithms accepted. Symmetric algorithms are left
+// out, so a public key can never be used as an HMAC secret.
+var jwtAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// JWTVerifier checks bearer JWTs issued by an OIDC identity provider.
+type JWTVerifier struct {
+	keys        *JWKS
+	parser      *jwt.Parser
+	rolesClaim  []string
+	groupsClaim []string
+	tenantClaim []string
+	roleScopes  map[string][]string
+}
+
+// NewJWTVerifier creates a JWTVerifier that accepts tokens described by cfg.
+func NewJWTVerifier(cfg config.JWTConfig) (*JWTVerifier, error) {
+	for role, scopes := range cfg.RoleScopes {
+		if err := ValidateScopes(scopes); err != nil {
+			return nil, fmt.Errorf("scopes of role '%s': %w", role, err)
+		}
+	}
+	return &JWTVerifier{
+		keys: NewJWKS(cfg.JWKS, time.Duration(cfg.CacheTTL)*time.Second),
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(jwtAlgorithms),
+			jwt.WithIssuer(cfg.Issuer),
+			jwt.WithAudience(cfg.Audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(clockSkew),
+		),
+		rolesClaim:  strings.Split(cfg.RolesClaim, "."),
+		groupsClaim: strings.Split(cfg.GroupsClaim, "."),
+		tenantClaim: strings.Split(cfg.TenantClaim, "."),
+		roleScopes:  cfg.RoleScopes,
+	}, nil
+}
+
+// Verify returns the principal for a JWT. The principal's ID is the token's subject,
+// and its scopes are those of its roles plus any in its scope claim. Verify returns
+// an authentication error if the token is invalid, and a 503 AppError if the
+// identity provider's keys cannot be read.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.Key(ctx, kid)
+	})
+	if errors.Is(err, ErrKeySetUnavailable) {
+		return nil, types.NewAppError("Authentication Unavailable", "bearer token could not be checked", http.StatusServiceUnavailable, err)
+	}
+	if err != nil {
+		return nil, types.NewAuthenticationError("bearer token is invalid", err)
+	}
+
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return nil, types.NewAuthenticationError("bearer token has no subject", nil)
+	}
+	principal := &Principal{ID: subject, Name: subject}
+	for _, claim := range []string{"name", "preferred_username", "email"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			principal.Name = name
+			break
+		}
+	}
+
+	principal.Roles = stringsClaim(lookupClaim(claims, v.rolesClaim))
+	principal.Groups = stringsClaim(lookupClaim(claims, v.groupsClaim))
+	principal.Tenant, _ = lookupClaim(claims, v.tenantClaim).(string)
+	for _, role := range principal.Roles {
+		principal.Scopes = append(principal.Scopes, v.roleScopes[role]...)
+	}
+	// OAuth access tokens list scopes in "scope"; Microsoft Entra ID uses "scp".
+	for _, claim := range []string{"scope", "scp"} {
+		for _, scope := range stringsClaim(claims[claim]) {
+			if slices.Contains(Scopes, scope) {
+				principal.Scopes = append(principal.Scopes, scope)
+			}
+		}
+	}
+	slices.Sort(principal.Scopes)
+	principal.Scopes = slices.Compact(principal.Scopes)
+	return principal, nil
+}
+
+// lookupClaim returns the claim reached by following path through nested objects.
+func lookupClaim(claims map[string]any, path []string) any {
+	var value any = claims
+	for _, name := range path {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// stringsClaim returns the strings of a claim that is either an array of strings or
+// a single string of space separated values.
+func stringsClaim(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
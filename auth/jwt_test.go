@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSigningKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
+
+// jwksJSON encodes the public halves of keys, by key ID, as a JSON Web Key Set.
+func jwksJSON(t *testing.T, keys map[string]*rsa.PrivateKey) []byte {
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, map[string]string{
+			"kid": kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, err := json.Marshal(set)
+	require.NoError(t, err)
+	return data
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                "https://id.example.com",
+		"aud":                "file-uploader",
+		"sub":                "user-1",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"preferred_username": "alice",
+		"realm_access":       map[string]any{"roles": []string{"uploader"}},
+		"org":                map[string]any{"id": "acme"},
+		"scope":              "openid files:delete",
+	}
+}
+
+func jwtConfig(jwks string) config.JWTConfig {
+	return config.JWTConfig{
+		JWKS:        jwks,
+		CacheTTL:    300,
+		Issuer:      "https://id.example.com",
+		Audience:    "file-uploader",
+		RolesClaim:  "realm_access.roles",
+		TenantClaim: "org.id",
+		RoleScopes:  map[string][]string{"uploader": {ScopeFilesRead, ScopeFilesWrite}},
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	ctx := context.Background()
+	key := newSigningKey(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwksJSON(t, map[string]*rsa.PrivateKey{"k1": key}), 0o600))
+	verifier, err := NewJWTVerifier(jwtConfig(path))
+	require.NoError(t, err)
+
+	principal, err := verifier.Verify(ctx, signToken(t, key, "k1", validClaims()))
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", principal.ID)
+	assert.Equal(t, "alice", principal.Name)
+	assert.Equal(t, []string{"uploader"}, principal.Roles)
+	assert.Equal(t, "acme", principal.Tenant)
+	assert.Equal(t, []string{ScopeFilesDelete, ScopeFilesRead, ScopeFilesWrite}, principal.Scopes)
+
+	tests := []struct {
+		name   string
+		modify func(jwt.MapClaims)
+		kid    string
+	}{
+		{name: "wrong issuer", modify: func(c jwt.MapClaims) { c["iss"] = "https://other.example.com" }},
+		{name: "wrong audience", modify: func(c jwt.MapClaims) { c["aud"] = "another-app" }},
+		{name: "expired", modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "no expiry", modify: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "no subject", modify: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "unknown key", kid: "k2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			kid := "k1"
+			if tt.kid != "" {
+				kid = tt.kid
+			}
+			_, err := verifier.Verify(ctx, signToken(t, key, kid, claims))
+			var appErr *types.AppError
+			require.ErrorAs(t, err, &appErr)
+			assert.Equal(t, http.StatusUnauthorized, appErr.HTTPStatus)
+		})
+	}
+
+	t.Run("signed with another key", func(t *testing.T) {
+		_, err := verifier.Verify(ctx, signToken(t, newSigningKey(t), "k1", validClaims()))
+		assert.Error(t, err)
+	})
+
+	t.Run("symmetric algorithm", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString(key.N.Bytes())
+		require.NoError(t, err)
+		_, err = verifier.Verify(ctx, token)
+		assert.Error(t, err)
+	})
+}
+
+func TestJWTVerifier_KeyRotation(t *testing.T) {
+	ctx := context.Background()
+	oldKey, newKey := newSigningKey(t), newSigningKey(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwksJSON(t, map[string]*rsa.PrivateKey{"old": oldKey}), 0o600))
+	verifier, err := NewJWTVerifier(jwtConfig(path))
+	require.NoError(t, err)
+	verifier.keys.minRefresh = 0
+
+	_, err = verifier.Verify(ctx, signToken(t, oldKey, "old", validClaims()))
+	require.NoError(t, err)
+
+	// The identity provider publishes its new key and starts signing with it.
+	require.NoError(t, os.WriteFile(path, jwksJSON(t, map[string]*rsa.PrivateKey{"old": oldKey, "new": newKey}), 0o600))
+	_, err = verifier.Verify(ctx, signToken(t, newKey, "new", validClaims()))
+	assert.NoError(t, err, "an unknown key ID reads the key set again")
+}
+
+func TestJWTVerifier_JWKSURL(t *testing.T) {
+	ctx := context.Background()
+	key := newSigningKey(t)
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(jwksJSON(t, map[string]*rsa.PrivateKey{"k1": key}))
+	}))
+	defer server.Close()
+
+	verifier, err := NewJWTVerifier(jwtConfig(server.URL))
+	require.NoError(t, err)
+	for range 3 {
+		_, err = verifier.Verify(ctx, signToken(t, key, "k1", validClaims()))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), fetches.Load(), "the key set is cached")
+
+	// Cached keys are used while the identity provider cannot be reached.
+	failing.Store(true)
+	verifier.keys.fetchedAt = time.Time{}
+	_, err = verifier.Verify(ctx, signToken(t, key, "k1", validClaims()))
+	assert.NoError(t, err)
+
+	unreachable, err := NewJWTVerifier(jwtConfig(server.URL))
+	require.NoError(t, err)
+	_, err = unreachable.Verify(ctx, signToken(t, key, "k1", validClaims()))
+	var appErr *types.AppError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, http.StatusServiceUnavailable, appErr.HTTPStatus)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/tenant"
+)
+
+const apiKeyUsage = `usage:
+  apikey create -name <name> -scopes <scope>[,<scope>...] [-groups <group>[,<group>...]] [-tenant <id>]
+  apikey revoke <id>
+  apikey list
+
+scopes: %s
+`
+
+// runAPIKeyCommand mints, revokes or lists API keys in the key store selected by
+// cfg, and returns the process exit code.
+func runAPIKeyCommand(cfg *config.Config, args []string) int {
+	if cfg.Auth.APIKeys == "" || cfg.Auth.APIKeys == "none" {
+		fmt.Fprintln(os.Stderr, "API keys are disabled; set auth.apiKeys to metadata or file")
+		return 1
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, apiKeyUsage, strings.Join(auth.Scopes, ", "))
+		return 2
+	}
+
+	ctx := context.Background()
+	metadataRepository, err := newMetadataRepository(ctx, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create metadata repository:", err)
+		return 1
+	}
+	defer metadataRepository.Close()
+	keyStore, err := newKeyStore(cfg, metadataRepository)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open API key store:", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := flags.String("name", "", "what the key is for, such as the client that uses it")
+		scopes := flags.String("scopes", "", "comma separated scopes to grant: "+strings.Join(auth.Scopes, ", "))
+		groups := flags.String("groups", "", "comma separated teams the key belongs to; its uploads are shared with the first")
+		tenantID := flags.String("tenant", "", "the tenant the key belongs to; keys without one may only name a tenant in the tenancy header with the tenants:select scope")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *name == "" {
+			fmt.Fprintln(os.Stderr, "-name is required")
+			return 2
+		}
+
+		var groupList []string
+		if *groups != "" {
+			groupList = strings.Split(*groups, ",")
+		}
+		token, key, err := auth.NewAPIKey(*name, strings.Split(*scopes, ","), groupList)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid API key:", err)
+			return 2
+		}
+		if *tenantID != "" && !tenant.ValidID(*tenantID) {
+			fmt.Fprintln(os.Stderr, "Invalid API key: tenant ID must be 1 to 63 lowercase letters, digits or dashes")
+			return 2
+		}
+		key.Tenant = *tenantID
+		if err := keyStore.CreateAPIKey(ctx, key); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to store API key:", err)
+			return 1
+		}
+		fmt.Printf("Created API key %s (%s) with scopes %s.\n", key.ID, key.Name, strings.Join(key.Scopes, ", "))
+		fmt.Println("It is not stored and cannot be shown again:")
+		fmt.Println(token)
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, apiKeyUsage, strings.Join(auth.Scopes, ", "))
+			return 2
+		}
+		if err := keyStore.RevokeAPIKey(ctx, args[1], time.Now().UTC()); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to revoke API key:", err)
+			return 1
+		}
+		fmt.Printf("Revoked API key %s.\n", args[1])
+	case "list":
+		keys, err := keyStore.ListAPIKeys(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to list API keys:", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tGROUPS\tTENANT\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+			tenantID := key.Tenant
+			if tenantID == "" {
+				tenantID = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), strings.Join(key.Groups, ","), tenantID, key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		w.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, apiKeyUsage, strings.Join(auth.Scopes, ", "))
+		return 2
+	}
+	return 0
+}
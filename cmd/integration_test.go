@@ -4,6 +4,8 @@ package main_test
 
 import (
 	"net/http"
+	"os/exec"
+	"strings"
 	"testing"
 	"time"
 )
@@ -50,9 +52,35 @@ func uploadEndpoint(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to request upload endpoint: %v", err)
 	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized { // Expecting unauthorized as no API key is sent
+		t.Errorf("upload endpoint test failed: expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://nginx:80/upload", nil)
+	if err != nil {
+		t.Fatalf("Failed to create upload request: %v", err)
+	}
+	req.Header.Set("X-API-Key", mintAPIKey(t))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to request upload endpoint: %v", err)
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusBadRequest { // Expecting bad request as no file is sent
 		t.Errorf("upload endpoint test failed: expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
 	}
 }
+
+// mintAPIKey creates an API key with the apikey command. The key file is on a volume
+// shared with go-service, which reads it again once it changes.
+func mintAPIKey(t *testing.T) string {
+	out, err := exec.Command("/app/server", "-config", "/app/config.yml", "apikey", "create", "-name", "integration-tests", "-scopes", "files:write").Output()
+	if err != nil {
+		t.Fatalf("Failed to mint API key: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}
@@ -9,14 +9,20 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"time"
 
+	"github.com/pizza-nz/file-uploader/auth"
 	"github.com/pizza-nz/file-uploader/config"
 	"github.com/pizza-nz/file-uploader/handlers"
 	"github.com/pizza-nz/file-uploader/logging"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/metrics"
 	"github.com/pizza-nz/file-uploader/middleware"
 	"github.com/pizza-nz/file-uploader/services"
 	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/tracing"
 )
 
 func handleStartupError(msg string, err error) {
@@ -39,9 +45,18 @@ func main() {
 		handleStartupError("Configuration validation failed", err)
 	}
 
+	if flag.Arg(0) == "apikey" {
+		os.Exit(runAPIKeyCommand(cfg, flag.Args()[1:]))
+	}
+
 	logger := logging.NewLogger(cfg.Logging.Level)
 	slog.SetDefault(logger)
 
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, cfg.Environment)
+	if err != nil {
+		handleStartupError("Failed to set up tracing", err)
+	}
+
 	var fileStorage storage.FileStorage
 	switch cfg.StorageType {
 	case "s3":
@@ -50,22 +65,138 @@ func main() {
 		if err != nil {
 			handleStartupError("Failed to create S3 storage", err)
 		}
+	case "local":
+		var err error
+		fileStorage, err = storage.NewLocalStorage(cfg.File.Path)
+		if err != nil {
+			handleStartupError("Failed to create local storage", err)
+		}
 	case "mock":
 		fileStorage = storage.NewMockFileStorage()
 	default:
 		handleStartupError("Invalid storage type", fmt.Errorf("storage type '%s' is not supported", cfg.StorageType))
 	}
 
-	fileUploadService := services.NewFileUploadService(fileStorage, cfg.File.AllowedTypes)
+	metadataRepository, err := newMetadataRepository(context.Background(), cfg)
+	if err != nil {
+		handleStartupError("Failed to create metadata repository", err)
+	}
+
+	keyStore, err := newKeyStore(cfg, metadataRepository)
+	if err != nil {
+		handleStartupError("Failed to open API key store", err)
+	}
+	var jwtVerifier *auth.JWTVerifier
+	if cfg.Auth.JWT.JWKS != "" {
+		jwtVerifier, err = auth.NewJWTVerifier(cfg.Auth.JWT)
+		if err != nil {
+			handleStartupError("Invalid JWT settings", err)
+		}
+	}
+	tenantResolver, err := tenant.NewResolver(cfg.Tenancy)
+	if err != nil {
+		handleStartupError("Invalid tenancy settings", err)
+	}
+	resolveTenant := middleware.ResolveTenant(tenantResolver)
+	// protect requires a caller holding scope for a route, unless authentication is
+	// off, and then finds the tenant the request is made for.
+	protect := func(scope string, next http.HandlerFunc) http.HandlerFunc { return resolveTenant(next) }
+	if keyStore != nil || jwtVerifier != nil {
+		authenticator := middleware.NewAuthenticator(keyStore, jwtVerifier)
+		protect = func(scope string, next http.HandlerFunc) http.HandlerFunc {
+			return authenticator.Require(scope, resolveTenant(next))
+		}
+	} else {
+		slog.Warn("Authentication is disabled; every route can be used anonymously")
+	}
+
+	if cfg.Deduplicate {
+		blobIndex, ok := metadataRepository.(storage.BlobIndex)
+		if !ok {
+			handleStartupError("Invalid metadata store", fmt.Errorf("metadata store '%s' cannot index deduplicated blobs", cfg.MetadataStore))
+		}
+		fileStorage, err = storage.NewDedupStorage(fileStorage, blobIndex, filepath.Join(cfg.File.Path, ".dedup"))
+		if err != nil {
+			handleStartupError("Failed to create deduplicating storage", err)
+		}
+	}
+
+	usageStore, ok := metadataRepository.(metadata.UsageStore)
+	if !ok {
+		handleStartupError("Invalid metadata store", fmt.Errorf("metadata store '%s' cannot keep storage usage", cfg.MetadataStore))
+	}
+	quotaService := services.NewQuotaService(usageStore, cfg.Quotas)
+
+	fileUploadService := services.NewFileUploadService(fileStorage, metadataRepository, quotaService, services.OwnershipPolicy{}, cfg.File.AllowedTypes, cfg.File.BatchConcurrency)
 
 	mux := http.NewServeMux()
 	handl := handlers.NewFileUploadHandler(cfg.File.MaxSize, fileUploadService)
-	mux.HandleFunc("POST /upload", handl.CreateFileUpload)
+	mux.HandleFunc("POST /upload", protect(auth.ScopeFilesWrite, handl.CreateFileUpload))
+	mux.HandleFunc("POST /upload/batch", protect(auth.ScopeFilesWrite, handl.CreateFileUploads))
+	mux.HandleFunc("GET /files", protect(auth.ScopeFilesRead, handl.ListFileUploads))
+	mux.HandleFunc("PUT /files/{name}", protect(auth.ScopeFilesWrite, handl.PutFileUpload))
+	mux.HandleFunc("GET /files/{id}", protect(auth.ScopeFilesRead, handl.GetFileUpload))
+	mux.HandleFunc("DELETE /files/{id}", protect(auth.ScopeFilesDelete, handl.DeleteFileUpload))
+	mux.HandleFunc("GET /usage", protect(auth.ScopeFilesRead, handlers.NewUsageHandler(quotaService).GetUsage))
+
+	pendingUploads, ok := metadataRepository.(metadata.PendingUploadStore)
+	if !ok {
+		handleStartupError("Invalid metadata store", fmt.Errorf("metadata store '%s' cannot keep presigned uploads", cfg.MetadataStore))
+	}
+	presignService := services.NewPresignService(fileStorage, metadataRepository, pendingUploads, quotaService, services.OwnershipPolicy{}, cfg.File.AllowedTypes, cfg.File.MaxSize, time.Duration(cfg.AWS.S3.PresignedURLExpiry)*time.Minute, tenantResolver.Tenants())
+	presignHandler := handlers.NewPresignHandler(presignService)
+	mux.HandleFunc("GET /files/{id}/url", protect(auth.ScopeFilesRead, presignHandler.CreateDownloadURL))
+	mux.HandleFunc("POST /presigned-uploads", protect(auth.ScopeFilesWrite, presignHandler.CreateUploadURL))
+	mux.HandleFunc("POST /presigned-uploads/{id}/complete", protect(auth.ScopeFilesWrite, presignHandler.CompleteUpload))
+
+	sessionStore, err := services.NewFileSessionStore(filepath.Join(cfg.File.Path, ".sessions"))
+	if err != nil {
+		handleStartupError("Failed to create upload session store", err)
+	}
+	sessionService := services.NewUploadSessionService(fileStorage, metadataRepository, quotaService, sessionStore, cfg.File.AllowedTypes, cfg.File.MaxSize, int64(cfg.File.ChunkSize), cfg.File.TimeoutDuration())
+	sessionHandler := handlers.NewUploadSessionHandler(sessionService, cfg.File.TimeoutDuration())
+	mux.HandleFunc("POST /uploads", protect(auth.ScopeFilesWrite, sessionHandler.CreateSession))
+	mux.HandleFunc("GET /uploads/{id}", protect(auth.ScopeFilesWrite, sessionHandler.GetSession))
+	mux.HandleFunc("PUT /uploads/{id}/chunks/{chunk}", protect(auth.ScopeFilesWrite, sessionHandler.UploadChunk))
+	mux.HandleFunc("POST /uploads/{id}/complete", protect(auth.ScopeFilesWrite, sessionHandler.CompleteSession))
+	mux.HandleFunc("DELETE /uploads/{id}", protect(auth.ScopeFilesWrite, sessionHandler.AbortSession))
+
+	tusService, err := services.NewTusService(fileStorage, metadataRepository, quotaService, filepath.Join(cfg.File.Path, ".tus"), cfg.File.AllowedTypes, cfg.File.MaxSize)
+	if err != nil {
+		handleStartupError("Failed to create tus upload service", err)
+	}
+	tusHandler := handlers.NewTusHandler(tusService, "/tus/", cfg.File.MaxSize)
+	mux.HandleFunc("OPTIONS /tus/", tusHandler.Options)
+	mux.HandleFunc("POST /tus/{$}", protect(auth.ScopeFilesWrite, tusHandler.CreateUpload))
+	mux.HandleFunc("HEAD /tus/{id}", protect(auth.ScopeFilesWrite, tusHandler.HeadUpload))
+	mux.HandleFunc("PATCH /tus/{id}", protect(auth.ScopeFilesWrite, tusHandler.PatchUpload))
+	mux.HandleFunc("DELETE /tus/{id}", protect(auth.ScopeFilesWrite, tusHandler.TerminateUpload))
 	mux.HandleFunc("GET /health", handlers.HealthCheck)
+	mux.HandleFunc("GET /livez", handlers.Livez)
+	readinessChecks := append([]services.DependencyCheck{
+		services.StorageCheck(fileStorage),
+		services.MetadataCheck(metadataRepository),
+		services.DiskSpaceCheck(cfg.File.Path, uint64(cfg.Health.MinFreeDisk)),
+	}, services.TenantStorageChecks(fileStorage, tenantResolver.Tenants())...)
+	readinessService := services.NewReadinessService(readinessChecks, time.Duration(cfg.Health.Timeout)*time.Second, time.Duration(*cfg.Health.CacheTTL)*time.Second)
+	mux.HandleFunc("GET /readyz", handlers.NewReadinessHandler(readinessService).Readyz)
+
+	accessLog, err := middleware.NewAccessLog(cfg.Server.TrustedProxies)
+	if err != nil {
+		handleStartupError("Invalid trusted proxies", err)
+	}
 
 	server := http.Server{
 		Addr:    cfg.Server.Port,
-		Handler: middleware.RequestIDMiddleware(mux),
+		Handler: middleware.RequestIDMiddleware(accessLog.FromTrustedProxy, accessLog.Middleware(middleware.MetricsMiddleware(mux))),
+	}
+
+	// Metrics are served on their own port, which the load balancer and proxy do not expose.
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("GET /metrics", metrics.Handler())
+	metricsServer := http.Server{
+		Addr:    cfg.Server.MetricsPort,
+		Handler: metricsMux,
 	}
 
 	go func() {
@@ -74,6 +205,12 @@ func main() {
 			handleStartupError("Server failed to start", err)
 		}
 	}()
+	go func() {
+		slog.Info("Starting metrics server", "addr", cfg.Server.MetricsPort)
+		if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			handleStartupError("Metrics server failed to start", err)
+		}
+	}()
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
@@ -89,6 +226,50 @@ func main() {
 	} else {
 		slog.Info("Server shutdown gracefully")
 	}
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Metrics server shutdown failed", "error", err)
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+
+	if err := metadataRepository.Close(); err != nil {
+		slog.Error("Failed to close metadata repository", "error", err)
+	}
 
 	os.Exit(0)
 }
+
+// newMetadataRepository opens the metadata store selected by cfg.
+func newMetadataRepository(ctx context.Context, cfg *config.Config) (metadata.Repository, error) {
+	switch cfg.MetadataStore {
+	case "postgres":
+		return metadata.NewPostgresRepository(ctx, cfg.Database)
+	case "sqlite":
+		return metadata.NewSQLiteRepository(ctx, cfg.Database.Path)
+	case "memory":
+		return metadata.NewMemoryRepository(), nil
+	default:
+		return nil, fmt.Errorf("metadata store '%s' is not supported", cfg.MetadataStore)
+	}
+}
+
+// newKeyStore opens the API key store selected by cfg, or returns nil if API keys
+// are not required.
+func newKeyStore(cfg *config.Config, metadataRepository metadata.Repository) (auth.KeyStore, error) {
+	switch cfg.Auth.APIKeys {
+	case "", "none":
+		return nil, nil
+	case "metadata":
+		keyStore, ok := metadataRepository.(auth.KeyStore)
+		if !ok {
+			return nil, fmt.Errorf("metadata store '%s' cannot keep API keys", cfg.MetadataStore)
+		}
+		return keyStore, nil
+	case "file":
+		return auth.NewFileKeyStore(cfg.Auth.KeysFile)
+	default:
+		return nil, fmt.Errorf("auth apiKeys '%s' is not supported", cfg.Auth.APIKeys)
+	}
+}
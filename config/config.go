@@ -2,48 +2,188 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Environment string         `yaml:"environment"`
-	StorageType string         `yaml:"storage_type"`
-	Server      ServerConfig   `yaml:"server"`
-	File        FileConfig     `yaml:"file"`
-	Logging     LoggingConfig  `yaml:"logging"`
-	Database    DatabaseConfig `yaml:"database"`
-	AWS         AWSConfig      `yaml:"aws"`
+	Environment   string         `yaml:"environment"`
+	StorageType   string         `yaml:"storage_type"`
+	MetadataStore string         `yaml:"metadata_store"`
+	Deduplicate   bool           `yaml:"deduplicate"`
+	Server        ServerConfig   `yaml:"server"`
+	File          FileConfig     `yaml:"file"`
+	Logging       LoggingConfig  `yaml:"logging"`
+	Tracing       TracingConfig  `yaml:"tracing"`
+	Auth          AuthConfig     `yaml:"auth"`
+	Tenancy       TenancyConfig  `yaml:"tenancy"`
+	Quotas        QuotaConfig    `yaml:"quotas"`
+	Health        HealthConfig   `yaml:"health"`
+	Database      DatabaseConfig `yaml:"database"`
+	AWS           AWSConfig      `yaml:"aws"`
 }
 
 type ServerConfig struct {
 	Port string `yaml:"port"`
 	Host string `yaml:"host"`
+	// TrustedProxies are the IP addresses or CIDR prefixes of proxies whose
+	// X-Forwarded-For header is believed when logging client addresses, and whose
+	// X-Request-ID is kept.
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// MetricsPort is the address /metrics is served on, apart from the API so that
+	// whatever exposes the API does not expose the metrics too.
+	MetricsPort string `yaml:"metricsPort"`
 }
 
 type FileConfig struct {
-	MaxSize      int64    `yaml:"maxSize"`
-	AllowedTypes []string `yaml:"allowedTypes"`
-	Path         string   `yaml:"path"`
-	Timeout      int      `yaml:"timeout"`
-	Unit         string   `yaml:"unit"`
-	ChunkSize    int      `yaml:"chunkSize"`
+	MaxSize          int64    `yaml:"maxSize"`
+	AllowedTypes     []string `yaml:"allowedTypes"`
+	Path             string   `yaml:"path"`
+	Timeout          int      `yaml:"timeout"`
+	Unit             string   `yaml:"unit"`
+	ChunkSize        int      `yaml:"chunkSize"`
+	BatchConcurrency int      `yaml:"batchConcurrency"`
+}
+
+// minS3ChunkSize is the smallest part S3 accepts in a multipart upload, other than the last part.
+const minS3ChunkSize = 5 << 20
+
+var timeoutUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// TimeoutDuration returns Timeout expressed in Unit ("ms", "s", "m" or "h").
+func (f FileConfig) TimeoutDuration() time.Duration {
+	return time.Duration(f.Timeout) * timeoutUnits[f.Unit]
 }
 
 type LoggingConfig struct {
 	Level string `yaml:"level"`
 }
 
+// HealthConfig tunes the dependency checks behind GET /readyz.
+type HealthConfig struct {
+	// Timeout is how long each check may take, in seconds. 0 means the default of 2.
+	Timeout int `yaml:"timeout"`
+	// CacheTTL is how long, in seconds, a readiness report is reused before the
+	// dependencies are checked again. 0 checks them on every probe; when it is not
+	// set, reports are reused for 5 seconds.
+	CacheTTL *int `yaml:"cacheTTL"`
+	// MinFreeDisk is the free space, in bytes, required on the volume holding
+	// File.Path. It defaults to File.MaxSize.
+	MinFreeDisk int64 `yaml:"minFreeDisk"`
+}
+
+// AuthConfig selects how callers prove who they are: API keys, bearer JWTs issued
+// by an OIDC identity provider, or both.
+type AuthConfig struct {
+	// APIKeys is "metadata" to keep keys in the metadata database, "file" to keep
+	// them in KeysFile, or "none" to accept no API keys. It may only be left out
+	// when JWT.JWKS is set, and no API keys are accepted then.
+	APIKeys  string    `yaml:"apiKeys"`
+	KeysFile string    `yaml:"keysFile"`
+	JWT      JWTConfig `yaml:"jwt"`
+}
+
+// JWTConfig describes the bearer JWTs that are accepted. JWTs are only accepted
+// when JWKS is set.
+type JWTConfig struct {
+	// JWKS is the URL, or file path, of the JSON Web Key Set the tokens are signed with.
+	JWKS string `yaml:"jwks"`
+	// CacheTTL is how long, in seconds, the key set is used before it is read again.
+	CacheTTL int    `yaml:"cacheTTL"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// RolesClaim is the claim holding the caller's roles. Dots separate the names of
+	// nested claims, as in "realm_access.roles".
+	RolesClaim string `yaml:"rolesClaim"`
+	// GroupsClaim is the claim holding the teams the caller belongs to, named as
+	// RolesClaim is.
+	GroupsClaim string `yaml:"groupsClaim"`
+	// TenantClaim is the claim naming the tenant the caller belongs to, named as
+	// RolesClaim is.
+	TenantClaim string `yaml:"tenantClaim"`
+	// RoleScopes lists the scopes granted to each role. Scopes in a token's scope
+	// claim are granted too.
+	RoleScopes map[string][]string `yaml:"roleScopes"`
+}
+
+// TenancyConfig lets one deployment serve several customers, each with its own
+// files and upload limits. A request's tenant is the one its credentials belong
+// to or, for credentials that belong to none, the one named in Header.
+type TenancyConfig struct {
+	// Header is the request header naming the tenant. When it is empty, only
+	// credentials select a tenant.
+	Header string `yaml:"header"`
+	// Required rejects requests that resolve to no tenant. Otherwise their files
+	// are kept apart from every tenant's, as they were before tenants existed.
+	Required bool `yaml:"required"`
+	// Tenants holds the settings of tenants that differ from the defaults in File
+	// and AWS.S3. Tenants that are not listed use the defaults.
+	Tenants map[string]TenantConfig `yaml:"tenants"`
+}
+
+// TenantConfig overrides the defaults for one tenant.
+type TenantConfig struct {
+	// Bucket is an S3 bucket holding only this tenant's files. When it is empty,
+	// the tenant's files are kept under tenant/<id>/ in the shared bucket.
+	Bucket       string      `yaml:"bucket"`
+	AllowedTypes []string    `yaml:"allowedTypes"`
+	MaxSize      int64       `yaml:"maxSize"`
+	Quotas       QuotaConfig `yaml:"quotas"`
+}
+
+// QuotaConfig limits how much may be stored. In TenantConfig, a limit that is not
+// set keeps the deployment's default.
+type QuotaConfig struct {
+	// Tenant limits the files of each tenant. Files that belong to no tenant are
+	// limited as one more tenant.
+	Tenant Quota `yaml:"tenant"`
+	// User limits the files each caller uploads within its tenant.
+	User Quota `yaml:"user"`
+}
+
+// Quota is a limit on stored files. Zero means no limit.
+type Quota struct {
+	MaxBytes   int64 `yaml:"maxBytes"`
+	MaxObjects int64 `yaml:"maxObjects"`
+}
+
+type TracingConfig struct {
+	// Exporter is where spans are sent: "none", "stdout", "file" or "otlp".
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of an OTLP/HTTP collector. When it is empty the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable applies, then localhost:4318.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans to Endpoint over plain HTTP.
+	Insecure bool `yaml:"insecure"`
+	// Path is the file spans are appended to when Exporter is "file".
+	Path string `yaml:"path"`
+	// SampleRatio is the fraction of new traces that are recorded, or every one when
+	// it is not set. Requests whose traceparent says the caller is recording are
+	// always recorded.
+	SampleRatio *float64 `yaml:"sampleRatio"`
+}
+
 type DatabaseConfig struct {
 	Host     string `yaml:"host"`
 	Port     int    `yaml:"port"`
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
 	Dbname   string `yaml:"dbname"`
+	// SSLMode is passed to the driver as sslmode. The driver default applies when it is empty.
+	SSLMode string `yaml:"sslmode"`
+	// Path is the database file used when MetadataStore is "sqlite".
+	Path string `yaml:"path"`
 }
 
 type S3Config struct {
@@ -85,6 +225,52 @@ func NewConfig(configPath string) (*Config, error) {
 	config.AWS.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
 	config.AWS.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
 
+	// Keep the database password out of config.yml in deployed environments
+	if password := os.Getenv("DB_PASSWORD"); password != "" {
+		config.Database.Password = password
+	}
+
+	if config.Server.MetricsPort == "" {
+		config.Server.MetricsPort = ":9090"
+	}
+
+	if config.File.BatchConcurrency == 0 {
+		config.File.BatchConcurrency = 4
+	}
+
+	if config.Health.Timeout == 0 {
+		config.Health.Timeout = 2
+	}
+	if config.Health.CacheTTL == nil {
+		cacheTTL := 5
+		config.Health.CacheTTL = &cacheTTL
+	}
+	if config.Health.MinFreeDisk == 0 {
+		config.Health.MinFreeDisk = config.File.MaxSize
+	}
+
+	if config.Tracing.Exporter == "" {
+		config.Tracing.Exporter = "none"
+	}
+
+	if config.Auth.JWT.CacheTTL == 0 {
+		config.Auth.JWT.CacheTTL = 300
+	}
+	if config.Auth.JWT.RolesClaim == "" {
+		config.Auth.JWT.RolesClaim = "roles"
+	}
+	if config.Auth.JWT.GroupsClaim == "" {
+		config.Auth.JWT.GroupsClaim = "groups"
+	}
+	if config.Auth.JWT.TenantClaim == "" {
+		config.Auth.JWT.TenantClaim = "tenant"
+	}
+
+	// File metadata is kept in memory unless a database is configured
+	if config.MetadataStore == "" {
+		config.MetadataStore = "memory"
+	}
+
 	return config, nil
 }
 
@@ -94,15 +280,181 @@ func ValidateConfig(config *Config) error {
 	if config.Server.Port == "" {
 		return errors.New("server port is not set")
 	}
+	if config.Server.MetricsPort == config.Server.Port {
+		return errors.New("server metricsPort must differ from port")
+	}
 	if config.File.MaxSize == 0 {
 		return errors.New("File max size is not set")
 	}
 	if config.File.Path == "" {
 		return errors.New("File path is not set")
 	}
+	if config.File.ChunkSize <= 0 {
+		return errors.New("File chunk size is not set")
+	}
+	if config.File.BatchConcurrency < 0 {
+		return errors.New("File batch concurrency must not be negative")
+	}
+	if _, ok := timeoutUnits[config.File.Unit]; !ok || config.File.Timeout <= 0 {
+		return fmt.Errorf("File timeout is invalid: %d%s", config.File.Timeout, config.File.Unit)
+	}
 	if config.Logging.Level == "" {
 		return errors.New("Logging level is not set")
 	}
+
+	switch config.MetadataStore {
+	case "memory":
+	case "postgres":
+		if err := validateDatabaseConfig(config.Database); err != nil {
+			return err
+		}
+	case "sqlite":
+		if config.Database.Path == "" {
+			return errors.New("Database path is not set")
+		}
+	default:
+		return fmt.Errorf("metadata store '%s' is not supported", config.MetadataStore)
+	}
+
+	if config.Health.Timeout < 0 || (config.Health.CacheTTL != nil && *config.Health.CacheTTL < 0) || config.Health.MinFreeDisk < 0 {
+		return errors.New("Health settings must not be negative")
+	}
+	if !config.Quotas.valid() {
+		return errors.New("Quotas must not be negative")
+	}
+	if err := validateTracingConfig(config.Tracing); err != nil {
+		return err
+	}
+	if err := validateAuthConfig(config); err != nil {
+		return err
+	}
+	if err := validateTenancyConfig(config); err != nil {
+		return err
+	}
+
+	// Blob references must outlive a restart, or deduplicated files become unreachable.
+	if config.Deduplicate && config.MetadataStore == "memory" {
+		return errors.New("deduplicate requires the postgres or sqlite metadata store")
+	}
+	// Usage kept in memory is lost on restart and is not shared between instances.
+	if config.MetadataStore == "memory" && config.quotasSet() {
+		return errors.New("quotas require the postgres or sqlite metadata store")
+	}
+
+	// AWS settings are only required when files are stored in S3, so the local
+	// and mock backends can run without any AWS credentials.
+	if config.StorageType == "s3" {
+		return validateAWSConfig(config)
+	}
+	return nil
+}
+
+func validateTracingConfig(tracing TracingConfig) error {
+	switch tracing.Exporter {
+	case "none", "stdout", "otlp":
+	case "file":
+		if tracing.Path == "" {
+			return errors.New("Tracing path is not set")
+		}
+	default:
+		return fmt.Errorf("tracing exporter '%s' is not supported", tracing.Exporter)
+	}
+	if tracing.SampleRatio != nil && (*tracing.SampleRatio < 0 || *tracing.SampleRatio > 1) {
+		return fmt.Errorf("Tracing sample ratio must be between 0 and 1: %g", *tracing.SampleRatio)
+	}
+	return nil
+}
+
+func validateAuthConfig(config *Config) error {
+	// Anonymous access has to be asked for, so a config that leaves out the auth
+	// section does not start a service anyone can write to.
+	if config.Auth.APIKeys == "" && config.Auth.JWT.JWKS == "" {
+		return errors.New("Auth is not configured: set auth.apiKeys to metadata, file or none, or set auth.jwt.jwks")
+	}
+
+	switch config.Auth.APIKeys {
+	case "", "none":
+	case "metadata":
+		// Keys are minted by a separate process, which cannot reach an in-memory store.
+		if config.MetadataStore == "memory" {
+			return errors.New("auth apiKeys 'metadata' requires the postgres or sqlite metadata store")
+		}
+	case "file":
+		if config.Auth.KeysFile == "" {
+			return errors.New("Auth keys file is not set")
+		}
+	default:
+		return fmt.Errorf("auth apiKeys '%s' is not supported", config.Auth.APIKeys)
+	}
+
+	if jwt := config.Auth.JWT; jwt.JWKS != "" {
+		// Without both, a token issued for any other application would be accepted.
+		if jwt.Issuer == "" {
+			return errors.New("Auth JWT issuer is not set")
+		}
+		if jwt.Audience == "" {
+			return errors.New("Auth JWT audience is not set")
+		}
+		if jwt.CacheTTL < 0 {
+			return errors.New("Auth JWT cache TTL must not be negative")
+		}
+	}
+	return nil
+}
+
+func validateTenancyConfig(config *Config) error {
+	for id, tenant := range config.Tenancy.Tenants {
+		if tenant.MaxSize < 0 {
+			return fmt.Errorf("Tenant %s max size must not be negative", id)
+		}
+		if !tenant.Quotas.valid() {
+			return fmt.Errorf("Tenant %s quotas must not be negative", id)
+		}
+		if tenant.Bucket != "" && config.StorageType != "s3" {
+			return fmt.Errorf("Tenant %s bucket requires the s3 storage type", id)
+		}
+	}
+	return nil
+}
+
+func (q QuotaConfig) valid() bool {
+	return q.Tenant.MaxBytes >= 0 && q.Tenant.MaxObjects >= 0 && q.User.MaxBytes >= 0 && q.User.MaxObjects >= 0
+}
+
+func (q QuotaConfig) set() bool {
+	return q.Tenant != (Quota{}) || q.User != (Quota{})
+}
+
+// quotasSet reports whether any quota, global or of a tenant, limits usage.
+func (config *Config) quotasSet() bool {
+	if config.Quotas.set() {
+		return true
+	}
+	for _, tenant := range config.Tenancy.Tenants {
+		if tenant.Quotas.set() {
+			return true
+		}
+	}
+	return false
+}
+
+func validateDatabaseConfig(database DatabaseConfig) error {
+	if database.Host == "" {
+		return errors.New("Database host is not set")
+	}
+	if database.Port <= 0 {
+		return errors.New("Database port is not set")
+	}
+	if database.User == "" {
+		return errors.New("Database user is not set")
+	}
+	if database.Dbname == "" {
+		return errors.New("Database name is not set")
+	}
+	return nil
+}
+
+func validateAWSConfig(config *Config) error {
 	if config.AWS.Region == "" {
 		return errors.New("AWS region is not set")
 	}
@@ -125,5 +477,8 @@ func ValidateConfig(config *Config) error {
 	if config.AWS.S3.PresignedURLExpiry == 0 {
 		return errors.New("S3 presigned URL expiry is not set")
 	}
+	if config.File.ChunkSize < minS3ChunkSize {
+		return fmt.Errorf("File chunk size must be at least %d bytes for S3 multipart uploads", minS3ChunkSize)
+	}
 	return nil
 }
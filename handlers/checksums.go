@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strings"
+
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// checksumField is the multipart form field that carries a checksum of the uploaded
+// file, as "<algorithm>:<hex digest>". It may be repeated, and must come before the file.
+const checksumField = "checksum"
+
+// maxChecksumFieldSize bounds how much of a checksum field is read. The longest
+// valid value, a SHA-256 digest, is well under this.
+const maxChecksumFieldSize = 256
+
+// checksumTarget returns the field of checksums that holds digests made with algorithm,
+// and the length of those digests. Algorithms are named as in Content-Digest (RFC 9530),
+// with "sha256" accepted as well to match the checksum returned for an upload.
+func checksumTarget(checksums *types.Checksums, algorithm string) (*[]byte, int, bool) {
+	switch strings.ToLower(algorithm) {
+	case "sha-256", "sha256":
+		return &checksums.SHA256, sha256.Size, true
+	case "md5":
+		return &checksums.MD5, md5.Size, true
+	case "crc32c":
+		return &checksums.CRC32C, crc32.Size, true
+	}
+	return nil, 0, false
+}
+
+// addChecksum records a client-supplied digest, rejecting one that has the wrong
+// length or that disagrees with a digest already supplied for the same algorithm.
+func addChecksum(checksums *types.Checksums, field, algorithm string, sum []byte) error {
+	target, size, ok := checksumTarget(checksums, algorithm)
+	if !ok {
+		return types.NewBadRequestError([]types.Details{types.NewDetails(field, fmt.Sprintf("algorithm %s is not supported", algorithm))})
+	}
+	if len(sum) != size {
+		return types.NewBadRequestError([]types.Details{types.NewDetails(field, fmt.Sprintf("%s digest must be %d bytes", algorithm, size))})
+	}
+	if *target != nil && !bytes.Equal(*target, sum) {
+		return types.NewBadRequestError([]types.Details{types.NewDetails(field, fmt.Sprintf("%s digest conflicts with another %s digest in the request", algorithm, algorithm))})
+	}
+	*target = sum
+	return nil
+}
+
+// parseChecksumHeaders reads the Content-MD5 (RFC 1864) and Content-Digest (RFC 9530)
+// headers of a request whose body is the uploaded file. Content-Digest algorithms
+// that are not supported are ignored, as the RFC requires.
+func parseChecksumHeaders(header http.Header, checksums *types.Checksums) error {
+	if value := header.Get("Content-MD5"); value != "" {
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return types.NewBadRequestError([]types.Details{types.NewDetails("Content-MD5", "must be a base64 encoded MD5 digest")})
+		}
+		if err := addChecksum(checksums, "Content-MD5", "md5", sum); err != nil {
+			return err
+		}
+	}
+
+	for _, value := range header.Values("Content-Digest") {
+		for _, member := range strings.Split(value, ",") {
+			algorithm, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok {
+				return types.NewBadRequestError([]types.Details{types.NewDetails("Content-Digest", "must be a list of algorithm=:digest: pairs")})
+			}
+			if _, _, supported := checksumTarget(checksums, algorithm); !supported {
+				continue
+			}
+			// Discard any parameters after the byte sequence.
+			encoded, _, _ = strings.Cut(encoded, ";")
+			if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+				return types.NewBadRequestError([]types.Details{types.NewDetails("Content-Digest", "digests must be base64 encoded between colons")})
+			}
+			sum, err := base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+			if err != nil {
+				return types.NewBadRequestError([]types.Details{types.NewDetails("Content-Digest", "digests must be base64 encoded between colons")})
+			}
+			if err := addChecksum(checksums, "Content-Digest", algorithm, sum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseChecksumField reads one value of the checksum form field.
+func parseChecksumField(value string, checksums *types.Checksums) error {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), ":")
+	sum, err := hex.DecodeString(encoded)
+	if !ok || err != nil {
+		return types.NewBadRequestError([]types.Details{types.NewDetails(checksumField, "must be an algorithm followed by a colon and a hex encoded digest")})
+	}
+	return addChecksum(checksums, checksumField, algorithm, sum)
+}
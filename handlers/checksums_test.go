@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChecksums(t *testing.T) {
+	md5Sum := md5.Sum([]byte("content"))
+	shaSum := sha256.Sum256([]byte("content"))
+	otherSum := sha256.Sum256([]byte("other content"))
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		fields   []string
+		expected types.Checksums
+		wantErr  bool
+	}{
+		{
+			name:     "Content-MD5",
+			headers:  map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:])},
+			expected: types.Checksums{MD5: md5Sum[:]},
+		},
+		{
+			name:     "Content-Digest with parameters",
+			headers:  map[string]string{"Content-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(shaSum[:]) + ":;note=1"},
+			expected: types.Checksums{SHA256: shaSum[:]},
+		},
+		{
+			name:     "Form fields",
+			fields:   []string{"sha256:" + hex.EncodeToString(shaSum[:]), "crc32c:0a0b0c0d"},
+			expected: types.Checksums{SHA256: shaSum[:], CRC32C: []byte{0x0a, 0x0b, 0x0c, 0x0d}},
+		},
+		{
+			name:    "Conflicting digests",
+			headers: map[string]string{"Content-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(shaSum[:]) + ":"},
+			fields:  []string{"sha256:" + hex.EncodeToString(otherSum[:])},
+			wantErr: true,
+		},
+		{
+			name:    "Digest of the wrong length",
+			headers: map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(shaSum[:])},
+			wantErr: true,
+		},
+		{
+			name:    "Unsupported form field algorithm",
+			fields:  []string{"sha1:" + hex.EncodeToString(md5Sum[:])},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tt.headers {
+				header.Set(name, value)
+			}
+
+			var checksums types.Checksums
+			err := parseChecksumHeaders(header, &checksums)
+			for _, field := range tt.fields {
+				if err == nil {
+					err = parseChecksumField(field, &checksums)
+				}
+			}
+
+			if tt.wantErr {
+				var badRequestErr *types.BadRequestError
+				assert.ErrorAs(t, err, &badRequestErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, checksums)
+		})
+	}
+}
@@ -1,10 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/pizza-nz/file-uploader/services"
+	"github.com/pizza-nz/file-uploader/tenant"
 	"github.com/pizza-nz/file-uploader/types"
 	"github.com/pizza-nz/file-uploader/utils"
 )
@@ -16,11 +27,23 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 type FileUploadHandler interface {
 	CreateFileUpload(w http.ResponseWriter, r *http.Request)
 
+	CreateFileUploads(w http.ResponseWriter, r *http.Request)
+
+	PutFileUpload(w http.ResponseWriter, r *http.Request)
+
 	GetFileUpload(w http.ResponseWriter, r *http.Request)
 
 	DeleteFileUpload(w http.ResponseWriter, r *http.Request)
+
+	ListFileUploads(w http.ResponseWriter, r *http.Request)
 }
 
+const (
+	// defaultListLimit and maxListLimit bound the page size of GET /files.
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
 type FileUploadHandlerImpl struct {
 	maxFileSize int64
 	service     services.FileUploadService
@@ -37,26 +60,417 @@ func (h *FileUploadHandlerImpl) CreateFileUpload(w http.ResponseWriter, r *http.
 	if h.service == nil {
 		panic("FileUploadService is not initialized")
 	}
-	slog.Info("New Put request", "requestID", r.Header.Get("X-Request-ID"))
-	r.ParseMultipartForm(h.maxFileSize)
+	maxFileSize := tenant.MaxSize(r.Context(), h.maxFileSize)
+	slog.InfoContext(r.Context(), "New Put request")
+
+	// Parts are streamed straight to the service rather than buffered by
+	// ParseMultipartForm, so memory use does not grow with the size of the upload.
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+multipartOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		utils.HandleError(w, r, types.NewAppError("Error Reading File", "Request is not a multipart form", http.StatusBadRequest, err))
+		return
+	}
 
-	file, handler, err := r.FormFile("uploadFile")
+	var checksums types.Checksums
+	part, err := nextFilePart(reader, "uploadFile", &checksums)
 	if err != nil {
-		utils.HandleError(w, r, types.NewAppError("Error Reading File", "User file submitted failed to read", http.StatusBadRequest, err))
+		utils.HandleError(w, r, uploadReadError(maxFileSize, err))
 		return
 	}
+	defer part.Close()
 
-	fileUploadResponse, err := h.service.CreateFileUpload(r.Context(), file, handler)
+	req := &types.FileUploadRequest{Filename: part.FileName(), Checksums: checksums}
+	fileUploadResponse, err := h.service.CreateFileUpload(r.Context(), http.MaxBytesReader(w, part, maxFileSize), req)
 	if err != nil {
+		utils.HandleError(w, r, uploadReadError(maxFileSize, err))
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusCreated, fileUploadResponse)
+}
+
+// PutFileUpload stores the raw request body as a file called name, for clients such as
+// curl --upload-file that send a file without a multipart form. Content-Type,
+// Content-Length, Content-MD5 and Content-Digest are optional, and are checked against
+// the file when set.
+func (h *FileUploadHandlerImpl) PutFileUpload(w http.ResponseWriter, r *http.Request) {
+	if h.service == nil {
+		panic("FileUploadService is not initialized")
+	}
+	maxFileSize := tenant.MaxSize(r.Context(), h.maxFileSize)
+	slog.InfoContext(r.Context(), "New raw upload request")
+
+	// Reject a declared size that is too large before reading any of the body.
+	if r.ContentLength > maxFileSize {
+		utils.HandleError(w, r, uploadReadError(maxFileSize, &http.MaxBytesError{Limit: maxFileSize}))
+		return
+	}
+
+	req := &types.FileUploadRequest{
+		Filename:    r.PathValue("name"),
+		ContentType: r.Header.Get("Content-Type"),
+		Size:        r.ContentLength,
+	}
+	if err := parseChecksumHeaders(r.Header, &req.Checksums); err != nil {
 		utils.HandleError(w, r, err)
 		return
 	}
 
+	fileUploadResponse, err := h.service.CreateFileUpload(r.Context(), http.MaxBytesReader(w, r.Body, maxFileSize), req)
+	if err != nil {
+		utils.HandleError(w, r, uploadReadError(maxFileSize, err))
+		return
+	}
+
+	w.Header().Set("Location", "/files/"+url.PathEscape(fileUploadResponse.FileID))
 	utils.JSONResponse(w, r, http.StatusCreated, fileUploadResponse)
 }
+
+// CreateFileUploads stores every file in a multipart form, sent as repeated uploadFile
+// or files[] fields. Each file is checked and stored independently as soon as it has
+// been read: the response is 201 Created if all of them were stored, otherwise 207
+// Multi-Status with the status of each file.
+func (h *FileUploadHandlerImpl) CreateFileUploads(w http.ResponseWriter, r *http.Request) {
+	if h.service == nil {
+		panic("FileUploadService is not initialized")
+	}
+	maxFileSize := tenant.MaxSize(r.Context(), h.maxFileSize)
+	slog.InfoContext(r.Context(), "New batch upload request")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchFiles*maxFileSize+multipartOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		utils.HandleError(w, r, types.NewAppError("Error Reading File", "Request is not a multipart form", http.StatusBadRequest, err))
+		return
+	}
+
+	batch := &uploadBatch{ctx: r.Context(), reader: reader, maxFileSize: maxFileSize}
+	for i, result := range h.service.CreateFileUploads(r.Context(), batch.files) {
+		batch.setResult(batch.stored[i], result.Response, result.Err)
+	}
+	if batch.err != nil && len(batch.stored) == 0 {
+		utils.HandleError(w, r, uploadReadError(maxFileSize, batch.err))
+		return
+	}
+	if len(batch.results) == 0 {
+		utils.HandleError(w, r, types.NewAppError("Error Reading File", "No files were submitted in the uploadFile or files[] fields", http.StatusBadRequest, nil))
+		return
+	}
+
+	response := types.BatchUploadResponse{Files: batch.results}
+	status := http.StatusCreated
+	if batch.err != nil {
+		// Files read before the error have already been stored, so they are still reported.
+		status = http.StatusMultiStatus
+		_, response.Message, response.Details = utils.DescribeError(r.Context(), uploadReadError(maxFileSize, batch.err))
+	}
+	var failed int
+	for _, result := range batch.results {
+		if result.Status != http.StatusCreated {
+			status = http.StatusMultiStatus
+			failed++
+		}
+	}
+	slog.InfoContext(r.Context(), "Batch upload finished", "files", len(batch.results), "failed", failed)
+	utils.JSONResponse(w, r, status, response)
+}
+
+const (
+	// maxBatchFiles is the most files accepted in one batch upload.
+	maxBatchFiles = 100
+
+	// batchFileField and batchFileArrayField are the form fields whose files are
+	// stored by a batch upload.
+	batchFileField      = "uploadFile"
+	batchFileArrayField = "files[]"
+)
+
+// uploadBatch reads the files of a batch upload from a multipart form. Every file has a
+// result, in the order it was sent. Since the form can only be read one part at a time,
+// each file is spooled to a temporary file and handed over to be stored before the next
+// one is read; the temporary file is removed once the file has been stored.
+type uploadBatch struct {
+	ctx         context.Context
+	reader      *multipart.Reader
+	maxFileSize int64
+
+	results []types.BatchUploadResult
+	// stored holds the index in results of each file handed over to be stored.
+	stored []int
+	// err is why the form stopped being read before its end, if it did. A file over
+	// the size limit fails on its own, but any other read error ends the batch.
+	err error
+}
+
+// files reads the form, yielding each file that was read successfully.
+func (b *uploadBatch) files(yield func(services.BatchFile) bool) {
+	for {
+		part, err := b.reader.NextPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			b.err = types.NewAppError("Error Reading File", "Multipart form is malformed", http.StatusBadRequest, err)
+			return
+		}
+
+		if (part.FormName() != batchFileField && part.FormName() != batchFileArrayField) || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		if len(b.results) == maxBatchFiles {
+			part.Close()
+			b.err = types.NewBadRequestError([]types.Details{types.NewDetails(part.FormName(), fmt.Sprintf("must not contain more than %d files", maxBatchFiles))})
+			return
+		}
+
+		file, err := b.spool(part)
+		part.Close()
+		if err != nil {
+			b.err = err
+			return
+		}
+		if file == nil {
+			continue
+		}
+		b.stored = append(b.stored, len(b.results)-1)
+		if !yield(services.BatchFile{Filename: part.FileName(), Body: file}) {
+			return
+		}
+	}
+}
+
+// spool copies part to a temporary file, or records it as too large and returns nil.
+// The file gets a result unless it could not be read.
+func (b *uploadBatch) spool(part *multipart.Part) (*spooledFile, error) {
+	file, err := os.CreateTemp("", "batch-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	spooled := &spooledFile{File: file}
+
+	n, err := io.Copy(file, io.LimitReader(part, b.maxFileSize+1))
+	if err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if n > b.maxFileSize {
+		spooled.Close()
+		// Skip the rest of this file so the next one can be read.
+		if _, err := io.Copy(io.Discard, part); err != nil {
+			return nil, err
+		}
+		b.results = append(b.results, types.BatchUploadResult{Filename: part.FileName()})
+		b.setResult(len(b.results)-1, nil, types.NewAppError("File Too Large", fmt.Sprintf("File exceeds the maximum of %d bytes", b.maxFileSize), http.StatusRequestEntityTooLarge, nil))
+		return nil, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	b.results = append(b.results, types.BatchUploadResult{Filename: part.FileName()})
+	return spooled, nil
+}
+
+func (b *uploadBatch) setResult(index int, response *types.FileUploadResponse, err error) {
+	result := &b.results[index]
+	if err != nil {
+		result.Status, result.Message, result.Details = utils.DescribeError(b.ctx, err)
+		return
+	}
+	result.Status = http.StatusCreated
+	result.File = response
+}
+
+// spooledFile is a temporary file holding one file of a batch. Closing it removes it.
+type spooledFile struct {
+	*os.File
+}
+
+func (f *spooledFile) Close() error {
+	f.File.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		slog.Error("Failed to remove spooled batch file", "error", err, "path", f.Name())
+		return err
+	}
+	return nil
+}
+
+// multipartOverhead is the allowance for form fields and part headers on top of the
+// file itself when limiting the size of a multipart request body.
+const multipartOverhead = 1 << 20
+
+// nextFilePart skips ahead to the next file in the form field name, collecting any
+// checksum fields sent before it.
+func nextFilePart(reader *multipart.Reader, name string, checksums *types.Checksums) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, types.NewAppError("Error Reading File", fmt.Sprintf("No file was submitted in the %s field", name), http.StatusBadRequest, nil)
+		}
+		if err != nil {
+			return nil, types.NewAppError("Error Reading File", "Multipart form is malformed", http.StatusBadRequest, err)
+		}
+		if part.FormName() == name && part.FileName() != "" {
+			return part, nil
+		}
+		if part.FormName() == checksumField && part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxChecksumFieldSize))
+			if err == nil {
+				err = parseChecksumField(string(value), checksums)
+			}
+			if err != nil {
+				part.Close()
+				return nil, err
+			}
+		}
+		part.Close()
+	}
+}
+
+// uploadReadError turns an error caused by reading past the size limit into a 413.
+func uploadReadError(maxFileSize int64, err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return types.NewAppError("File Too Large", fmt.Sprintf("File exceeds the maximum of %d bytes", maxFileSize), http.StatusRequestEntityTooLarge, err)
+	}
+	return err
+}
+
 func (h *FileUploadHandlerImpl) GetFileUpload(w http.ResponseWriter, r *http.Request) {
+	if h.service == nil {
+		panic("FileUploadService is not initialized")
+	}
+	fileID := r.PathValue("id")
+	slog.InfoContext(r.Context(), "New Get request", "fileID", fileID)
+
+	download, err := h.service.GetFileUpload(r.Context(), fileID)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+	defer download.Body.Close()
+
+	contentType := download.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	filename := download.Filename
+	if filename == "" {
+		filename = download.FileID
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if download.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(download.Size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
 
+	if _, err := io.Copy(w, download.Body); err != nil {
+		// The status line has already been sent, so the client only sees a truncated body.
+		slog.ErrorContext(r.Context(), "Failed to stream file to client", "error", err, "fileID", fileID)
+	}
 }
+
 func (h *FileUploadHandlerImpl) DeleteFileUpload(w http.ResponseWriter, r *http.Request) {
+	if h.service == nil {
+		panic("FileUploadService is not initialized")
+	}
+	fileID := r.PathValue("id")
+	slog.InfoContext(r.Context(), "New Delete request", "fileID", fileID)
+
+	if err := h.service.DeleteFileUpload(r.Context(), fileID); err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *FileUploadHandlerImpl) ListFileUploads(w http.ResponseWriter, r *http.Request) {
+	if h.service == nil {
+		panic("FileUploadService is not initialized")
+	}
+	slog.InfoContext(r.Context(), "New List request", "query", r.URL.RawQuery)
+
+	query, details := parseFileListQuery(r.URL.Query())
+	if len(details) > 0 {
+		utils.HandleError(w, r, types.NewBadRequestError(details))
+		return
+	}
+
+	page, err := h.service.ListFileUploads(r.Context(), query)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusOK, page)
+}
+
+// parseFileListQuery reads the GET /files query parameters, returning every invalid one.
+// Dates are either RFC 3339 timestamps or plain dates, which are taken as midnight UTC.
+func parseFileListQuery(values url.Values) (*types.FileListQuery, []types.Details) {
+	query := &types.FileListQuery{
+		ContentType: values.Get("contentType"),
+		Uploader:    values.Get("uploader"),
+		Sort:        values.Get("sort"),
+		Cursor:      values.Get("cursor"),
+		Limit:       defaultListLimit,
+	}
+	var details []types.Details
+
+	parseInt := func(name string, target *int64) {
+		if value := values.Get(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				details = append(details, types.NewDetails(name, "must be a non-negative integer"))
+				return
+			}
+			*target = n
+		}
+	}
+	parseTime := func(name string, target *time.Time) {
+		if value := values.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				t, err = time.Parse(time.DateOnly, value)
+			}
+			if err != nil {
+				details = append(details, types.NewDetails(name, "must be an RFC 3339 timestamp or a YYYY-MM-DD date"))
+				return
+			}
+			*target = t
+		}
+	}
+
+	parseInt("minSize", &query.MinSize)
+	parseInt("maxSize", &query.MaxSize)
+	parseTime("uploadedAfter", &query.UploadedAfter)
+	parseTime("uploadedBefore", &query.UploadedBefore)
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			details = append(details, types.NewDetails("limit", fmt.Sprintf("must be between 1 and %d", maxListLimit)))
+		} else {
+			query.Limit = limit
+		}
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		details = append(details, types.NewDetails("order", "must be asc or desc"))
+	}
+	if values.Get("order") != "" && query.Sort == "" {
+		details = append(details, types.NewDetails("order", "requires sort"))
+	}
 
+	return query, details
 }
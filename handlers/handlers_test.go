@@ -3,25 +3,55 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"io"
+	"iter"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pizza-nz/file-uploader/services"
 	"github.com/pizza-nz/file-uploader/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Mock FileUploadService
 type MockFileUploadService struct {
-	CreateFileUploadFunc func(ctx context.Context, file multipart.File, handler *multipart.FileHeader) (*types.FileUploadResponse, error)
+	CreateFileUploadFunc  func(ctx context.Context, body io.Reader, req *types.FileUploadRequest) (*types.FileUploadResponse, error)
+	CreateFileUploadsFunc func(ctx context.Context, files iter.Seq[services.BatchFile]) []services.BatchResult
+	GetFileUploadFunc     func(ctx context.Context, fileID string) (*types.FileDownload, error)
+	DeleteFileUploadFunc  func(ctx context.Context, fileID string) error
+	ListFileUploadsFunc   func(ctx context.Context, query *types.FileListQuery) (*types.FileListPage, error)
 }
 
-func (m *MockFileUploadService) CreateFileUpload(ctx context.Context, file multipart.File, handler *multipart.FileHeader) (*types.FileUploadResponse, error) {
-	return m.CreateFileUploadFunc(ctx, file, handler)
+func (m *MockFileUploadService) CreateFileUpload(ctx context.Context, body io.Reader, req *types.FileUploadRequest) (*types.FileUploadResponse, error) {
+	return m.CreateFileUploadFunc(ctx, body, req)
+}
+
+func (m *MockFileUploadService) CreateFileUploads(ctx context.Context, files iter.Seq[services.BatchFile]) []services.BatchResult {
+	return m.CreateFileUploadsFunc(ctx, files)
+}
+
+func (m *MockFileUploadService) GetFileUpload(ctx context.Context, fileID string) (*types.FileDownload, error) {
+	return m.GetFileUploadFunc(ctx, fileID)
+}
+
+func (m *MockFileUploadService) DeleteFileUpload(ctx context.Context, fileID string) error {
+	return m.DeleteFileUploadFunc(ctx, fileID)
+}
+
+func (m *MockFileUploadService) ListFileUploads(ctx context.Context, query *types.FileListQuery) (*types.FileListPage, error) {
+	return m.ListFileUploadsFunc(ctx, query)
 }
 
 func TestCreateFileUpload(t *testing.T) {
@@ -41,6 +71,11 @@ func TestCreateFileUpload(t *testing.T) {
 	var requestBody bytes.Buffer
 	multipartWriter := multipart.NewWriter(&requestBody)
 
+	// Form fields before the file are skipped, apart from checksums of the file
+	assert.NoError(t, multipartWriter.WriteField("description", "receipts"))
+	sum := sha256.Sum256([]byte("test file content"))
+	assert.NoError(t, multipartWriter.WriteField("checksum", "sha256:"+hex.EncodeToString(sum[:])))
+
 	// Create a form file
 	formFile, err := multipartWriter.CreateFormFile("uploadFile", filepath.Base(tempFile.Name()))
 	assert.NoError(t, err)
@@ -52,10 +87,21 @@ func TestCreateFileUpload(t *testing.T) {
 	// Close the multipart writer
 	multipartWriter.Close()
 
+	// readAll stands in for a service that streams the whole file to storage.
+	readAll := func(ctx context.Context, body io.Reader, req *types.FileUploadRequest) (*types.FileUploadResponse, error) {
+		assert.Equal(t, sum[:], req.Checksums.SHA256)
+		content, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		return &types.FileUploadResponse{FileID: "test-file-id", Size: int64(len(content)), Filename: req.Filename}, nil
+	}
+
 	// Test cases
 	tests := []struct {
 		name               string
 		maxFileSize        int64
+		body               []byte
 		service            *MockFileUploadService
 		expectedStatusCode int
 		expectedBody       string
@@ -63,17 +109,17 @@ func TestCreateFileUpload(t *testing.T) {
 		{
 			name:        "Successful file upload",
 			maxFileSize: 10 * 1024 * 1024, // 10 MB
+			body:        requestBody.Bytes(),
 			service: &MockFileUploadService{
-				CreateFileUploadFunc: func(ctx context.Context, file multipart.File, handler *multipart.FileHeader) (*types.FileUploadResponse, error) {
-					return &types.FileUploadResponse{FileID: "test-file-id", Size: 123}, nil
-				},
+				CreateFileUploadFunc: readAll,
 			},
 			expectedStatusCode: http.StatusCreated,
-			expectedBody:       `"fileId":"test-file-id","size":123`,
+			expectedBody:       `"fileId":"test-file-id","size":17,"filename":"` + filepath.Base(tempFile.Name()) + `"`,
 		},
 		{
 			name:               "No file in upload",
 			maxFileSize:        10 * 1024 * 1024, // 10 MB
+			body:               nil,
 			service:            &MockFileUploadService{},
 			expectedStatusCode: http.StatusBadRequest,
 			expectedBody:       `"Error Reading File"`,
@@ -81,25 +127,21 @@ func TestCreateFileUpload(t *testing.T) {
 		{
 			name:        "File greater than maxFileSize",
 			maxFileSize: 5, // 5 bytes
-			service:     &MockFileUploadService{},
-			// The error for file size is handled by r.ParseMultipartForm, so the handler won't even be called.
-			// We expect a bad request.
-			expectedStatusCode: http.StatusBadRequest,
-			expectedBody:       `"Error Reading File"`,
+			body:        requestBody.Bytes(),
+			service: &MockFileUploadService{
+				CreateFileUploadFunc: readAll,
+			},
+			// The file is cut off as soon as it goes over the limit.
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			expectedBody:       `"File Too Large"`,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest("POST", "/upload", &requestBody)
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(tt.body))
 			req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
 
-			if tt.name == "No file in upload" {
-				// Create a new request with an empty body
-				req = httptest.NewRequest("POST", "/upload", nil)
-				req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
-			}
-
 			w := httptest.NewRecorder()
 
 			handler := &FileUploadHandlerImpl{
@@ -114,3 +156,342 @@ func TestCreateFileUpload(t *testing.T) {
 		})
 	}
 }
+
+func TestPutFileUpload(t *testing.T) {
+	content := "raw file content"
+	sum := md5.Sum([]byte(content))
+	sha := sha256.Sum256([]byte(content))
+
+	var received *types.FileUploadRequest
+	service := &MockFileUploadService{
+		CreateFileUploadFunc: func(ctx context.Context, body io.Reader, req *types.FileUploadRequest) (*types.FileUploadResponse, error) {
+			received = req
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return nil, err
+			}
+			return &types.FileUploadResponse{FileID: "test-file-id.pdf", Size: int64(len(data)), Filename: req.Filename}, nil
+		},
+	}
+
+	tests := []struct {
+		name               string
+		maxFileSize        int64
+		contentLength      int64
+		headers            map[string]string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:          "Successful upload",
+			maxFileSize:   1024,
+			contentLength: int64(len(content)),
+			headers: map[string]string{
+				"Content-Type": "application/pdf",
+				"Content-MD5":  base64.StdEncoding.EncodeToString(sum[:]),
+				// Algorithms that are not supported, such as unixsum, are ignored.
+				"Content-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(sha[:]) + ":, unixsum=:MTIz:",
+			},
+			expectedStatusCode: http.StatusCreated,
+			expectedBody:       `"fileId":"test-file-id.pdf"`,
+		},
+		{
+			name:               "Invalid Content-MD5",
+			maxFileSize:        1024,
+			contentLength:      int64(len(content)),
+			headers:            map[string]string{"Content-MD5": "not base64"},
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBody:       `"field":"Content-MD5"`,
+		},
+		{
+			name:               "Declared length too large",
+			maxFileSize:        5,
+			contentLength:      int64(len(content)),
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			expectedBody:       `"File Too Large"`,
+		},
+		{
+			name:               "Streamed body too large",
+			maxFileSize:        5,
+			contentLength:      -1,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			expectedBody:       `"File Too Large"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			mux := http.NewServeMux()
+			mux.HandleFunc("PUT /files/{name}", NewFileUploadHandler(tt.maxFileSize, service).PutFileUpload)
+
+			req := httptest.NewRequest("PUT", "/files/report.pdf", strings.NewReader(content))
+			req.ContentLength = tt.contentLength
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			if tt.expectedStatusCode == http.StatusCreated {
+				assert.Equal(t, "/files/test-file-id.pdf", w.Header().Get("Location"))
+				assert.Equal(t, &types.FileUploadRequest{Filename: "report.pdf", ContentType: "application/pdf", Size: int64(len(content)), Checksums: types.Checksums{MD5: sum[:], SHA256: sha[:]}}, received)
+			}
+			if tt.name == "Declared length too large" {
+				assert.Nil(t, received, "the body must not be read")
+			}
+		})
+	}
+}
+
+func TestCreateFileUploads(t *testing.T) {
+	var requestBody bytes.Buffer
+	multipartWriter := multipart.NewWriter(&requestBody)
+	for _, file := range []struct{ field, name, content string }{
+		{"files[]", "receipt-1.png", "first receipt"},
+		{"files[]", "receipt-2.png", "a receipt that is far too large"},
+		{"uploadFile", "notes.txt", "not an image"},
+	} {
+		formFile, err := multipartWriter.CreateFormFile(file.field, file.name)
+		require.NoError(t, err)
+		_, err = io.WriteString(formFile, file.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, multipartWriter.Close())
+
+	// Stores PNGs and rejects anything else, the way the real service checks file types.
+	service := &MockFileUploadService{
+		CreateFileUploadsFunc: func(ctx context.Context, files iter.Seq[services.BatchFile]) []services.BatchResult {
+			var results []services.BatchResult
+			for file := range files {
+				content, err := io.ReadAll(file.Body)
+				require.NoError(t, err)
+				require.NoError(t, file.Body.Close())
+				if filepath.Ext(file.Filename) != ".png" {
+					results = append(results, services.BatchResult{Err: types.NewAppError("Invalid File Type", "File type text/plain is not allowed", http.StatusBadRequest, nil)})
+					continue
+				}
+				results = append(results, services.BatchResult{Response: &types.FileUploadResponse{FileID: "id-" + file.Filename, Size: int64(len(content)), Filename: file.Filename}})
+			}
+			return results
+		},
+	}
+	handler := &FileUploadHandlerImpl{maxFileSize: 20, service: service}
+
+	req := httptest.NewRequest("POST", "/upload/batch", &requestBody)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	w := httptest.NewRecorder()
+	handler.CreateFileUploads(w, req)
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	var response types.BatchUploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Len(t, response.Files, 3)
+
+	assert.Equal(t, "receipt-1.png", response.Files[0].Filename)
+	assert.Equal(t, http.StatusCreated, response.Files[0].Status)
+	assert.Equal(t, int64(len("first receipt")), response.Files[0].File.Size)
+
+	assert.Equal(t, "receipt-2.png", response.Files[1].Filename)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Files[1].Status)
+	assert.Equal(t, "File Too Large", response.Files[1].Message)
+	assert.Nil(t, response.Files[1].File)
+
+	assert.Equal(t, "notes.txt", response.Files[2].Filename)
+	assert.Equal(t, http.StatusBadRequest, response.Files[2].Status)
+	assert.Equal(t, "Invalid File Type", response.Files[2].Message)
+
+	// A form without any files is rejected outright.
+	requestBody.Reset()
+	multipartWriter = multipart.NewWriter(&requestBody)
+	require.NoError(t, multipartWriter.WriteField("description", "receipts"))
+	require.NoError(t, multipartWriter.Close())
+	req = httptest.NewRequest("POST", "/upload/batch", &requestBody)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	w = httptest.NewRecorder()
+	handler.CreateFileUploads(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// A form that breaks off still reports the files stored before it did.
+	requestBody.Reset()
+	multipartWriter = multipart.NewWriter(&requestBody)
+	formFile, err := multipartWriter.CreateFormFile("files[]", "receipt-1.png")
+	require.NoError(t, err)
+	_, err = io.WriteString(formFile, "first receipt")
+	require.NoError(t, err)
+	_, err = multipartWriter.CreateFormFile("files[]", "receipt-2.png")
+	require.NoError(t, err)
+	req = httptest.NewRequest("POST", "/upload/batch", &requestBody)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	w = httptest.NewRecorder()
+	handler.CreateFileUploads(w, req)
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	response = types.BatchUploadResponse{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Len(t, response.Files, 1)
+	assert.Equal(t, "receipt-1.png", response.Files[0].Filename)
+	assert.Equal(t, http.StatusCreated, response.Files[0].Status)
+	assert.NotEmpty(t, response.Message)
+}
+
+func TestGetFileUpload(t *testing.T) {
+	tests := []struct {
+		name               string
+		service            *MockFileUploadService
+		expectedStatusCode int
+		expectedBody       string
+		expectedHeaders    map[string]string
+	}{
+		{
+			name: "Successful file download",
+			service: &MockFileUploadService{
+				GetFileUploadFunc: func(ctx context.Context, fileID string) (*types.FileDownload, error) {
+					return &types.FileDownload{
+						FileID:      fileID,
+						ContentType: "application/pdf",
+						Size:        int64(len("file content")),
+						Body:        io.NopCloser(strings.NewReader("file content")),
+					}, nil
+				},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "file content",
+			expectedHeaders: map[string]string{
+				"Content-Type":        "application/pdf",
+				"Content-Length":      "12",
+				"Content-Disposition": `attachment; filename=test-file-id.pdf`,
+			},
+		},
+		{
+			name: "File not found",
+			service: &MockFileUploadService{
+				GetFileUploadFunc: func(ctx context.Context, fileID string) (*types.FileDownload, error) {
+					return nil, types.NewNotFoundError(fileID)
+				},
+			},
+			expectedStatusCode: http.StatusNotFound,
+			expectedBody:       `"Resource Not Found"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/files/test-file-id.pdf", nil)
+			req.SetPathValue("id", "test-file-id.pdf")
+			w := httptest.NewRecorder()
+
+			handler := &FileUploadHandlerImpl{service: tt.service}
+			handler.GetFileUpload(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			for header, value := range tt.expectedHeaders {
+				assert.Equal(t, value, w.Header().Get(header))
+			}
+		})
+	}
+}
+
+func TestDeleteFileUpload(t *testing.T) {
+	tests := []struct {
+		name               string
+		service            *MockFileUploadService
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name: "Successful file delete",
+			service: &MockFileUploadService{
+				DeleteFileUploadFunc: func(ctx context.Context, fileID string) error {
+					return nil
+				},
+			},
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name: "File not found",
+			service: &MockFileUploadService{
+				DeleteFileUploadFunc: func(ctx context.Context, fileID string) error {
+					return types.NewNotFoundError(fileID)
+				},
+			},
+			expectedStatusCode: http.StatusNotFound,
+			expectedBody:       `"Resource Not Found"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/files/test-file-id.pdf", nil)
+			req.SetPathValue("id", "test-file-id.pdf")
+			w := httptest.NewRecorder()
+
+			handler := &FileUploadHandlerImpl{service: tt.service}
+			handler.DeleteFileUpload(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+		})
+	}
+}
+
+func TestListFileUploads(t *testing.T) {
+	tests := []struct {
+		name               string
+		query              string
+		expectedQuery      *types.FileListQuery
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "Defaults",
+			query:              "",
+			expectedQuery:      &types.FileListQuery{Limit: defaultListLimit},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       `"nextCursor":"next"`,
+		},
+		{
+			name:  "PDFs uploaded yesterday",
+			query: "contentType=application/pdf&uploadedAfter=2025-06-01&uploadedBefore=2025-06-02T00:00:00Z&minSize=10&sort=size&order=desc&limit=5&cursor=abc",
+			expectedQuery: &types.FileListQuery{
+				ContentType:    "application/pdf",
+				MinSize:        10,
+				UploadedAfter:  time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+				UploadedBefore: time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC),
+				Sort:           types.FileSortSize,
+				Descending:     true,
+				Limit:          5,
+				Cursor:         "abc",
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Invalid parameters",
+			query:              "limit=0&minSize=-1&uploadedAfter=yesterday&order=desc",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBody:       `"field":"limit"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &MockFileUploadService{
+				ListFileUploadsFunc: func(ctx context.Context, query *types.FileListQuery) (*types.FileListPage, error) {
+					assert.Equal(t, tt.expectedQuery, query)
+					return &types.FileListPage{Files: []types.FileMetadata{}, NextCursor: "next"}, nil
+				},
+			}
+			req := httptest.NewRequest("GET", "/files?"+tt.query, nil)
+			w := httptest.NewRecorder()
+
+			handler := &FileUploadHandlerImpl{service: service}
+			handler.ListFileUploads(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+		})
+	}
+}
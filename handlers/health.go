@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/pizza-nz/file-uploader/services"
+	"github.com/pizza-nz/file-uploader/utils"
+)
+
+// Livez reports that the process is up and serving requests. It checks nothing else,
+// so a dependency outage never gets healthy tasks restarted.
+func Livez(w http.ResponseWriter, r *http.Request) {
+	utils.JSONResponse(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+type ReadinessHandler interface {
+	Readyz(w http.ResponseWriter, r *http.Request)
+}
+
+type ReadinessHandlerImpl struct {
+	service services.ReadinessService
+}
+
+func NewReadinessHandler(service services.ReadinessService) ReadinessHandler {
+	return &ReadinessHandlerImpl{service: service}
+}
+
+// Readyz responds 200 when every dependency is usable and 503 otherwise, with whether
+// each check passed either way. Why a check failed is only logged, as the endpoint is
+// public.
+func (h *ReadinessHandlerImpl) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := h.service.Ready(r.Context())
+	if report.Status != "ok" {
+		for name, check := range report.Checks {
+			if check.Status != "ok" {
+				slog.WarnContext(r.Context(), "Dependency check failed", "check", name, "error", check.Error, "latencyMs", check.LatencyMs, "checkedAt", report.CheckedAt)
+			}
+		}
+		utils.JSONResponse(w, r, http.StatusServiceUnavailable, report)
+		return
+	}
+	utils.JSONResponse(w, r, http.StatusOK, report)
+}
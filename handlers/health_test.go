@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticReadinessService struct {
+	report *types.ReadinessReport
+}
+
+func (s staticReadinessService) Ready(ctx context.Context) *types.ReadinessReport {
+	return s.report
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		report     *types.ReadinessReport
+		wantStatus int
+	}{
+		{
+			name:       "ready",
+			report:     &types.ReadinessReport{Status: "ok", CheckedAt: time.Now(), Checks: map[string]types.DependencyCheck{"storage": {Status: "ok"}}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "bucket unreachable",
+			report:     &types.ReadinessReport{Status: "unavailable", CheckedAt: time.Now(), Checks: map[string]types.DependencyCheck{"storage": {Status: "failed", Error: "AccessDenied"}}},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewReadinessHandler(staticReadinessService{report: tt.report})
+			rec := httptest.NewRecorder()
+			handler.Readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			var body map[string]any
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+			assert.Equal(t, tt.report.Status, body["status"])
+			for name, check := range tt.report.Checks {
+				assert.Equal(t, map[string]any{"status": check.Status}, body["checks"].(map[string]any)[name], "only the outcome of each check is public")
+			}
+			assert.Len(t, body, 2)
+		})
+	}
+}
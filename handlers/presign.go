@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/pizza-nz/file-uploader/services"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/pizza-nz/file-uploader/utils"
+)
+
+type PresignHandler interface {
+	CreateDownloadURL(w http.ResponseWriter, r *http.Request)
+
+	CreateUploadURL(w http.ResponseWriter, r *http.Request)
+
+	CompleteUpload(w http.ResponseWriter, r *http.Request)
+}
+
+type PresignHandlerImpl struct {
+	service services.PresignService
+}
+
+func NewPresignHandler(service services.PresignService) PresignHandler {
+	return &PresignHandlerImpl{service: service}
+}
+
+func (h *PresignHandlerImpl) CreateDownloadURL(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("id")
+	slog.InfoContext(r.Context(), "New presigned download request", "fileID", fileID)
+
+	presigned, err := h.service.CreateDownloadURL(r.Context(), fileID)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusOK, presigned)
+}
+
+func (h *PresignHandlerImpl) CreateUploadURL(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "New presigned upload request")
+
+	var req types.PresignedUploadRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		utils.HandleError(w, r, types.NewAppError("Invalid Request Body", "Presigned upload request body is not valid JSON", http.StatusBadRequest, err))
+		return
+	}
+
+	presigned, err := h.service.CreateUploadURL(r.Context(), &req)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusCreated, presigned)
+}
+
+func (h *PresignHandlerImpl) CompleteUpload(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("id")
+	slog.InfoContext(r.Context(), "New presigned upload completion", "fileID", fileID)
+
+	fileUploadResponse, err := h.service.CompleteUpload(r.Context(), fileID)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusCreated, fileUploadResponse)
+}
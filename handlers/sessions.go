@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/services"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/pizza-nz/file-uploader/utils"
+)
+
+type UploadSessionHandler interface {
+	CreateSession(w http.ResponseWriter, r *http.Request)
+
+	GetSession(w http.ResponseWriter, r *http.Request)
+
+	UploadChunk(w http.ResponseWriter, r *http.Request)
+
+	CompleteSession(w http.ResponseWriter, r *http.Request)
+
+	AbortSession(w http.ResponseWriter, r *http.Request)
+}
+
+type UploadSessionHandlerImpl struct {
+	service      services.UploadSessionService
+	chunkTimeout time.Duration
+}
+
+// NewUploadSessionHandler creates an UploadSessionHandler. chunkTimeout bounds how
+// long a client may take to send a single chunk.
+func NewUploadSessionHandler(service services.UploadSessionService, chunkTimeout time.Duration) UploadSessionHandler {
+	return &UploadSessionHandlerImpl{service: service, chunkTimeout: chunkTimeout}
+}
+
+func (h *UploadSessionHandlerImpl) CreateSession(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "New upload session request")
+
+	var req types.UploadSessionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		utils.HandleError(w, r, types.NewAppError("Invalid Request Body", "Upload session request body is not valid JSON", http.StatusBadRequest, err))
+		return
+	}
+
+	status, err := h.service.CreateSession(r.Context(), &req)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusCreated, status)
+}
+
+func (h *UploadSessionHandlerImpl) GetSession(w http.ResponseWriter, r *http.Request) {
+	status, err := h.service.GetSession(r.Context(), r.PathValue("id"))
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusOK, status)
+}
+
+// UploadChunk expects the chunk's position in a Content-Range header, for example
+// "bytes 5242880-10485759/157286400", which must agree with the chunk number, the
+// length of the body and the size of the upload.
+func (h *UploadSessionHandlerImpl) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	index, err := strconv.Atoi(r.PathValue("chunk"))
+	if err != nil {
+		utils.HandleError(w, r, types.NewBadRequestError([]types.Details{types.NewDetails("chunk", "must be a number")}))
+		return
+	}
+
+	var chunkRange types.ChunkRange
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &chunkRange.Start, &chunkRange.End, &chunkRange.Total); err != nil {
+		utils.HandleError(w, r, types.NewBadRequestError([]types.Details{types.NewDetails("Content-Range", "must be of the form bytes start-end/total")}))
+		return
+	}
+
+	// Bound how long a stalled client can hold the chunk buffer.
+	if err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(h.chunkTimeout)); err != nil {
+		slog.DebugContext(r.Context(), "Could not set chunk read deadline", "error", err)
+	}
+
+	status, err := h.service.UploadChunk(r.Context(), sessionID, index, chunkRange, r.Body)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusOK, status)
+}
+
+func (h *UploadSessionHandlerImpl) CompleteSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	slog.InfoContext(r.Context(), "New upload session completion", "sessionID", sessionID)
+
+	fileUploadResponse, err := h.service.CompleteSession(r.Context(), sessionID)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	utils.JSONResponse(w, r, http.StatusCreated, fileUploadResponse)
+}
+
+func (h *UploadSessionHandlerImpl) AbortSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	slog.InfoContext(r.Context(), "New upload session abort", "sessionID", sessionID)
+
+	if err := h.service.AbortSession(r.Context(), sessionID); err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pizza-nz/file-uploader/services"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/pizza-nz/file-uploader/utils"
+)
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination,checksum,expiration"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// TusHandler serves the tus 1.0 resumable upload protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, termination, checksum and expiration extensions.
+type TusHandler interface {
+	Options(w http.ResponseWriter, r *http.Request)
+
+	CreateUpload(w http.ResponseWriter, r *http.Request)
+
+	HeadUpload(w http.ResponseWriter, r *http.Request)
+
+	PatchUpload(w http.ResponseWriter, r *http.Request)
+
+	TerminateUpload(w http.ResponseWriter, r *http.Request)
+}
+
+type TusHandlerImpl struct {
+	service  services.TusService
+	basePath string
+	maxSize  int64
+}
+
+// NewTusHandler creates a TusHandler whose uploads are addressed as basePath + upload ID.
+func NewTusHandler(service services.TusService, basePath string, maxSize int64) TusHandler {
+	return &TusHandlerImpl{service: service, basePath: basePath, maxSize: maxSize}
+}
+
+func (h *TusHandlerImpl) Options(w http.ResponseWriter, r *http.Request) {
+	algorithms := make([]string, 0, len(services.TusChecksumAlgorithms))
+	for algorithm := range services.TusChecksumAlgorithms {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxSize, 10))
+	w.Header().Set("Tus-Checksum-Algorithm", strings.Join(algorithms, ","))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TusHandlerImpl) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !h.checkVersion(w, r) {
+		return
+	}
+	slog.InfoContext(r.Context(), "New tus upload request")
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		utils.HandleError(w, r, types.NewBadRequestError([]types.Details{types.NewDetails("Upload-Length", "must be a non-negative integer")}))
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		utils.HandleError(w, r, types.NewBadRequestError([]types.Details{types.NewDetails("Upload-Metadata", "must be comma separated keys with base64 encoded values")}))
+		return
+	}
+
+	upload, err := h.service.CreateUpload(r.Context(), length, metadata)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", h.basePath+upload.ID)
+	h.writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *TusHandlerImpl) HeadUpload(w http.ResponseWriter, r *http.Request) {
+	if !h.checkVersion(w, r) {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	upload, err := h.service.GetUpload(r.Context(), r.PathValue("id"))
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(upload.Metadata))
+	}
+	h.writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TusHandlerImpl) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !h.checkVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		utils.HandleError(w, r, types.NewAppError("Unsupported Media Type", "PATCH requests must use "+tusContentType, http.StatusUnsupportedMediaType, nil))
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		utils.HandleError(w, r, types.NewBadRequestError([]types.Details{types.NewDetails("Upload-Offset", "must be a non-negative integer")}))
+		return
+	}
+
+	var algorithm string
+	var checksum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		var encoded string
+		var ok bool
+		algorithm, encoded, ok = strings.Cut(header, " ")
+		if ok {
+			checksum, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		if !ok || err != nil {
+			utils.HandleError(w, r, types.NewBadRequestError([]types.Details{types.NewDetails("Upload-Checksum", "must be an algorithm followed by a base64 encoded checksum")}))
+			return
+		}
+	}
+
+	upload, err := h.service.WriteChunk(r.Context(), r.PathValue("id"), offset, r.Body, algorithm, checksum)
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	h.writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TusHandlerImpl) TerminateUpload(w http.ResponseWriter, r *http.Request) {
+	if !h.checkVersion(w, r) {
+		return
+	}
+
+	if err := h.service.TerminateUpload(r.Context(), r.PathValue("id")); err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkVersion rejects requests for a protocol version other than 1.0.0.
+func (h *TusHandlerImpl) checkVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+
+	w.Header().Set("Tus-Version", tusVersion)
+	utils.HandleError(w, r, types.NewAppError("Unsupported Tus Version", "Tus-Resumable header must be "+tusVersion, http.StatusPreconditionFailed, nil))
+	return false
+}
+
+// writeUploadHeaders sets the headers common to every successful response about an upload.
+// X-File-ID carries the stored file's ID once the upload is complete.
+func (h *TusHandlerImpl) writeUploadHeaders(w http.ResponseWriter, upload *services.TusUpload) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.FileID != "" {
+		w.Header().Set("X-File-ID", upload.FileID)
+	} else {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs of a key
+// and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("metadata key is empty")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
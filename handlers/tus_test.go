@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/services"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTusServer(t *testing.T) (*httptest.Server, storage.FileStorage) {
+	t.Helper()
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	repository := metadata.NewMemoryRepository()
+	service, err := services.NewTusService(fileStorage, repository, services.NewQuotaService(repository, config.QuotaConfig{}), t.TempDir(), []string{"image/png"}, 1024)
+	require.NoError(t, err)
+
+	handler := NewTusHandler(service, "/tus/", 1024)
+	mux := http.NewServeMux()
+	mux.HandleFunc("OPTIONS /tus/", handler.Options)
+	mux.HandleFunc("POST /tus/{$}", handler.CreateUpload)
+	mux.HandleFunc("HEAD /tus/{id}", handler.HeadUpload)
+	mux.HandleFunc("PATCH /tus/{id}", handler.PatchUpload)
+	mux.HandleFunc("DELETE /tus/{id}", handler.TerminateUpload)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, fileStorage
+}
+
+func tusRequest(t *testing.T, method, url string, body []byte, headers map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestTusUpload(t *testing.T) {
+	server, fileStorage := newTestTusServer(t)
+	content := append([]byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a}, []byte("rest of the png")...)
+
+	resp := tusRequest(t, http.MethodOptions, server.URL+"/tus/", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "creation,termination,checksum,expiration", resp.Header.Get("Tus-Extension"))
+
+	resp = tusRequest(t, http.MethodPost, server.URL+"/tus/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("photo.png")),
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Upload-Expires"))
+	uploadURL := server.URL + resp.Header.Get("Location")
+
+	// A chunk with the wrong checksum is discarded.
+	resp = tusRequest(t, http.MethodPatch, uploadURL, content[:10], map[string]string{
+		"Content-Type":    "application/offset+octet-stream",
+		"Upload-Offset":   "0",
+		"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString([]byte("not the right checksum")),
+	})
+	assert.Equal(t, services.StatusChecksumMismatch, resp.StatusCode)
+
+	sum := sha1.Sum(content[:10])
+	resp = tusRequest(t, http.MethodPatch, uploadURL, content[:10], map[string]string{
+		"Content-Type":    "application/offset+octet-stream",
+		"Upload-Offset":   "0",
+		"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "10", resp.Header.Get("Upload-Offset"))
+
+	// Resending from a stale offset is a conflict.
+	resp = tusRequest(t, http.MethodPatch, uploadURL, content, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodHead, uploadURL, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "10", resp.Header.Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(content)), resp.Header.Get("Upload-Length"))
+
+	resp = tusRequest(t, http.MethodPatch, uploadURL, content[10:], map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "10",
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	fileID := resp.Header.Get("X-File-ID")
+	require.NotEmpty(t, fileID)
+
+	download, err := fileStorage.Download(context.Background(), fileID)
+	require.NoError(t, err)
+	download.Body.Close()
+	assert.Equal(t, int64(len(content)), download.Size)
+
+	resp = tusRequest(t, http.MethodDelete, uploadURL, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = tusRequest(t, http.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTusUpload_Rejections(t *testing.T) {
+	server, _ := newTestTusServer(t)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/tus/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Upload-Length", "10")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodPost, server.URL+"/tus/", nil, map[string]string{"Upload-Length": "2048"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodPost, server.URL+"/tus/", nil, map[string]string{"Upload-Length": "300"})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	uploadURL := server.URL + resp.Header.Get("Location")
+
+	// The upload is rejected once enough bytes have arrived to detect a disallowed type.
+	resp = tusRequest(t, http.MethodPatch, uploadURL, make([]byte, 300), map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = tusRequest(t, http.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
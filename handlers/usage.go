@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/pizza-nz/file-uploader/services"
+	"github.com/pizza-nz/file-uploader/utils"
+)
+
+type UsageHandler interface {
+	GetUsage(w http.ResponseWriter, r *http.Request)
+}
+
+type UsageHandlerImpl struct {
+	service services.QuotaService
+}
+
+func NewUsageHandler(service services.QuotaService) UsageHandler {
+	return &UsageHandlerImpl{service: service}
+}
+
+// GetUsage reports how much the caller's tenant, and the caller, store and may store.
+func (h *UsageHandlerImpl) GetUsage(w http.ResponseWriter, r *http.Request) {
+	report, err := h.service.Usage(r.Context())
+	if err != nil {
+		utils.HandleError(w, r, err)
+		return
+	}
+	utils.JSONResponse(w, r, http.StatusOK, report)
+}
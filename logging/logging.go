@@ -1,19 +1,64 @@
 package logging
 
 import (
+	"context"
 	"log/slog"
 	"os"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 func NewLogger(env string) *slog.Logger {
 	switch env {
 	case "development":
-		return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		return slog.New(NewContextHandler(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 			Level: slog.LevelDebug,
-		}))
+		})))
 	case "production":
-		return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+		return slog.New(NewContextHandler(slog.NewJSONHandler(os.Stdout, nil)))
 	default:
-		return slog.New(slog.NewTextHandler(os.Stdout, nil))
+		return slog.New(NewContextHandler(slog.NewTextHandler(os.Stdout, nil)))
 	}
-}
\ No newline at end of file
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that carries requestID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID carried by ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// ContextHandler adds the request ID and trace ID carried by a record's context to the
+// record, so anything logged with slog.InfoContext and friends while serving a request
+// can be correlated with the request's other logs and its trace.
+type ContextHandler struct {
+	slog.Handler
+}
+
+func NewContextHandler(next slog.Handler) *ContextHandler {
+	return &ContextHandler{Handler: next}
+}
+
+func (h *ContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("requestID", requestID))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(slog.String("traceID", spanContext.TraceID().String()), slog.String("spanID", spanContext.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return NewContextHandler(h.Handler.WithAttrs(attrs))
+}
+
+func (h *ContextHandler) WithGroup(name string) slog.Handler {
+	return NewContextHandler(h.Handler.WithGroup(name))
+}
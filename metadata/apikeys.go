@@ -0,0 +1,95 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// SQLRepository also keeps API keys, in the api_keys table. Scopes and groups are
+// stored separated by spaces.
+var _ auth.KeyStore = (*SQLRepository)(nil)
+
+func (r *SQLRepository) CreateAPIKey(ctx context.Context, key *types.APIKey) error {
+	_, err := r.db.ExecContext(ctx, r.bind(`
+		INSERT INTO api_keys (key_id, name, hash, scopes, key_groups, key_tenant, created_at, revoked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		key.ID, key.Name, key.Hash, strings.Join(key.Scopes, " "), strings.Join(key.Groups, " "), key.Tenant, key.CreatedAt, key.RevokedAt)
+	if err != nil {
+		return types.NewDBError("failed to insert API key "+key.ID, err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) GetAPIKey(ctx context.Context, id string) (*types.APIKey, error) {
+	row := r.db.QueryRowContext(ctx, r.bind(`
+		SELECT key_id, name, hash, scopes, key_groups, key_tenant, created_at, revoked_at
+		FROM api_keys WHERE key_id = ?`), id)
+	key, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, types.NewNotFoundError(id)
+	}
+	if err != nil {
+		return nil, types.NewDBError("failed to read API key "+id, err)
+	}
+	return key, nil
+}
+
+func (r *SQLRepository) RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error {
+	result, err := r.db.ExecContext(ctx, r.bind(`UPDATE api_keys SET revoked_at = ? WHERE key_id = ?`), revokedAt, id)
+	if err != nil {
+		return types.NewDBError("failed to revoke API key "+id, err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return types.NewNotFoundError(id)
+	}
+	return nil
+}
+
+func (r *SQLRepository) ListAPIKeys(ctx context.Context) ([]types.APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT key_id, name, hash, scopes, key_groups, key_tenant, created_at, revoked_at
+		FROM api_keys ORDER BY created_at, key_id`)
+	if err != nil {
+		return nil, types.NewDBError("failed to list API keys", err)
+	}
+	defer rows.Close()
+
+	var keys []types.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, types.NewDBError("failed to read listed API key", err)
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, types.NewDBError("failed to list API keys", err)
+	}
+	return keys, nil
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKey(row scanner) (*types.APIKey, error) {
+	key := &types.APIKey{}
+	var scopes, groups string
+	var revokedAt sql.NullTime
+	if err := row.Scan(&key.ID, &key.Name, &key.Hash, &scopes, &groups, &key.Tenant, &key.CreatedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	key.Groups = strings.Fields(groups)
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
@@ -0,0 +1,156 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// SQLRepository also serves as the blob index of a storage.DedupStorage, keeping
+// references in the blob_refs table.
+var _ storage.BlobIndex = (*SQLRepository)(nil)
+
+// AddBlobRef counts ref in the blobs table in the same transaction as it is recorded.
+// Updating the blob's row locks it, so a concurrent RemoveBlobRef of its last
+// reference either commits first, leaving the row marked as deleting, or waits for
+// ref to be counted. A blob marked as deleting for longer than storage.BlobDeleteLease
+// is taken over, as the deletion has been abandoned.
+func (r *SQLRepository) AddBlobRef(ctx context.Context, ref *types.BlobRef) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, types.NewDBError("failed to start adding blob reference for "+ref.Key, err)
+	}
+	defer tx.Rollback()
+
+	var stored bool
+	err = tx.QueryRowContext(ctx, r.bind(`
+		INSERT INTO blobs (hash, refs, stored) VALUES (?, 1, FALSE)
+		ON CONFLICT (hash) DO UPDATE SET refs = blobs.refs + 1, deleting_at = NULL
+		WHERE blobs.deleting_at IS NULL OR blobs.deleting_at < ?
+		RETURNING stored`), ref.Hash, time.Now().UTC().Add(-storage.BlobDeleteLease)).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, storage.ErrBlobDeleting
+	}
+	if err != nil {
+		return false, types.NewDBError("failed to count reference to blob "+ref.Hash, err)
+	}
+	_, err = tx.ExecContext(ctx, r.bind(`
+		INSERT INTO blob_refs (object_key, hash, size, content_type, created_at)
+		VALUES (?, ?, ?, ?, ?)`),
+		ref.Key, ref.Hash, ref.Size, ref.ContentType, ref.CreatedAt)
+	if err != nil {
+		return false, types.NewDBError("failed to insert blob reference for "+ref.Key, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, types.NewDBError("failed to commit adding blob reference for "+ref.Key, err)
+	}
+	return !stored, nil
+}
+
+func (r *SQLRepository) MarkBlobStored(ctx context.Context, hash string) error {
+	if _, err := r.db.ExecContext(ctx, r.bind(`UPDATE blobs SET stored = TRUE WHERE hash = ? AND refs > 0`), hash); err != nil {
+		return types.NewDBError("failed to mark blob "+hash+" as stored", err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) GetBlobRef(ctx context.Context, key string) (*types.BlobRef, error) {
+	return getBlobRef(ctx, r.db, r.bind, key)
+}
+
+// RemoveBlobRef commits the removal before deleteBlob runs, so no transaction is held
+// open during the storage round trip. Removing the last reference marks the blob's row
+// as deleting instead of deleting it, which holds back AddBlobRef until the blob is
+// gone and the row with it. The transaction starts with a write, so SQLite takes its
+// write lock up front rather than failing to upgrade a read.
+func (r *SQLRepository) RemoveBlobRef(ctx context.Context, key string, deleteBlob func(ctx context.Context, ref *types.BlobRef)) (*types.BlobRef, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, types.NewDBError("failed to start removing blob reference for "+key, err)
+	}
+	defer tx.Rollback()
+
+	ref := &types.BlobRef{}
+	err = tx.QueryRowContext(ctx, r.bind(`
+		DELETE FROM blob_refs WHERE object_key = ?
+		RETURNING object_key, hash, size, content_type, created_at`), key).
+		Scan(&ref.Key, &ref.Hash, &ref.Size, &ref.ContentType, &ref.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, types.NewNotFoundError(key)
+	}
+	if err != nil {
+		return nil, types.NewDBError("failed to delete blob reference for "+key, err)
+	}
+	var remaining int
+	if err := tx.QueryRowContext(ctx, r.bind(`UPDATE blobs SET refs = refs - 1 WHERE hash = ? RETURNING refs`), ref.Hash).Scan(&remaining); err != nil {
+		return nil, types.NewDBError("failed to count references to blob "+ref.Hash, err)
+	}
+	if remaining == 0 {
+		if _, err := tx.ExecContext(ctx, r.bind(`UPDATE blobs SET stored = FALSE, deleting_at = ? WHERE hash = ?`), time.Now().UTC(), ref.Hash); err != nil {
+			return nil, types.NewDBError("failed to mark blob "+ref.Hash+" as deleting", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, types.NewDBError("failed to commit removing blob reference for "+key, err)
+	}
+
+	if remaining == 0 {
+		deleteCtx, cancel := context.WithTimeout(ctx, storage.BlobDeleteLease/2)
+		deleteBlob(deleteCtx, ref)
+		cancel()
+		// A reference added since the deletion was abandoned keeps the row. A row left
+		// behind only holds the blob back until the lease passes.
+		if _, err := r.db.ExecContext(ctx, r.bind(`DELETE FROM blobs WHERE hash = ? AND refs = 0`), ref.Hash); err != nil {
+			slog.WarnContext(ctx, "Failed to delete row of deleted blob", "hash", ref.Hash, "error", err)
+		}
+	}
+	return ref, nil
+}
+
+func (r *SQLRepository) ListBlobRefs(ctx context.Context, startAfter string, limit int) ([]types.BlobRef, error) {
+	rows, err := r.db.QueryContext(ctx, r.bind(`
+		SELECT object_key, hash, size, content_type, created_at
+		FROM blob_refs WHERE object_key > ? ORDER BY object_key LIMIT ?`), startAfter, limit)
+	if err != nil {
+		return nil, types.NewDBError("failed to list blob references", err)
+	}
+	defer rows.Close()
+
+	var refs []types.BlobRef
+	for rows.Next() {
+		var ref types.BlobRef
+		if err := rows.Scan(&ref.Key, &ref.Hash, &ref.Size, &ref.ContentType, &ref.CreatedAt); err != nil {
+			return nil, types.NewDBError("failed to read listed blob reference", err)
+		}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, types.NewDBError("failed to list blob references", err)
+	}
+	return refs, nil
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func getBlobRef(ctx context.Context, q queryRower, bind func(string) string, key string) (*types.BlobRef, error) {
+	ref := &types.BlobRef{}
+	err := q.QueryRowContext(ctx, bind(`
+		SELECT object_key, hash, size, content_type, created_at
+		FROM blob_refs WHERE object_key = ?`), key).
+		Scan(&ref.Key, &ref.Hash, &ref.Size, &ref.ContentType, &ref.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, types.NewNotFoundError(key)
+	}
+	if err != nil {
+		return nil, types.NewDBError("failed to read blob reference for "+key, err)
+	}
+	return ref, nil
+}
@@ -0,0 +1,121 @@
+package metadata
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// sortColumns maps the sort orders of types.FileListQuery to columns of the files table.
+var sortColumns = map[string]string{
+	types.FileSortCreatedAt: "created_at",
+	types.FileSortSize:      "size",
+	types.FileSortFilename:  "filename",
+}
+
+// cursor is the position after the last file of a page: its sort value and, to
+// break ties, its file ID. The sort order is included so a cursor cannot be
+// reused with a different one.
+type cursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Value      string `json:"v"`
+	FileID     string `json:"id"`
+}
+
+func encodeCursor(query *types.FileListQuery, last *types.FileMetadata) string {
+	data, _ := json.Marshal(cursor{
+		Sort:       query.Sort,
+		Descending: query.Descending,
+		Value:      sortValue(query.Sort, last),
+		FileID:     last.FileID,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the cursor in query, or nil if there is none.
+func decodeCursor(query *types.FileListQuery) (*cursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	invalid := types.NewBadRequestError([]types.Details{types.NewDetails("cursor", "is not a cursor returned for this sort order")})
+	data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, invalid
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(data, c); err != nil || c.Sort != query.Sort || c.Descending != query.Descending {
+		return nil, invalid
+	}
+	if _, err := c.sqlValue(); err != nil {
+		return nil, invalid
+	}
+	return c, nil
+}
+
+// sqlValue converts the cursor's sort value back to the type of its column.
+func (c *cursor) sqlValue() (any, error) {
+	switch c.Sort {
+	case types.FileSortCreatedAt:
+		return time.Parse(time.RFC3339Nano, c.Value)
+	case types.FileSortSize:
+		return strconv.ParseInt(c.Value, 10, 64)
+	default:
+		return c.Value, nil
+	}
+}
+
+func sortValue(sort string, file *types.FileMetadata) string {
+	switch sort {
+	case types.FileSortCreatedAt:
+		return file.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case types.FileSortSize:
+		return strconv.FormatInt(file.Size, 10)
+	default:
+		return file.Filename
+	}
+}
+
+// compareFiles orders a and b by sort, then by file ID, in ascending order.
+func compareFiles(sort string, a, b *types.FileMetadata) int {
+	var c int
+	switch sort {
+	case types.FileSortCreatedAt:
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	case types.FileSortSize:
+		c = compareInt64(a.Size, b.Size)
+	default:
+		c = strings.Compare(a.Filename, b.Filename)
+	}
+	if c == 0 {
+		c = strings.Compare(a.FileID, b.FileID)
+	}
+	return c
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// validateListQuery fills in the default sort order, newest first, and rejects unknown ones.
+func validateListQuery(query *types.FileListQuery) error {
+	if query.Sort == "" {
+		query.Sort = types.FileSortCreatedAt
+		query.Descending = true
+	}
+	if _, ok := sortColumns[query.Sort]; !ok {
+		return types.NewBadRequestError([]types.Details{types.NewDetails("sort", "must be createdAt, size or filename")})
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepository_List(t *testing.T) {
+	sqlite, err := NewSQLiteRepository(context.Background(), filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer sqlite.Close()
+
+	repositories := map[string]Repository{
+		"memory": NewMemoryRepository(),
+		"sqlite": sqlite,
+	}
+	for name, repository := range repositories {
+		t.Run(name, func(t *testing.T) {
+			testRepositoryList(t, repository)
+		})
+	}
+}
+
+func testRepositoryList(t *testing.T, repository Repository) {
+	ctx := context.Background()
+	day := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// Files 0-5 are uploaded an hour apart on day, alternating between PDFs and
+	// PNGs; file 6 is a PDF uploaded the next day.
+	for i := 0; i < 7; i++ {
+		file := &types.FileMetadata{
+			FileID:         fmt.Sprintf("file-%d", i),
+			Filename:       fmt.Sprintf("name-%d", 6-i),
+			ContentType:    "image/png",
+			Size:           int64(100 * (i % 3)),
+			Uploader:       "support",
+			StorageBackend: "local",
+			CreatedAt:      day.Add(time.Duration(i) * time.Hour),
+		}
+		if i%2 == 0 {
+			file.ContentType = "application/pdf"
+		}
+		if i == 6 {
+			file.CreatedAt = day.Add(30 * time.Hour)
+		}
+		file.UpdatedAt = file.CreatedAt
+		require.NoError(t, repository.Create(ctx, file))
+	}
+
+	// listAll follows cursors until the last page, returning the file IDs in order.
+	listAll := func(query types.FileListQuery) []string {
+		var ids []string
+		for {
+			page, err := repository.List(ctx, &query)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(page.Files), query.Limit)
+			for _, file := range page.Files {
+				ids = append(ids, file.FileID)
+			}
+			if page.NextCursor == "" {
+				return ids
+			}
+			query.Cursor = page.NextCursor
+		}
+	}
+
+	assert.Equal(t, []string{"file-6", "file-5", "file-4", "file-3", "file-2", "file-1", "file-0"}, listAll(types.FileListQuery{Limit: 3}), "newest first by default")
+	assert.Equal(t, []string{"file-0", "file-2", "file-4"}, listAll(types.FileListQuery{
+		ContentType:    "application/pdf",
+		UploadedAfter:  day,
+		UploadedBefore: day.Add(24 * time.Hour),
+		Sort:           types.FileSortCreatedAt,
+		Limit:          2,
+	}), "PDFs uploaded on day")
+	// Sizes are 0, 100, 200, 0, 100, 200, 0; ties are broken by file ID in the same direction.
+	assert.Equal(t, []string{"file-5", "file-2", "file-4", "file-1"}, listAll(types.FileListQuery{
+		MinSize:    100,
+		Sort:       types.FileSortSize,
+		Descending: true,
+		Limit:      1,
+	}))
+	assert.Equal(t, []string{"file-6", "file-5", "file-4"}, listAll(types.FileListQuery{Sort: types.FileSortFilename, MaxSize: 1000, Uploader: "support", Limit: 10})[:3])
+	assert.Empty(t, listAll(types.FileListQuery{Uploader: "someone else", Limit: 10}))
+
+	page, err := repository.List(ctx, &types.FileListQuery{Limit: 2})
+	require.NoError(t, err)
+	var badRequestErr *types.BadRequestError
+	_, err = repository.List(ctx, &types.FileListQuery{Sort: types.FileSortSize, Limit: 2, Cursor: page.NextCursor})
+	assert.ErrorAs(t, err, &badRequestErr, "cursors are tied to their sort order")
+	_, err = repository.List(ctx, &types.FileListQuery{Sort: "uploader", Limit: 2})
+	assert.ErrorAs(t, err, &badRequestErr)
+}
@@ -0,0 +1,79 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// SQLRepository also keeps presigned uploads, in the pending_uploads table, so any
+// instance sharing the database can complete them.
+var _ PendingUploadStore = (*SQLRepository)(nil)
+
+func (r *SQLRepository) SavePendingUpload(ctx context.Context, upload *types.PendingUpload) error {
+	_, err := r.db.ExecContext(ctx, r.bind(`
+		INSERT INTO pending_uploads (file_id, filename, size, tenant, owner, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`),
+		upload.FileID, upload.Filename, upload.Size, upload.Tenant, upload.Owner, upload.ExpiresAt.UTC())
+	if err != nil {
+		return types.NewDBError("failed to insert pending upload "+upload.FileID, err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) GetPendingUpload(ctx context.Context, fileID string) (*types.PendingUpload, error) {
+	upload := &types.PendingUpload{}
+	err := r.db.QueryRowContext(ctx, r.bind(`
+		SELECT file_id, filename, size, tenant, owner, expires_at
+		FROM pending_uploads WHERE file_id = ?`), fileID).
+		Scan(&upload.FileID, &upload.Filename, &upload.Size, &upload.Tenant, &upload.Owner, &upload.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, types.NewNotFoundError(fileID)
+	}
+	if err != nil {
+		return nil, types.NewDBError("failed to read pending upload "+fileID, err)
+	}
+	return upload, nil
+}
+
+func (r *SQLRepository) DeletePendingUpload(ctx context.Context, fileID string) error {
+	result, err := r.db.ExecContext(ctx, r.bind(`DELETE FROM pending_uploads WHERE file_id = ?`), fileID)
+	if err != nil {
+		return types.NewDBError("failed to delete pending upload "+fileID, err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return types.NewDBError("failed to delete pending upload "+fileID, err)
+	}
+	if rows == 0 {
+		return types.NewNotFoundError(fileID)
+	}
+	return nil
+}
+
+func (r *SQLRepository) ListExpiredPendingUploads(ctx context.Context, now time.Time, limit int) ([]types.PendingUpload, error) {
+	rows, err := r.db.QueryContext(ctx, r.bind(`
+		SELECT file_id, filename, size, tenant, owner, expires_at
+		FROM pending_uploads WHERE expires_at < ?
+		ORDER BY expires_at LIMIT ?`), now.UTC(), limit)
+	if err != nil {
+		return nil, types.NewDBError("failed to list expired pending uploads", err)
+	}
+	defer rows.Close()
+
+	var expired []types.PendingUpload
+	for rows.Next() {
+		var upload types.PendingUpload
+		if err := rows.Scan(&upload.FileID, &upload.Filename, &upload.Size, &upload.Tenant, &upload.Owner, &upload.ExpiresAt); err != nil {
+			return nil, types.NewDBError("failed to read expired pending upload", err)
+		}
+		expired = append(expired, upload)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, types.NewDBError("failed to list expired pending uploads", err)
+	}
+	return expired, nil
+}
@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	_ "github.com/lib/pq"
+	"github.com/pizza-nz/file-uploader/config"
+)
+
+var postgresDialect = dialect{
+	name:           "postgres",
+	numberedParams: true,
+	migrations: []string{
+		// The files table predates schema_migrations, so it may already exist.
+		`CREATE TABLE IF NOT EXISTS files (
+			file_id         TEXT PRIMARY KEY,
+			filename        TEXT NOT NULL,
+			content_type    TEXT NOT NULL,
+			size            BIGINT NOT NULL,
+			checksum        TEXT NOT NULL DEFAULT '',
+			uploader        TEXT NOT NULL DEFAULT '',
+			storage_backend TEXT NOT NULL,
+			created_at      TIMESTAMPTZ NOT NULL,
+			updated_at      TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE pending_uploads (
+			file_id    TEXT PRIMARY KEY,
+			filename   TEXT NOT NULL,
+			size       BIGINT NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX pending_uploads_expires_at_idx ON pending_uploads (expires_at)`,
+		`CREATE INDEX files_created_at_idx ON files (created_at, file_id);
+		CREATE INDEX files_content_type_idx ON files (content_type, created_at);
+		CREATE INDEX files_uploader_idx ON files (uploader, created_at)`,
+		`CREATE TABLE blob_refs (
+			object_key   TEXT PRIMARY KEY,
+			hash         TEXT NOT NULL,
+			size         BIGINT NOT NULL,
+			content_type TEXT NOT NULL,
+			created_at   TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX blob_refs_hash_idx ON blob_refs (hash);
+		CREATE TABLE blobs (
+			hash        TEXT PRIMARY KEY,
+			refs        BIGINT NOT NULL,
+			stored      BOOLEAN NOT NULL,
+			deleting_at TIMESTAMPTZ
+		)`,
+		`CREATE TABLE api_keys (
+			key_id     TEXT PRIMARY KEY,
+			name       TEXT NOT NULL,
+			hash       TEXT NOT NULL,
+			scopes     TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			revoked_at TIMESTAMPTZ
+		)`,
+		`ALTER TABLE files ADD COLUMN owner_group TEXT NOT NULL DEFAULT '';
+		CREATE INDEX files_owner_group_idx ON files (owner_group, created_at);
+		ALTER TABLE api_keys ADD COLUMN key_groups TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pending_uploads ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE files ADD COLUMN tenant TEXT NOT NULL DEFAULT '';
+		CREATE INDEX files_tenant_idx ON files (tenant, created_at);
+		ALTER TABLE api_keys ADD COLUMN key_tenant TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pending_uploads ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+		// Usage starts out as what is already stored.
+		`CREATE TABLE storage_usage (
+			tenant  TEXT NOT NULL,
+			owner   TEXT NOT NULL,
+			bytes   BIGINT NOT NULL,
+			objects BIGINT NOT NULL,
+			PRIMARY KEY (tenant, owner)
+		);
+		INSERT INTO storage_usage (tenant, owner, bytes, objects)
+			SELECT tenant, '', SUM(size), COUNT(*) FROM files GROUP BY tenant;
+		INSERT INTO storage_usage (tenant, owner, bytes, objects)
+			SELECT tenant, uploader, SUM(size), COUNT(*) FROM files WHERE uploader <> '' GROUP BY tenant, uploader`,
+	},
+}
+
+// NewPostgresRepository connects to the PostgreSQL database described by cfg and
+// brings its schema up to date.
+func NewPostgresRepository(ctx context.Context, cfg config.DatabaseConfig) (*SQLRepository, error) {
+	query := url.Values{}
+	if cfg.SSLMode != "" {
+		query.Set("sslmode", cfg.SSLMode)
+	}
+	dsn := &url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.User, cfg.Password),
+		Host:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Path:     "/" + cfg.Dbname,
+		RawQuery: query.Encode(),
+	}
+
+	db, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database %s on %s: %w", cfg.Dbname, dsn.Host, err)
+	}
+
+	return newSQLRepository(ctx, db, postgresDialect)
+}
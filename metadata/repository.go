@@ -0,0 +1,233 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// Repository stores metadata about uploaded files, keyed by file ID.
+type Repository interface {
+	// Create records a newly stored file. It fails if the file ID is already recorded.
+	Create(ctx context.Context, file *types.FileMetadata) error
+	// Get returns a *types.NotFoundError if the file is not recorded.
+	Get(ctx context.Context, fileID string) (*types.FileMetadata, error)
+	// Delete returns a *types.NotFoundError if the file is not recorded.
+	Delete(ctx context.Context, fileID string) error
+	// List returns the page of files selected by query. An empty Sort lists the newest files first.
+	List(ctx context.Context, query *types.FileListQuery) (*types.FileListPage, error)
+	// Ping returns an error if the store cannot currently be reached.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// UsageStore keeps how much each tenant, and each owner within a tenant, stores.
+type UsageStore interface {
+	// AddUsage adds delta to the usage of the scope of every charge, or to none of
+	// them. If delta would take any scope past its quota, nothing is changed and a
+	// *types.QuotaExceededError is returned. Reductions are never refused.
+	AddUsage(ctx context.Context, delta types.Usage, charges []types.UsageCharge) error
+	// GetUsage returns the usage of scope, which is zero if nothing was ever stored in it.
+	GetUsage(ctx context.Context, scope types.UsageScope) (types.Usage, error)
+}
+
+// PendingUploadStore keeps direct uploads that have been presigned but not yet
+// verified, so that whichever instance the client reports completion to can verify them.
+type PendingUploadStore interface {
+	SavePendingUpload(ctx context.Context, upload *types.PendingUpload) error
+	// GetPendingUpload returns a *types.NotFoundError if the upload is not pending.
+	GetPendingUpload(ctx context.Context, fileID string) (*types.PendingUpload, error)
+	// DeletePendingUpload returns a *types.NotFoundError if the upload is not
+	// pending, such as when another request has already completed it.
+	DeletePendingUpload(ctx context.Context, fileID string) error
+	// ListExpiredPendingUploads returns up to limit uploads that expired before now,
+	// soonest expired first.
+	ListExpiredPendingUploads(ctx context.Context, now time.Time, limit int) ([]types.PendingUpload, error)
+}
+
+// MemoryRepository keeps metadata in memory. Everything is lost on restart, so it
+// is only suitable for tests and local development.
+type MemoryRepository struct {
+	mu    sync.RWMutex
+	files map[string]types.FileMetadata
+	usage map[types.UsageScope]types.Usage
+	// pending holds presigned uploads, which are then only known to this instance.
+	pending map[string]types.PendingUpload
+}
+
+var (
+	_ Repository         = (*MemoryRepository)(nil)
+	_ UsageStore         = (*MemoryRepository)(nil)
+	_ PendingUploadStore = (*MemoryRepository)(nil)
+)
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		files:   make(map[string]types.FileMetadata),
+		usage:   make(map[types.UsageScope]types.Usage),
+		pending: make(map[string]types.PendingUpload),
+	}
+}
+
+func (m *MemoryRepository) Create(ctx context.Context, file *types.FileMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[file.FileID]; ok {
+		return fmt.Errorf("metadata for file %s already exists", file.FileID)
+	}
+	m.files[file.FileID] = *file
+	return nil
+}
+
+func (m *MemoryRepository) Get(ctx context.Context, fileID string) (*types.FileMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, ok := m.files[fileID]
+	if !ok {
+		return nil, types.NewNotFoundError(fileID)
+	}
+	return &file, nil
+}
+
+func (m *MemoryRepository) Delete(ctx context.Context, fileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[fileID]; !ok {
+		return types.NewNotFoundError(fileID)
+	}
+	delete(m.files, fileID)
+	return nil
+}
+
+func (m *MemoryRepository) List(ctx context.Context, query *types.FileListQuery) (*types.FileListPage, error) {
+	if err := validateListQuery(query); err != nil {
+		return nil, err
+	}
+	after, err := decodeCursor(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// compare orders files in the direction of the listing.
+	compare := func(a, b *types.FileMetadata) int {
+		if query.Descending {
+			return compareFiles(query.Sort, b, a)
+		}
+		return compareFiles(query.Sort, a, b)
+	}
+
+	m.mu.RLock()
+	files := make([]types.FileMetadata, 0, len(m.files))
+	for _, file := range m.files {
+		if query.Matches(&file) {
+			files = append(files, file)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool { return compare(&files[i], &files[j]) < 0 })
+	if after != nil {
+		// Skip to the first file that sorts after the cursor.
+		position := &types.FileMetadata{FileID: after.FileID}
+		value, _ := after.sqlValue()
+		switch v := value.(type) {
+		case time.Time:
+			position.CreatedAt = v
+		case int64:
+			position.Size = v
+		case string:
+			position.Filename = v
+		}
+		start := sort.Search(len(files), func(i int) bool { return compare(&files[i], position) > 0 })
+		files = files[start:]
+	}
+
+	page := &types.FileListPage{Files: files}
+	if len(files) > query.Limit {
+		page.Files = files[:query.Limit]
+		page.NextCursor = encodeCursor(query, &page.Files[query.Limit-1])
+	}
+	return page, nil
+}
+
+func (m *MemoryRepository) AddUsage(ctx context.Context, delta types.Usage, charges []types.UsageCharge) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, charge := range charges {
+		if m.usage[charge.Scope].Exceeds(delta, charge.Quota) {
+			return &types.QuotaExceededError{Scope: charge.Scope, Quota: charge.Quota}
+		}
+	}
+	for _, charge := range charges {
+		usage := m.usage[charge.Scope]
+		usage.Bytes += delta.Bytes
+		usage.Objects += delta.Objects
+		m.usage[charge.Scope] = usage
+	}
+	return nil
+}
+
+func (m *MemoryRepository) GetUsage(ctx context.Context, scope types.UsageScope) (types.Usage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.usage[scope], nil
+}
+
+func (m *MemoryRepository) SavePendingUpload(ctx context.Context, upload *types.PendingUpload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[upload.FileID] = *upload
+	return nil
+}
+
+func (m *MemoryRepository) GetPendingUpload(ctx context.Context, fileID string) (*types.PendingUpload, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	upload, ok := m.pending[fileID]
+	if !ok {
+		return nil, types.NewNotFoundError(fileID)
+	}
+	return &upload, nil
+}
+
+func (m *MemoryRepository) DeletePendingUpload(ctx context.Context, fileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pending[fileID]; !ok {
+		return types.NewNotFoundError(fileID)
+	}
+	delete(m.pending, fileID)
+	return nil
+}
+
+func (m *MemoryRepository) ListExpiredPendingUploads(ctx context.Context, now time.Time, limit int) ([]types.PendingUpload, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var expired []types.PendingUpload
+	for _, upload := range m.pending {
+		if upload.ExpiresAt.Before(now) {
+			expired = append(expired, upload)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ExpiresAt.Before(expired[j].ExpiresAt) })
+	return expired[:min(limit, len(expired))], nil
+}
+
+func (m *MemoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryRepository) Close() error {
+	return nil
+}
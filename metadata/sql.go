@@ -0,0 +1,237 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// dialect holds what differs between the SQL databases the repository supports.
+type dialect struct {
+	name string
+	// numberedParams is true for databases that use $1, $2, ... rather than ? for bind parameters.
+	numberedParams bool
+	// migrations are applied in order, once each. Never edit or reorder a migration
+	// that has been released; append a new one instead.
+	migrations []string
+}
+
+// SQLRepository stores metadata in the files table of a SQL database.
+type SQLRepository struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+var _ Repository = (*SQLRepository)(nil)
+
+// newSQLRepository runs any pending migrations on db and returns a repository that uses it.
+// db is closed if the migrations fail.
+func newSQLRepository(ctx context.Context, db *sql.DB, d dialect) (*SQLRepository, error) {
+	r := &SQLRepository{db: db, dialect: d}
+	if err := r.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// migrate applies every migration newer than the version recorded in schema_migrations.
+func (r *SQLRepository) migrate(ctx context.Context) error {
+	if _, err := r.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL
+		)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	var current int
+	if err := r.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(r.dialect.migrations); i++ {
+		version := i + 1
+		tx, err := r.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to start migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, r.dialect.migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply %s migration %d: %w", r.dialect.name, version, err)
+		}
+		if _, err := tx.ExecContext(ctx, r.bind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), version, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// bind rewrites the ? bind parameters in query for the dialect.
+func (r *SQLRepository) bind(query string) string {
+	if !r.dialect.numberedParams {
+		return query
+	}
+
+	var sb strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+func (r *SQLRepository) Create(ctx context.Context, file *types.FileMetadata) error {
+	_, err := r.db.ExecContext(ctx, r.bind(`
+		INSERT INTO files (file_id, filename, content_type, size, checksum, uploader, owner_group, tenant, storage_backend, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		file.FileID, file.Filename, file.ContentType, file.Size, file.Checksum, file.Uploader, file.Group, file.Tenant, file.StorageBackend, file.CreatedAt, file.UpdatedAt)
+	if err != nil {
+		return types.NewDBError("failed to insert metadata for file "+file.FileID, err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) Get(ctx context.Context, fileID string) (*types.FileMetadata, error) {
+	file := &types.FileMetadata{}
+	err := r.db.QueryRowContext(ctx, r.bind(`
+		SELECT file_id, filename, content_type, size, checksum, uploader, owner_group, tenant, storage_backend, created_at, updated_at
+		FROM files WHERE file_id = ?`), fileID).
+		Scan(&file.FileID, &file.Filename, &file.ContentType, &file.Size, &file.Checksum, &file.Uploader, &file.Group, &file.Tenant, &file.StorageBackend, &file.CreatedAt, &file.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, types.NewNotFoundError(fileID)
+	}
+	if err != nil {
+		return nil, types.NewDBError("failed to read metadata for file "+fileID, err)
+	}
+	return file, nil
+}
+
+func (r *SQLRepository) Delete(ctx context.Context, fileID string) error {
+	result, err := r.db.ExecContext(ctx, r.bind(`DELETE FROM files WHERE file_id = ?`), fileID)
+	if err != nil {
+		return types.NewDBError("failed to delete metadata for file "+fileID, err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return types.NewNotFoundError(fileID)
+	}
+	return nil
+}
+
+func (r *SQLRepository) List(ctx context.Context, query *types.FileListQuery) (*types.FileListPage, error) {
+	if err := validateListQuery(query); err != nil {
+		return nil, err
+	}
+	after, err := decodeCursor(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are only ever listed for one tenant.
+	conditions := []string{"tenant = ?"}
+	args := []any{query.Tenant}
+	if query.ContentType != "" {
+		conditions = append(conditions, "content_type = ?")
+		args = append(args, query.ContentType)
+	}
+	if query.MinSize > 0 {
+		conditions = append(conditions, "size >= ?")
+		args = append(args, query.MinSize)
+	}
+	if query.MaxSize > 0 {
+		conditions = append(conditions, "size <= ?")
+		args = append(args, query.MaxSize)
+	}
+	if !query.UploadedAfter.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, query.UploadedAfter.UTC())
+	}
+	if !query.UploadedBefore.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, query.UploadedBefore.UTC())
+	}
+	if query.Uploader != "" {
+		conditions = append(conditions, "uploader = ?")
+		args = append(args, query.Uploader)
+	}
+	if access := query.VisibleTo; access != nil {
+		visible := []string{"(uploader <> '' AND uploader = ?)"}
+		args = append(args, access.Owner)
+		if len(access.Groups) > 0 {
+			visible = append(visible, "owner_group IN ("+strings.Repeat("?, ", len(access.Groups)-1)+"?)")
+			for _, group := range access.Groups {
+				args = append(args, group)
+			}
+		}
+		conditions = append(conditions, "("+strings.Join(visible, " OR ")+")")
+	}
+
+	column := sortColumns[query.Sort]
+	direction, comparison := "ASC", ">"
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if after != nil {
+		value, _ := after.sqlValue()
+		conditions = append(conditions, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND file_id %[2]s ?))", column, comparison))
+		args = append(args, value, value, after.FileID)
+	}
+
+	statement := `
+		SELECT file_id, filename, content_type, size, checksum, uploader, owner_group, tenant, storage_backend, created_at, updated_at
+		FROM files`
+	statement += " WHERE " + strings.Join(conditions, " AND ")
+	// Fetch one extra row to find out whether there is another page.
+	statement += fmt.Sprintf(" ORDER BY %[1]s %[2]s, file_id %[2]s LIMIT ?", column, direction)
+	args = append(args, query.Limit+1)
+
+	rows, err := r.db.QueryContext(ctx, r.bind(statement), args...)
+	if err != nil {
+		return nil, types.NewDBError("failed to list files", err)
+	}
+	defer rows.Close()
+
+	page := &types.FileListPage{Files: make([]types.FileMetadata, 0, query.Limit)}
+	for rows.Next() {
+		var file types.FileMetadata
+		if err := rows.Scan(&file.FileID, &file.Filename, &file.ContentType, &file.Size, &file.Checksum, &file.Uploader, &file.Group, &file.Tenant, &file.StorageBackend, &file.CreatedAt, &file.UpdatedAt); err != nil {
+			return nil, types.NewDBError("failed to read listed file", err)
+		}
+		page.Files = append(page.Files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, types.NewDBError("failed to list files", err)
+	}
+
+	if len(page.Files) > query.Limit {
+		page.Files = page.Files[:query.Limit]
+		page.NextCursor = encodeCursor(query, &page.Files[query.Limit-1])
+	}
+	return page, nil
+}
+
+func (r *SQLRepository) Ping(ctx context.Context) error {
+	if err := r.db.PingContext(ctx); err != nil {
+		return types.NewDBError("failed to reach the "+r.dialect.name+" database", err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) Close() error {
+	return r.db.Close()
+}
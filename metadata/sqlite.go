@@ -0,0 +1,107 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqliteDialect = dialect{
+	name: "sqlite",
+	migrations: []string{
+		`CREATE TABLE files (
+			file_id         TEXT PRIMARY KEY,
+			filename        TEXT NOT NULL,
+			content_type    TEXT NOT NULL,
+			size            INTEGER NOT NULL,
+			checksum        TEXT NOT NULL DEFAULT '',
+			uploader        TEXT NOT NULL DEFAULT '',
+			storage_backend TEXT NOT NULL,
+			created_at      TIMESTAMP NOT NULL,
+			updated_at      TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE pending_uploads (
+			file_id    TEXT PRIMARY KEY,
+			filename   TEXT NOT NULL,
+			size       INTEGER NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX pending_uploads_expires_at_idx ON pending_uploads (expires_at)`,
+		`CREATE INDEX files_created_at_idx ON files (created_at, file_id);
+		CREATE INDEX files_content_type_idx ON files (content_type, created_at);
+		CREATE INDEX files_uploader_idx ON files (uploader, created_at)`,
+		`CREATE TABLE blob_refs (
+			object_key   TEXT PRIMARY KEY,
+			hash         TEXT NOT NULL,
+			size         INTEGER NOT NULL,
+			content_type TEXT NOT NULL,
+			created_at   TIMESTAMP NOT NULL
+		);
+		CREATE INDEX blob_refs_hash_idx ON blob_refs (hash);
+		CREATE TABLE blobs (
+			hash        TEXT PRIMARY KEY,
+			refs        INTEGER NOT NULL,
+			stored      BOOLEAN NOT NULL,
+			deleting_at TIMESTAMP
+		)`,
+		`CREATE TABLE api_keys (
+			key_id     TEXT PRIMARY KEY,
+			name       TEXT NOT NULL,
+			hash       TEXT NOT NULL,
+			scopes     TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP
+		)`,
+		`ALTER TABLE files ADD COLUMN owner_group TEXT NOT NULL DEFAULT '';
+		CREATE INDEX files_owner_group_idx ON files (owner_group, created_at);
+		ALTER TABLE api_keys ADD COLUMN key_groups TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pending_uploads ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE files ADD COLUMN tenant TEXT NOT NULL DEFAULT '';
+		CREATE INDEX files_tenant_idx ON files (tenant, created_at);
+		ALTER TABLE api_keys ADD COLUMN key_tenant TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pending_uploads ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+		// Usage starts out as what is already stored.
+		`CREATE TABLE storage_usage (
+			tenant  TEXT NOT NULL,
+			owner   TEXT NOT NULL,
+			bytes   INTEGER NOT NULL,
+			objects INTEGER NOT NULL,
+			PRIMARY KEY (tenant, owner)
+		);
+		INSERT INTO storage_usage (tenant, owner, bytes, objects)
+			SELECT tenant, '', SUM(size), COUNT(*) FROM files GROUP BY tenant;
+		INSERT INTO storage_usage (tenant, owner, bytes, objects)
+			SELECT tenant, uploader, SUM(size), COUNT(*) FROM files WHERE uploader <> '' GROUP BY tenant, uploader`,
+	},
+}
+
+// NewSQLiteRepository opens, creating it if needed, the SQLite database file at path
+// and brings its schema up to date. The driver is pure Go, so no cgo toolchain is needed.
+func NewSQLiteRepository(ctx context.Context, path string) (*SQLRepository, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	// WAL lets reads continue during a write, and busy_timeout makes concurrent
+	// writers wait for the lock instead of failing immediately. Times are written in
+	// a fixed width format so that, being UTC, they compare correctly as text.
+	query := url.Values{}
+	query.Set("_time_format", "sqlite")
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "busy_timeout(5000)")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+
+	return newSQLRepository(ctx, db, sqliteDialect)
+}
@@ -0,0 +1,282 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteRepository(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "data", "metadata.db")
+	repository, err := NewSQLiteRepository(ctx, path)
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	file := &types.FileMetadata{
+		FileID:         "a1b2c3.png",
+		Filename:       "holiday photo.png",
+		ContentType:    "image/png",
+		Size:           1024,
+		Checksum:       "sha256:abcd",
+		StorageBackend: "local",
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	require.NoError(t, repository.Create(ctx, file))
+	assert.Error(t, repository.Create(ctx, file), "duplicate file IDs are rejected")
+	require.NoError(t, repository.Close())
+
+	// Reopening runs the migrations again, which must leave existing data alone.
+	repository, err = NewSQLiteRepository(ctx, path)
+	require.NoError(t, err)
+	defer repository.Close()
+
+	stored, err := repository.Get(ctx, file.FileID)
+	require.NoError(t, err)
+	assert.True(t, now.Equal(stored.CreatedAt))
+	stored.CreatedAt, stored.UpdatedAt = file.CreatedAt, file.UpdatedAt
+	assert.Equal(t, file, stored)
+
+	require.NoError(t, repository.Delete(ctx, file.FileID))
+	var notFoundErr *types.NotFoundError
+	_, err = repository.Get(ctx, file.FileID)
+	assert.ErrorAs(t, err, &notFoundErr)
+	assert.ErrorAs(t, repository.Delete(ctx, file.FileID), &notFoundErr)
+}
+
+func TestSQLRepository_Bind(t *testing.T) {
+	postgres := &SQLRepository{dialect: postgresDialect}
+	assert.Equal(t, "DELETE FROM files WHERE file_id = $1 AND size > $2", postgres.bind("DELETE FROM files WHERE file_id = ? AND size > ?"))
+
+	sqlite := &SQLRepository{dialect: sqliteDialect}
+	assert.Equal(t, "DELETE FROM files WHERE file_id = ?", sqlite.bind("DELETE FROM files WHERE file_id = ?"))
+}
+
+func TestSQLiteRepository_BlobRefs(t *testing.T) {
+	ctx := context.Background()
+	repository, err := NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer repository.Close()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	first := &types.BlobRef{Key: "a.pdf", Hash: "abcd", Size: 8, ContentType: "application/pdf", CreatedAt: now}
+	second := &types.BlobRef{Key: "b.pdf", Hash: "abcd", Size: 8, ContentType: "application/pdf", CreatedAt: now}
+	store, err := repository.AddBlobRef(ctx, first)
+	require.NoError(t, err)
+	assert.True(t, store, "the first reference stores the blob")
+	store, err = repository.AddBlobRef(ctx, second)
+	require.NoError(t, err)
+	assert.True(t, store, "the blob is stored again until it is marked as stored")
+	require.NoError(t, repository.MarkBlobStored(ctx, "abcd"))
+	_, err = repository.AddBlobRef(ctx, first)
+	assert.Error(t, err, "a key refers to one blob at a time")
+
+	listed, err := repository.ListBlobRefs(ctx, "a.pdf", 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, "b.pdf", listed[0].Key)
+
+	var deleted []string
+	deleteBlob := func(ctx context.Context, ref *types.BlobRef) { deleted = append(deleted, ref.Key) }
+	removed, err := repository.RemoveBlobRef(ctx, "a.pdf", deleteBlob)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", removed.Hash)
+	assert.Empty(t, deleted, "the blob is kept while b.pdf refers to it")
+
+	third := &types.BlobRef{Key: "c.pdf", Hash: "abcd", Size: 8, ContentType: "application/pdf", CreatedAt: now}
+	store, err = repository.AddBlobRef(ctx, third)
+	require.NoError(t, err)
+	assert.False(t, store, "a stored blob is not stored again")
+
+	// The blob is deleted outside of the removal's transaction, and gains no reference
+	// until it is gone.
+	deleteBlob = func(ctx context.Context, ref *types.BlobRef) {
+		deleted = append(deleted, ref.Key)
+		_, err := repository.AddBlobRef(ctx, &types.BlobRef{Key: "d.pdf", Hash: "abcd", CreatedAt: now})
+		assert.ErrorIs(t, err, storage.ErrBlobDeleting)
+	}
+	for _, key := range []string{"b.pdf", "c.pdf"} {
+		_, err = repository.RemoveBlobRef(ctx, key, deleteBlob)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"c.pdf"}, deleted, "the last reference deletes the blob")
+
+	store, err = repository.AddBlobRef(ctx, first)
+	require.NoError(t, err)
+	assert.True(t, store, "a deleted blob is stored again")
+
+	var notFoundErr *types.NotFoundError
+	_, err = repository.GetBlobRef(ctx, "b.pdf")
+	assert.ErrorAs(t, err, &notFoundErr)
+	_, err = repository.RemoveBlobRef(ctx, "b.pdf", deleteBlob)
+	assert.ErrorAs(t, err, &notFoundErr)
+}
+
+func TestSQLiteRepository_APIKeys(t *testing.T) {
+	ctx := context.Background()
+	repository, err := NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer repository.Close()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	key := &types.APIKey{ID: "0123456789abcdef", Name: "ci", Hash: "abcd", Scopes: []string{"files:read", "files:write"}, CreatedAt: now}
+	require.NoError(t, repository.CreateAPIKey(ctx, key))
+	assert.Error(t, repository.CreateAPIKey(ctx, key), "key IDs are unique")
+
+	stored, err := repository.GetAPIKey(ctx, key.ID)
+	require.NoError(t, err)
+	assert.Equal(t, key.Scopes, stored.Scopes)
+	assert.True(t, now.Equal(stored.CreatedAt))
+	assert.Nil(t, stored.RevokedAt)
+
+	require.NoError(t, repository.RevokeAPIKey(ctx, key.ID, now))
+	listed, err := repository.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	require.NotNil(t, listed[0].RevokedAt)
+	assert.True(t, now.Equal(*listed[0].RevokedAt))
+
+	var notFoundErr *types.NotFoundError
+	_, err = repository.GetAPIKey(ctx, "missing")
+	assert.ErrorAs(t, err, &notFoundErr)
+	assert.ErrorAs(t, repository.RevokeAPIKey(ctx, "missing", now), &notFoundErr)
+}
+
+func TestSQLiteRepository_ListVisibleTo(t *testing.T) {
+	ctx := context.Background()
+	repository, err := NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer repository.Close()
+
+	now := time.Now().UTC()
+	for _, file := range []types.FileMetadata{
+		{FileID: "a.png", Uploader: "alice", Group: "finance"},
+		{FileID: "b.png", Uploader: "bob", Group: "sales"},
+		{FileID: "c.png", Uploader: "carol", Group: "finance"},
+		{FileID: "legacy.png"},
+		{FileID: "d.png", Uploader: "bob", Group: "finance", Tenant: "acme"},
+	} {
+		file.Filename, file.ContentType, file.StorageBackend, file.CreatedAt, file.UpdatedAt = file.FileID, "image/png", "local", now, now
+		require.NoError(t, repository.Create(ctx, &file))
+	}
+
+	tests := []struct {
+		name   string
+		access *types.FileAccess
+		tenant string
+		want   []string
+	}{
+		{name: "everything", want: []string{"a.png", "b.png", "c.png", "legacy.png"}},
+		{name: "own files", access: &types.FileAccess{Owner: "bob"}, want: []string{"b.png"}},
+		{name: "own and group files", access: &types.FileAccess{Owner: "bob", Groups: []string{"finance"}}, want: []string{"a.png", "b.png", "c.png"}},
+		{name: "no owner", access: &types.FileAccess{}, want: []string{}},
+		{name: "another tenant", access: &types.FileAccess{Owner: "bob"}, tenant: "acme", want: []string{"d.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := repository.List(ctx, &types.FileListQuery{Sort: types.FileSortFilename, Limit: 10, VisibleTo: tt.access, Tenant: tt.tenant})
+			require.NoError(t, err)
+			ids := []string{}
+			for _, file := range page.Files {
+				ids = append(ids, file.FileID)
+			}
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+
+	stored, err := repository.Get(ctx, "d.png")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", stored.Tenant)
+}
+
+func TestSQLiteRepository_Usage(t *testing.T) {
+	ctx := context.Background()
+	repository, err := NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer repository.Close()
+
+	tenantScope := types.UsageScope{Tenant: "acme"}
+	ownerScope := types.UsageScope{Tenant: "acme", Owner: "alice"}
+	charges := []types.UsageCharge{
+		{Scope: tenantScope, Quota: types.Usage{Bytes: 100}},
+		{Scope: ownerScope, Quota: types.Usage{Objects: 8}},
+	}
+
+	// Concurrent charges must not both fit into the last of a quota.
+	var wg sync.WaitGroup
+	errs := make([]error, 12)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = repository.AddUsage(ctx, types.Usage{Bytes: 10, Objects: 1}, charges)
+		}()
+	}
+	wg.Wait()
+	exceeded := 0
+	for _, err := range errs {
+		var exceededErr *types.QuotaExceededError
+		if errors.As(err, &exceededErr) {
+			exceeded++
+			assert.Equal(t, ownerScope, exceededErr.Scope)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	assert.Equal(t, 4, exceeded)
+
+	usage, err := repository.GetUsage(ctx, tenantScope)
+	require.NoError(t, err)
+	assert.Equal(t, types.Usage{Bytes: 80, Objects: 8}, usage, "a refused charge changes no scope")
+
+	var exceededErr *types.QuotaExceededError
+	err = repository.AddUsage(ctx, types.Usage{Bytes: 30}, charges[:1])
+	require.ErrorAs(t, err, &exceededErr)
+	assert.Equal(t, tenantScope, exceededErr.Scope)
+
+	require.NoError(t, repository.AddUsage(ctx, types.Usage{Bytes: -10, Objects: -1}, charges))
+	usage, err = repository.GetUsage(ctx, ownerScope)
+	require.NoError(t, err)
+	assert.Equal(t, types.Usage{Bytes: 70, Objects: 7}, usage)
+
+	usage, err = repository.GetUsage(ctx, types.UsageScope{Tenant: "globex"})
+	require.NoError(t, err)
+	assert.Zero(t, usage)
+}
+
+func TestSQLiteRepository_PendingUploads(t *testing.T) {
+	ctx := context.Background()
+	repository, err := NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer repository.Close()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	upload := &types.PendingUpload{FileID: "a1b2.png", Filename: "photo.png", Size: 1024, Tenant: "acme", ExpiresAt: now.Add(time.Hour)}
+	expired := &types.PendingUpload{FileID: "c3d4.png", Filename: "old.png", Size: 10, ExpiresAt: now.Add(-time.Hour)}
+	require.NoError(t, repository.SavePendingUpload(ctx, upload))
+	require.NoError(t, repository.SavePendingUpload(ctx, expired))
+
+	listed, err := repository.ListExpiredPendingUploads(ctx, now, 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, expired.FileID, listed[0].FileID)
+	var notFoundErr *types.NotFoundError
+
+	stored, err := repository.GetPendingUpload(ctx, upload.FileID)
+	require.NoError(t, err)
+	assert.True(t, upload.ExpiresAt.Equal(stored.ExpiresAt))
+	stored.ExpiresAt = upload.ExpiresAt
+	assert.Equal(t, upload, stored)
+
+	require.NoError(t, repository.DeletePendingUpload(ctx, upload.FileID))
+	assert.ErrorAs(t, repository.DeletePendingUpload(ctx, upload.FileID), &notFoundErr, "an upload is only completed once")
+}
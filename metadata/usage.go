@@ -0,0 +1,69 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// SQLRepository also keeps usage, in the storage_usage table. The usage of a whole
+// tenant is kept with an empty owner.
+var _ UsageStore = (*SQLRepository)(nil)
+
+func (r *SQLRepository) AddUsage(ctx context.Context, delta types.Usage, charges []types.UsageCharge) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return types.NewDBError("failed to start updating usage", err)
+	}
+	defer tx.Rollback()
+
+	for _, charge := range charges {
+		scope := charge.Scope
+		if _, err := tx.ExecContext(ctx, r.bind(`
+			INSERT INTO storage_usage (tenant, owner, bytes, objects) VALUES (?, ?, 0, 0)
+			ON CONFLICT (tenant, owner) DO NOTHING`), scope.Tenant, scope.Owner); err != nil {
+			return types.NewDBError("failed to create usage of tenant '"+scope.Tenant+"' owner '"+scope.Owner+"'", err)
+		}
+
+		// The quota is checked by the update itself, which holds the row's lock, so
+		// concurrent uploads cannot both fit into the last of a quota.
+		statement := `UPDATE storage_usage SET bytes = bytes + ?, objects = objects + ? WHERE tenant = ? AND owner = ?`
+		args := []any{delta.Bytes, delta.Objects, scope.Tenant, scope.Owner}
+		if delta.Bytes > 0 && charge.Quota.Bytes > 0 {
+			statement += " AND bytes + ? <= ?"
+			args = append(args, delta.Bytes, charge.Quota.Bytes)
+		}
+		if delta.Objects > 0 && charge.Quota.Objects > 0 {
+			statement += " AND objects + ? <= ?"
+			args = append(args, delta.Objects, charge.Quota.Objects)
+		}
+		result, err := tx.ExecContext(ctx, r.bind(statement), args...)
+		if err != nil {
+			return types.NewDBError("failed to update usage of tenant '"+scope.Tenant+"' owner '"+scope.Owner+"'", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return types.NewDBError("failed to update usage of tenant '"+scope.Tenant+"' owner '"+scope.Owner+"'", err)
+		}
+		if rows == 0 {
+			return &types.QuotaExceededError{Scope: scope, Quota: charge.Quota}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return types.NewDBError("failed to commit usage update", err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) GetUsage(ctx context.Context, scope types.UsageScope) (types.Usage, error) {
+	var usage types.Usage
+	err := r.db.QueryRowContext(ctx, r.bind(`SELECT bytes, objects FROM storage_usage WHERE tenant = ? AND owner = ?`), scope.Tenant, scope.Owner).
+		Scan(&usage.Bytes, &usage.Objects)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return types.Usage{}, types.NewDBError("failed to read usage of tenant '"+scope.Tenant+"' owner '"+scope.Owner+"'", err)
+	}
+	return usage, nil
+}
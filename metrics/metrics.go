@@ -0,0 +1,148 @@
+// Package metrics defines the Prometheus metrics the service exposes on /metrics.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "fileuploader"
+
+// Upload outcomes, as recorded in the outcome label.
+const (
+	OutcomeSuccess  = "success"
+	OutcomeRejected = "rejected"
+	OutcomeError    = "error"
+)
+
+// Registry holds every metric of the service, along with the Go runtime and process
+// collectors. A registry of our own keeps tests independent of the global default.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests being served.",
+	})
+
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by method and status code.",
+	}, []string{"method", "code"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	Uploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_total",
+		Help:      "Files uploaded, by detected MIME type and outcome. The type is \"unknown\" if the upload failed before it was detected.",
+	}, []string{"content_type", "outcome"})
+
+	UploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Time taken to receive, store and record an uploaded file, by outcome.",
+		// Uploads of up to hundreds of megabytes take far longer than other requests.
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"outcome"})
+
+	UploadSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_size_bytes",
+		Help:      "Size of successfully uploaded files.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10), // 1KiB to 256MiB
+	})
+
+	UploadBytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_received_bytes_total",
+		Help:      "Bytes of file content received, including uploads that failed.",
+	})
+
+	StorageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Time taken by storage backend operations, by backend, operation and outcome.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"backend", "operation", "outcome"})
+
+	Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Error responses, by HTTP status.",
+	}, []string{"status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequestsInFlight,
+		HTTPRequests,
+		HTTPRequestDuration,
+		Uploads,
+		UploadDuration,
+		UploadSize,
+		UploadBytesReceived,
+		StorageDuration,
+		Errors,
+	)
+}
+
+// Handler serves Registry in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveError counts an error response with the given status.
+func ObserveError(status int) {
+	Errors.WithLabelValues(strconv.Itoa(status)).Inc()
+}
+
+// ObserveUpload records the outcome of an upload that started at start. contentType
+// is the detected MIME type, or empty if the upload failed before it was detected.
+func ObserveUpload(contentType string, size int64, start time.Time, err error) {
+	outcome := OutcomeSuccess
+	var appErr *types.AppError
+	var notFoundErr *types.NotFoundError
+	var badRequestErr *types.BadRequestError
+	switch {
+	case err == nil:
+		UploadSize.Observe(float64(size))
+	case errors.As(err, &appErr) && appErr.HTTPStatus < http.StatusInternalServerError,
+		errors.As(err, &notFoundErr), errors.As(err, &badRequestErr):
+		outcome = OutcomeRejected
+	default:
+		outcome = OutcomeError
+	}
+	if contentType == "" {
+		contentType = "unknown"
+	}
+	Uploads.WithLabelValues(contentType, outcome).Inc()
+	UploadDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+// ObserveStorage records how long a storage operation that started at start took.
+// It is meant to be deferred with a pointer to the operation's named error result.
+func ObserveStorage(backend, operation string, start time.Time, err *error) {
+	outcome := OutcomeSuccess
+	var notFoundErr *types.NotFoundError
+	if *err != nil && !errors.As(*err, &notFoundErr) {
+		outcome = OutcomeError
+	}
+	StorageDuration.WithLabelValues(backend, operation, outcome).Observe(time.Since(start).Seconds())
+}
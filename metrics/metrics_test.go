@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveUpload(t *testing.T) {
+	before := testutil.ToFloat64(Uploads.WithLabelValues("image/png", OutcomeSuccess))
+	ObserveUpload("image/png", 2048, time.Now(), nil)
+	assert.Equal(t, before+1, testutil.ToFloat64(Uploads.WithLabelValues("image/png", OutcomeSuccess)))
+
+	before = testutil.ToFloat64(Uploads.WithLabelValues("unknown", OutcomeRejected))
+	ObserveUpload("", 0, time.Now(), types.NewAppError("Invalid File Type", "", http.StatusBadRequest, nil))
+	assert.Equal(t, before+1, testutil.ToFloat64(Uploads.WithLabelValues("unknown", OutcomeRejected)))
+
+	before = testutil.ToFloat64(Uploads.WithLabelValues("application/pdf", OutcomeError))
+	ObserveUpload("application/pdf", 0, time.Now(), errors.New("storage unavailable"))
+	assert.Equal(t, before+1, testutil.ToFloat64(Uploads.WithLabelValues("application/pdf", OutcomeError)))
+}
+
+func TestHandler(t *testing.T) {
+	ObserveError(http.StatusRequestEntityTooLarge)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `fileuploader_errors_total{status="413"}`)
+	assert.Contains(t, rec.Body.String(), "go_goroutines")
+}
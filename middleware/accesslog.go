@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// AccessLog writes one structured log line for every request once it has been served.
+type AccessLog struct {
+	trustedProxies []netip.Prefix
+}
+
+// NewAccessLog creates an AccessLog that takes the client address from X-Forwarded-For
+// when a request arrives through one of trustedProxies, given as IP addresses or CIDR
+// prefixes such as the nginx container or the load balancer's subnets.
+func NewAccessLog(trustedProxies []string) (*AccessLog, error) {
+	a := &AccessLog{}
+	for _, proxy := range trustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR prefix", proxy)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		a.trustedProxies = append(a.trustedProxies, prefix.Masked())
+	}
+	return a, nil
+}
+
+// Middleware logs the method, path, status, request and response sizes, duration and
+// client IP of every request served by next.
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+		body := &countingReader{r: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		slog.InfoContext(r.Context(), "Request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"requestBytes", body.n,
+			"responseBytes", recorder.written,
+			"duration", time.Since(start),
+			"remoteIP", a.ClientIP(r),
+			"userAgent", r.UserAgent(),
+		)
+	})
+}
+
+// ClientIP returns the address of the client that made r. When r came from a trusted
+// proxy, X-Forwarded-For is read from the right, skipping the addresses of further
+// trusted proxies; anything left of the first untrusted address may have been forged
+// by the client.
+func (a *AccessLog) ClientIP(r *http.Request) string {
+	host := remoteHost(r)
+	if !a.trusted(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		candidate := strings.TrimSpace(forwarded[i])
+		if candidate == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(candidate); err != nil {
+			// A malformed entry cannot be trusted, nor can anything left of it.
+			return host
+		}
+		host = candidate
+		if !a.trusted(candidate) {
+			return candidate
+		}
+	}
+	return host
+}
+
+// FromTrustedProxy reports whether r was sent directly by one of the trusted proxies,
+// so that the headers they set on it can be believed.
+func (a *AccessLog) FromTrustedProxy(r *http.Request) bool {
+	return a.trusted(remoteHost(r))
+}
+
+// remoteHost returns the address r was sent from, without its port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *AccessLog) trusted(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range a.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseRecorder remembers the status code and number of bytes written to a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	// Informational responses such as 100 Continue precede the real status.
+	if rec.status == 0 && status >= http.StatusOK {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, to flush or set deadlines.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
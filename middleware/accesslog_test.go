@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog_ClientIP(t *testing.T) {
+	accessLog, err := NewAccessLog([]string{"10.0.0.0/8", "127.0.0.1"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:51234", want: "203.0.113.7"},
+		{name: "untrusted peer cannot claim another address", remoteAddr: "203.0.113.7:51234", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "through nginx", remoteAddr: "127.0.0.1:40000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "through load balancer and nginx", remoteAddr: "127.0.0.1:40000", forwarded: []string{"198.51.100.1, 10.0.3.4"}, want: "198.51.100.1"},
+		{name: "forged entries left of the client are ignored", remoteAddr: "10.0.3.4:40000", forwarded: []string{"192.0.2.9", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "malformed entry", remoteAddr: "10.0.3.4:40000", forwarded: []string{"198.51.100.1, not-an-ip"}, want: "10.0.3.4"},
+		{name: "only proxies", remoteAddr: "10.0.3.4:40000", forwarded: []string{"10.0.9.9"}, want: "10.0.9.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, tt.want, accessLog.ClientIP(req))
+		})
+	}
+
+	_, err = NewAccessLog([]string{"nginx"})
+	assert.Error(t, err)
+}
+
+func TestAccessLog_Middleware(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	accessLog, err := NewAccessLog(nil)
+	require.NoError(t, err)
+	handler := accessLog.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"fileId":"abc"}`))
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/upload?x=1", strings.NewReader("file content"))
+	req.RemoteAddr = "203.0.113.7:51234"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "Request completed", record["msg"])
+	assert.Equal(t, "POST", record["method"])
+	assert.Equal(t, "/upload", record["path"])
+	assert.Equal(t, float64(http.StatusCreated), record["status"])
+	assert.Equal(t, float64(len("file content")), record["requestBytes"])
+	assert.Equal(t, float64(len(`{"fileId":"abc"}`)), record["responseBytes"])
+	assert.Equal(t, "203.0.113.7", record["remoteIP"])
+	assert.Contains(t, record, "duration")
+}
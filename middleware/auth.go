@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/pizza-nz/file-uploader/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Authenticator only lets requests through whose caller holds the scope of the
+// route. Callers present an API key, in an X-API-Key header or as an Authorization
+// bearer token, or a JWT from the identity provider as a bearer token.
+type Authenticator struct {
+	keys   auth.KeyStore
+	tokens *auth.JWTVerifier
+}
+
+// NewAuthenticator creates an Authenticator that checks API keys against keys and
+// JWTs with tokens. Either may be nil, in which case that kind of credential is
+// not accepted.
+func NewAuthenticator(keys auth.KeyStore, tokens *auth.JWTVerifier) *Authenticator {
+	return &Authenticator{keys: keys, tokens: tokens}
+}
+
+// Require serves requests whose caller holds scope with next, with the caller's
+// principal stored in the request context by auth.WithPrincipal. Requests without
+// a valid credential are rejected with 401, and callers without scope with 403.
+func (a *Authenticator) Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="file-uploader", error="invalid_token"`)
+			utils.HandleError(w, r, err)
+			return
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("enduser.id", principal.ID))
+
+		if !principal.HasScope(scope) {
+			utils.HandleError(w, r, types.NewAuthorizationError(principal.ID+" does not hold scope "+scope, nil))
+			return
+		}
+
+		next(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	}
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (*auth.Principal, error) {
+	token := r.Header.Get("X-API-Key")
+	if token == "" {
+		scheme, credentials, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(credentials)
+		}
+	}
+
+	switch {
+	case token == "":
+		return nil, types.NewAuthenticationError("no API key or bearer token was presented", nil)
+	case a.keys != nil && auth.IsAPIKey(token):
+		return auth.Authenticate(r.Context(), a.keys, token)
+	case a.tokens != nil && !auth.IsAPIKey(token):
+		return a.tokens.Verify(r.Context(), token)
+	}
+	return nil, types.NewAuthenticationError("the presented credential is not accepted", nil)
+}
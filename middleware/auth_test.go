@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticator_APIKeys(t *testing.T) {
+	keys, err := auth.NewFileKeyStore(filepath.Join(t.TempDir(), "apikeys.yml"))
+	require.NoError(t, err)
+	token, key, err := auth.NewAPIKey("ci", []string{auth.ScopeFilesRead}, nil)
+	require.NoError(t, err)
+	require.NoError(t, keys.CreateAPIKey(context.Background(), key))
+
+	var principal *auth.Principal
+	next := func(w http.ResponseWriter, r *http.Request) {
+		principal = auth.PrincipalFromContext(r.Context())
+	}
+	a := NewAuthenticator(keys, nil)
+
+	tests := []struct {
+		name   string
+		scope  string
+		header string
+		value  string
+		status int
+	}{
+		{name: "X-API-Key", scope: auth.ScopeFilesRead, header: "X-API-Key", value: token, status: http.StatusOK},
+		{name: "bearer token", scope: auth.ScopeFilesRead, header: "Authorization", value: "Bearer " + token, status: http.StatusOK},
+		{name: "missing key", scope: auth.ScopeFilesRead, status: http.StatusUnauthorized},
+		{name: "unknown key", scope: auth.ScopeFilesRead, header: "X-API-Key", value: "fu_0000000000000000_secret", status: http.StatusUnauthorized},
+		{name: "JWT when only API keys are accepted", scope: auth.ScopeFilesRead, header: "Authorization", value: "Bearer eyJhbGciOiJSUzI1NiJ9.e30.c2ln", status: http.StatusUnauthorized},
+		{name: "missing scope", scope: auth.ScopeFilesDelete, header: "X-API-Key", value: token, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal = nil
+			req := httptest.NewRequest(http.MethodGet, "/files", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			a.Require(tt.scope, next)(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.status == http.StatusOK {
+				require.NotNil(t, principal)
+				assert.Equal(t, "apikey:"+key.ID, principal.ID)
+			} else {
+				assert.Nil(t, principal, "the handler is not called")
+			}
+			if tt.status == http.StatusUnauthorized {
+				assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
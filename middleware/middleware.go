@@ -1,21 +1,64 @@
 package middleware
 
 import (
-	"log/slog"
 	"net/http"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/pizza-nz/file-uploader/logging"
+	"github.com/pizza-nz/file-uploader/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// RequestIDMiddleware is a middleware that generates a unique request ID for each incoming HTTP request.
-// It adds the request ID to the response header and logs the request details.
-func RequestIDMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestID := uuid.New().String()
+// maxRequestIDLength bounds the inbound request IDs that are accepted.
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware gives each incoming HTTP request a request ID, which is stored in
+// the request context with logging.WithRequestID, so that every log written with that
+// context includes it, and returned in the X-Request-ID response header. A well formed
+// X-Request-ID is kept when trustedProxy reports that the request came from a proxy,
+// such as nginx, whose ID can be believed, so the request can be followed across both;
+// otherwise, or if trustedProxy is nil, a new ID is generated. AccessLog.FromTrustedProxy
+// applies the same trusted proxies as the access log.
+// Each request is also traced in a server span that continues any trace named in the
+// request's W3C traceparent header.
+func RequestIDMiddleware(trustedProxy func(r *http.Request) bool, next http.Handler) http.Handler {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if trustedProxy == nil || !trustedProxy(r) || !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		ctx := logging.WithRequestID(r.Context(), requestID)
 
 		w.Header().Set("X-Request-ID", requestID)
-		slog.Info("Received request", "requestID", requestID, "method", r.Method, "url", r.URL.String())
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("request.id", requestID))
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
-}
\ No newline at end of file
+	return otelhttp.NewHandler(handler, "HTTP request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method }))
+}
+
+// validRequestID reports whether an inbound request ID is safe to log and echo back:
+// short, and made only of characters that appear in UUIDs and proxy-generated IDs.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MetricsMiddleware counts and times every request, and tracks how many are in flight.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerInFlight(metrics.HTTPRequestsInFlight,
+		promhttp.InstrumentHandlerDuration(metrics.HTTPRequestDuration,
+			promhttp.InstrumentHandlerCounter(metrics.HTTPRequests, next)))
+}
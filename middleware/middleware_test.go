@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	accessLog, err := NewAccessLog([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	var seen string
+	handler := RequestIDMiddleware(accessLog.FromTrustedProxy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		inbound    string
+		remoteAddr string
+		keep       bool
+	}{
+		{name: "nginx request ID", inbound: "7f3c9a1b2d4e5f60718293a4b5c6d7e8", keep: true},
+		{name: "UUID", inbound: "0d9b6a3e-2f41-4c55-9a7e-1b2c3d4e5f60", keep: true},
+		{name: "missing", inbound: ""},
+		{name: "too long", inbound: strings.Repeat("a", maxRequestIDLength+1)},
+		{name: "log injection", inbound: "abc\nlevel=ERROR"},
+		{name: "untrusted client", inbound: "0d9b6a3e-2f41-4c55-9a7e-1b2c3d4e5f60", remoteAddr: "203.0.113.7:4711"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.RemoteAddr = "10.0.0.2:50000"
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			if tt.inbound != "" {
+				req.Header.Set("X-Request-ID", tt.inbound)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, seen, rec.Header().Get("X-Request-ID"))
+			if tt.keep {
+				assert.Equal(t, tt.inbound, seen)
+			} else {
+				assert.NotEqual(t, tt.inbound, seen)
+				assert.Len(t, seen, 36, "a new UUID is generated")
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ResolveTenant returns a middleware that stores the tenant each request is made
+// for in its context, by tenant.WithTenant. It must run after authentication, as a
+// caller's credentials decide its tenant.
+func ResolveTenant(resolver *tenant.Resolver) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			t, err := resolver.Resolve(r)
+			if err != nil {
+				utils.HandleError(w, r, err)
+				return
+			}
+			if t != nil {
+				trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("tenant.id", t.ID))
+				r = r.WithContext(tenant.WithTenant(r.Context(), t))
+			}
+			next(w, r)
+		}
+	}
+}
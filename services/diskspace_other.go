@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package services
+
+import "errors"
+
+// freeDiskSpace is not implemented on this platform.
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
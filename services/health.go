@@ -0,0 +1,150 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// DependencyCheck checks that one dependency of the service is usable.
+type DependencyCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// StorageCheck checks fileStorage, if its backend can be checked.
+func StorageCheck(fileStorage storage.FileStorage) DependencyCheck {
+	return DependencyCheck{Name: "storage", Check: func(ctx context.Context) error {
+		if checker, ok := fileStorage.(storage.HealthChecker); ok {
+			return checker.CheckHealth(ctx)
+		}
+		return nil
+	}}
+}
+
+// TenantStorageChecks checks fileStorage for each tenant that keeps its files in a
+// bucket of its own, as a check named storage:<tenant ID>.
+func TenantStorageChecks(fileStorage storage.FileStorage, tenants []*tenant.Tenant) []DependencyCheck {
+	var checks []DependencyCheck
+	for _, t := range tenants {
+		if t.Bucket == "" {
+			continue
+		}
+		check := StorageCheck(fileStorage)
+		checks = append(checks, DependencyCheck{Name: "storage:" + t.ID, Check: func(ctx context.Context) error {
+			return check.Check(tenant.WithTenant(ctx, t))
+		}})
+	}
+	return checks
+}
+
+// MetadataCheck checks the metadata store can be reached.
+func MetadataCheck(repository metadata.Repository) DependencyCheck {
+	return DependencyCheck{Name: "metadata", Check: repository.Ping}
+}
+
+// DiskSpaceCheck checks the volume holding path has at least minFree bytes available,
+// as uploads are staged there. It always passes where free space cannot be measured.
+func DiskSpaceCheck(path string, minFree uint64) DependencyCheck {
+	return DependencyCheck{Name: "disk", Check: func(ctx context.Context) error {
+		free, err := freeDiskSpace(path)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to measure free space for %s: %w", path, err)
+		}
+		if free < minFree {
+			return fmt.Errorf("%d bytes free for %s, below the minimum of %d", free, path, minFree)
+		}
+		return nil
+	}}
+}
+
+type ReadinessService interface {
+	// Ready checks every dependency, or returns the last report if it is recent enough.
+	Ready(ctx context.Context) *types.ReadinessReport
+}
+
+type ReadinessServiceImpl struct {
+	checks   []DependencyCheck
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	mu     sync.Mutex
+	report *types.ReadinessReport
+}
+
+// NewReadinessService creates a ReadinessService that gives each check up to timeout,
+// and reuses a report for cacheTTL so frequent probes do not load the dependencies.
+func NewReadinessService(checks []DependencyCheck, timeout, cacheTTL time.Duration) ReadinessService {
+	return &ReadinessServiceImpl{checks: checks, timeout: timeout, cacheTTL: cacheTTL}
+}
+
+// Ready runs the checks concurrently. Callers that arrive while the checks are running
+// wait for, and share, their report.
+func (s *ReadinessServiceImpl) Ready(ctx context.Context) *types.ReadinessReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.report != nil && time.Since(s.report.CheckedAt) < s.cacheTTL {
+		return s.report
+	}
+
+	report := &types.ReadinessReport{
+		Status:    "ok",
+		CheckedAt: time.Now().UTC(),
+		Checks:    make(map[string]types.DependencyCheck, len(s.checks)),
+	}
+	results := make([]types.DependencyCheck, len(s.checks))
+	var wg sync.WaitGroup
+	for i, check := range s.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = s.run(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	for i, check := range s.checks {
+		report.Checks[check.Name] = results[i]
+		if results[i].Status != "ok" {
+			report.Status = "unavailable"
+		}
+	}
+	s.report = report
+	return report
+}
+
+func (s *ReadinessServiceImpl) run(ctx context.Context, check DependencyCheck) types.DependencyCheck {
+	// A probe that gives up must not cut short a check other probes are waiting on.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Not every check honours its context, so stop waiting at the deadline anyway.
+		err = fmt.Errorf("timed out after %s", s.timeout)
+	}
+
+	result := types.DependencyCheck{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+	}
+	return result
+}
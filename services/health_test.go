@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadinessService_Ready(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+
+	var bucketChecks atomic.Int32
+	service := NewReadinessService([]DependencyCheck{
+		StorageCheck(fileStorage),
+		MetadataCheck(metadata.NewMemoryRepository()),
+		DiskSpaceCheck(t.TempDir(), 1),
+		{Name: "bucket", Check: func(ctx context.Context) error {
+			bucketChecks.Add(1)
+			return errors.New("AccessDenied")
+		}},
+	}, time.Second, time.Minute)
+
+	report := service.Ready(context.Background())
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Equal(t, "ok", report.Checks["storage"].Status)
+	assert.Equal(t, "ok", report.Checks["metadata"].Status)
+	assert.Equal(t, "ok", report.Checks["disk"].Status)
+	assert.Equal(t, "failed", report.Checks["bucket"].Status)
+	assert.Equal(t, "AccessDenied", report.Checks["bucket"].Error)
+
+	assert.Same(t, report, service.Ready(context.Background()), "the report is cached")
+	assert.Equal(t, int32(1), bucketChecks.Load())
+}
+
+func TestReadinessService_Timeout(t *testing.T) {
+	service := NewReadinessService([]DependencyCheck{
+		{Name: "database", Check: func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}},
+		DiskSpaceCheck(t.TempDir(), 1<<62),
+	}, 20*time.Millisecond, 0)
+
+	start := time.Now()
+	report := service.Ready(context.Background())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Contains(t, report.Checks["database"].Error, "timed out")
+	assert.Equal(t, "failed", report.Checks["disk"].Status)
+}
+
+// bucketStorage is storage whose health check fails for one tenant's bucket.
+type bucketStorage struct {
+	storage.FileStorage
+	missing string
+}
+
+func (b bucketStorage) CheckHealth(ctx context.Context) error {
+	if t := tenant.FromContext(ctx); t != nil && t.Bucket == b.missing {
+		return errors.New("NoSuchBucket")
+	}
+	return nil
+}
+
+func TestReadinessService_ChecksTenantBuckets(t *testing.T) {
+	fileStorage := bucketStorage{missing: "globex-uploads"}
+	service := NewReadinessService(append([]DependencyCheck{StorageCheck(fileStorage)}, TenantStorageChecks(fileStorage, []*tenant.Tenant{
+		{ID: "acme", Bucket: "acme-uploads"},
+		{ID: "globex", Bucket: "globex-uploads"},
+		{ID: "initech"},
+	})...), time.Second, 0)
+
+	report := service.Ready(context.Background())
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Equal(t, "ok", report.Checks["storage"].Status)
+	assert.Equal(t, "ok", report.Checks["storage:acme"].Status)
+	assert.Equal(t, "failed", report.Checks["storage:globex"].Status)
+	assert.NotContains(t, report.Checks, "storage:initech", "tenants in the shared bucket need no check of their own")
+}
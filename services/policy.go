@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// Action is something a caller can do with a stored file.
+type Action string
+
+const (
+	ActionRead   Action = "read"
+	ActionDelete Action = "delete"
+)
+
+// AccessPolicy decides which stored files a caller may use. The principal is nil
+// when authentication is disabled.
+type AccessPolicy interface {
+	// Authorize returns an authorization error if principal may not perform action
+	// on file. A file stored without metadata is described only by its FileID.
+	Authorize(ctx context.Context, principal *auth.Principal, action Action, file *types.FileMetadata) error
+	// Visible returns the files principal may list, or nil if it may list every file.
+	Visible(ctx context.Context, principal *auth.Principal) *types.FileAccess
+}
+
+// OwnershipPolicy lets a caller use the files it uploaded and the files shared with
+// any of its groups. Callers holding auth.ScopeFilesAdmin can use every file, and
+// are the only callers that can use files with no owner, such as those uploaded
+// before authentication was enabled.
+type OwnershipPolicy struct{}
+
+var _ AccessPolicy = OwnershipPolicy{}
+
+func (OwnershipPolicy) Authorize(ctx context.Context, principal *auth.Principal, action Action, file *types.FileMetadata) error {
+	if principal == nil || principal.HasScope(auth.ScopeFilesAdmin) {
+		return nil
+	}
+	access := types.FileAccess{Owner: principal.ID, Groups: principal.Groups}
+	if !access.Allows(file) {
+		return types.NewAuthorizationError(fmt.Sprintf("%s may not %s file %s owned by '%s' in group '%s'", principal.ID, action, file.FileID, file.Uploader, file.Group), nil)
+	}
+	return nil
+}
+
+func (OwnershipPolicy) Visible(ctx context.Context, principal *auth.Principal) *types.FileAccess {
+	if principal == nil || principal.HasScope(auth.ScopeFilesAdmin) {
+		return nil
+	}
+	return &types.FileAccess{Owner: principal.ID, Groups: principal.Groups}
+}
+
+// setOwner records the principal in ctx, if any, as the owner of file, shared with
+// the principal's first group.
+func setOwner(ctx context.Context, file *types.FileMetadata) {
+	principal := auth.PrincipalFromContext(ctx)
+	if principal == nil {
+		return
+	}
+	file.Uploader = principal.ID
+	if len(principal.Groups) > 0 {
+		file.Group = principal.Groups[0]
+	}
+}
+
+// callerID returns the ID of the principal in ctx, or "" if there is none.
+func callerID(ctx context.Context) string {
+	if principal := auth.PrincipalFromContext(ctx); principal != nil {
+		return principal.ID
+	}
+	return ""
+}
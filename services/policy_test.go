@@ -0,0 +1,81 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwnershipPolicy_Authorize(t *testing.T) {
+	file := &types.FileMetadata{FileID: "report.pdf", Uploader: "alice", Group: "finance"}
+	unowned := &types.FileMetadata{FileID: "legacy.pdf"}
+
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		file      *types.FileMetadata
+		allowed   bool
+	}{
+		{name: "authentication disabled", file: file, allowed: true},
+		{name: "owner", principal: &auth.Principal{ID: "alice"}, file: file, allowed: true},
+		{name: "group member", principal: &auth.Principal{ID: "bob", Groups: []string{"sales", "finance"}}, file: file, allowed: true},
+		{name: "another team", principal: &auth.Principal{ID: "carol", Groups: []string{"sales"}}, file: file},
+		{name: "admin", principal: &auth.Principal{ID: "dave", Scopes: []string{auth.ScopeFilesAdmin}}, file: file, allowed: true},
+		{name: "unowned file", principal: &auth.Principal{ID: "alice"}, file: unowned},
+		{name: "unowned file and no group", principal: &auth.Principal{ID: "erin", Groups: []string{""}}, file: unowned},
+		{name: "admin and unowned file", principal: &auth.Principal{ID: "dave", Scopes: []string{auth.ScopeFilesAdmin}}, file: unowned, allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := OwnershipPolicy{}.Authorize(context.Background(), tt.principal, ActionRead, tt.file)
+			if tt.allowed {
+				assert.NoError(t, err)
+				return
+			}
+			var appErr *types.AppError
+			require.ErrorAs(t, err, &appErr)
+			assert.Equal(t, http.StatusForbidden, appErr.HTTPStatus)
+		})
+	}
+}
+
+func TestFileUploadService_EnforcesOwnership(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	service := NewFileUploadService(fileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 2)
+
+	as := func(id string, groups ...string) context.Context {
+		return auth.WithPrincipal(context.Background(), &auth.Principal{ID: id, Groups: groups})
+	}
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	response, err := service.CreateFileUpload(as("alice", "finance", "sales"), bytes.NewReader(content), &types.FileUploadRequest{Filename: "budget.png"})
+	require.NoError(t, err)
+
+	var appErr *types.AppError
+	_, err = service.GetFileUpload(as("carol", "sales"), response.FileID)
+	require.ErrorAs(t, err, &appErr, "the file is only shared with alice's first group")
+	assert.Equal(t, http.StatusForbidden, appErr.HTTPStatus)
+	assert.ErrorAs(t, service.DeleteFileUpload(as("carol", "sales"), response.FileID), &appErr)
+
+	page, err := service.ListFileUploads(as("carol", "sales"), &types.FileListQuery{Limit: 10})
+	require.NoError(t, err)
+	assert.Empty(t, page.Files)
+	page, err = service.ListFileUploads(as("bob", "finance"), &types.FileListQuery{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, page.Files, 1)
+	assert.Equal(t, "alice", page.Files[0].Uploader)
+	assert.Equal(t, "finance", page.Files[0].Group)
+
+	download, err := service.GetFileUpload(as("bob", "finance"), response.FileID)
+	require.NoError(t, err)
+	download.Body.Close()
+	assert.NoError(t, service.DeleteFileUpload(as("alice"), response.FileID))
+}
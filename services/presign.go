@@ -0,0 +1,258 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// PresignService hands out presigned URLs so clients can transfer files directly
+// to and from storage, and verifies direct uploads once the client reports them complete.
+type PresignService interface {
+	CreateDownloadURL(ctx context.Context, fileID string) (*types.PresignedRequest, error)
+	CreateUploadURL(ctx context.Context, req *types.PresignedUploadRequest) (*types.PresignedRequest, error)
+	CompleteUpload(ctx context.Context, fileID string) (*types.FileUploadResponse, error)
+}
+
+type PresignServiceImpl struct {
+	fileStorage  storage.FileStorage
+	presigner    storage.Presigner
+	repository   metadata.Repository
+	pending      metadata.PendingUploadStore
+	quotas       QuotaService
+	policy       AccessPolicy
+	allowedTypes map[string]bool
+	maxSize      int64
+	expiry       time.Duration
+	tenants      map[string]*tenant.Tenant
+}
+
+// expiredUploadBatch is how many expired uploads one request cleans up.
+const expiredUploadBatch = 100
+
+// NewPresignService creates a PresignService that only hands out download URLs for
+// files policy lets the caller read, and keeps uploads awaiting completion in
+// pending. Objects of uploads that expire before they are completed are deleted from
+// the tenants' storage. If fileStorage does not implement storage.Presigner every call
+// fails with a 501 AppError.
+func NewPresignService(fileStorage storage.FileStorage, repository metadata.Repository, pending metadata.PendingUploadStore, quotas QuotaService, policy AccessPolicy, allowedTypes []string, maxSize int64, expiry time.Duration, tenants []*tenant.Tenant) PresignService {
+	presigner, _ := fileStorage.(storage.Presigner)
+	tenantsByID := make(map[string]*tenant.Tenant, len(tenants))
+	for _, t := range tenants {
+		tenantsByID[t.ID] = t
+	}
+	return &PresignServiceImpl{
+		fileStorage:  fileStorage,
+		presigner:    presigner,
+		repository:   repository,
+		pending:      pending,
+		quotas:       quotas,
+		policy:       policy,
+		allowedTypes: newAllowedTypes(allowedTypes),
+		maxSize:      maxSize,
+		expiry:       expiry,
+		tenants:      tenantsByID,
+	}
+}
+
+func (s *PresignServiceImpl) CreateDownloadURL(ctx context.Context, fileID string) (*types.PresignedRequest, error) {
+	if s.presigner == nil {
+		return nil, errPresignNotSupported()
+	}
+	if fileID == "" {
+		return nil, types.NewAppError("Invalid File ID", "File ID is empty", http.StatusBadRequest, nil)
+	}
+	if _, err := authorizeFile(ctx, s.repository, s.policy, ActionRead, fileID); err != nil {
+		return nil, err
+	}
+
+	presigned, err := s.presigner.PresignDownload(ctx, fileID, s.expiry)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil, errPresignNotSupported()
+	}
+	return presigned, err
+}
+
+func (s *PresignServiceImpl) CreateUploadURL(ctx context.Context, req *types.PresignedUploadRequest) (*types.PresignedRequest, error) {
+	if s.presigner == nil {
+		return nil, errPresignNotSupported()
+	}
+
+	req.Method = strings.ToUpper(req.Method)
+	if req.Method == "" {
+		req.Method = http.MethodPut
+	}
+	var details []types.Details
+	if req.Filename == "" {
+		details = append(details, types.NewDetails("filename", "is required"))
+	}
+	if maxSize := tenant.MaxSize(ctx, s.maxSize); req.Size <= 0 {
+		details = append(details, types.NewDetails("size", "must be greater than zero"))
+	} else if req.Size > maxSize {
+		details = append(details, types.NewDetails("size", fmt.Sprintf("must not exceed %d bytes", maxSize)))
+	}
+	if !allowedTypesFor(ctx, s.allowedTypes)[req.ContentType] {
+		details = append(details, types.NewDetails("contentType", "is not an allowed file type"))
+	}
+	if req.Method != http.MethodPut && req.Method != http.MethodPost {
+		details = append(details, types.NewDetails("method", "must be PUT or POST"))
+	}
+	if len(details) > 0 {
+		return nil, types.NewBadRequestError(details)
+	}
+	if err := s.quotas.Check(ctx, req.Size); err != nil {
+		return nil, err
+	}
+
+	objectKey := storage.NewObjectKey(req.Filename)
+	presigned, err := s.presigner.PresignUpload(ctx, objectKey, req.Method, req.ContentType, req.Size, s.expiry)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil, errPresignNotSupported()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s.deleteExpiredUploads(ctx, now)
+	// Keep the record for twice the URL lifetime so an upload that starts just
+	// before the URL expires can still be completed.
+	if err := s.pending.SavePendingUpload(ctx, &types.PendingUpload{
+		FileID:    objectKey,
+		Filename:  req.Filename,
+		Size:      req.Size,
+		Tenant:    tenant.ID(ctx),
+		Owner:     callerID(ctx),
+		ExpiresAt: now.Add(2 * s.expiry),
+	}); err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Presigned upload created", "filename", req.Filename, "s3_key", objectKey, "method", req.Method)
+	return presigned, nil
+}
+
+// CompleteUpload verifies a direct upload against what was declared when it was
+// presigned. Objects that fail verification are deleted.
+func (s *PresignServiceImpl) CompleteUpload(ctx context.Context, fileID string) (*types.FileUploadResponse, error) {
+	if s.presigner == nil {
+		return nil, errPresignNotSupported()
+	}
+
+	pending, err := s.pending.GetPendingUpload(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	// The object was presigned under the key of the tenant that asked for it, and only
+	// the caller that asked for it may claim it.
+	if time.Now().After(pending.ExpiresAt) || pending.Tenant != tenant.ID(ctx) || pending.Owner != callerID(ctx) {
+		return nil, types.NewNotFoundError(fileID)
+	}
+
+	download, err := s.fileStorage.Download(ctx, fileID)
+	if err != nil {
+		var notFoundErr *types.NotFoundError
+		if errors.As(err, &notFoundErr) {
+			return nil, types.NewAppError("Upload Not Received", fmt.Sprintf("Object %s has not been uploaded yet", fileID), http.StatusConflict, err)
+		}
+		return nil, err
+	}
+
+	head := make([]byte, fileTypeHeaderSize)
+	n, err := io.ReadFull(download.Body, head)
+	download.Body.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	var verifyErr error
+	var contentType string
+	if download.Size != pending.Size {
+		verifyErr = types.NewAppError("File Size Mismatch", fmt.Sprintf("Declared %d bytes but %d were uploaded", pending.Size, download.Size), http.StatusBadRequest, nil)
+	} else {
+		contentType, verifyErr = detectFileType(head[:n], allowedTypesFor(ctx, s.allowedTypes))
+	}
+
+	// Only the request that removes the pending upload acts on the outcome, so a
+	// completion reported twice records the file once.
+	if err := s.pending.DeletePendingUpload(ctx, fileID); err != nil {
+		return nil, err
+	}
+
+	if verifyErr != nil {
+		if err := s.fileStorage.Delete(ctx, fileID); err != nil {
+			slog.ErrorContext(ctx, "Failed to delete rejected direct upload", "error", err, "s3_key", fileID)
+		}
+		return nil, verifyErr
+	}
+	if adopter, ok := s.fileStorage.(storage.Adopter); ok {
+		if err := adopter.Adopt(ctx, fileID); err != nil {
+			discardObject(ctx, s.fileStorage, fileID)
+			return nil, err
+		}
+	}
+
+	fileMetadata := &types.FileMetadata{
+		FileID:      fileID,
+		Filename:    pending.Filename,
+		ContentType: contentType,
+		Size:        download.Size,
+	}
+	if err := recordUpload(ctx, s.repository, s.quotas, s.fileStorage, fileMetadata); err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Direct upload verified", "filename", pending.Filename, "s3_key", fileID)
+	return fileMetadata.UploadResponse(), nil
+}
+
+// deleteExpiredUploads forgets uploads that expired before now without being completed,
+// and deletes any object the client uploaded for them.
+func (s *PresignServiceImpl) deleteExpiredUploads(ctx context.Context, now time.Time) {
+	expired, err := s.pending.ListExpiredPendingUploads(ctx, now, expiredUploadBatch)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to list expired pending uploads", "error", err)
+		return
+	}
+
+	var notFoundErr *types.NotFoundError
+	for _, upload := range expired {
+		// As in CompleteUpload, only the request that removes the pending upload acts on it.
+		if err := s.pending.DeletePendingUpload(ctx, upload.FileID); err != nil {
+			if !errors.As(err, &notFoundErr) {
+				slog.WarnContext(ctx, "Failed to delete expired pending upload", "error", err, "s3_key", upload.FileID)
+			}
+			continue
+		}
+		uploadCtx := tenant.WithTenant(ctx, s.tenant(upload.Tenant))
+		if err := s.fileStorage.Delete(uploadCtx, upload.FileID); err != nil && !errors.As(err, &notFoundErr) {
+			slog.ErrorContext(ctx, "Failed to delete object of expired pending upload", "error", err, "s3_key", upload.FileID, "tenant", upload.Tenant)
+		}
+	}
+}
+
+// tenant returns the tenant with the given ID, or nil if id is "".
+func (s *PresignServiceImpl) tenant(id string) *tenant.Tenant {
+	if id == "" {
+		return nil
+	}
+	if t, ok := s.tenants[id]; ok {
+		return t
+	}
+	// A tenant that is no longer configured is taken to use the shared bucket.
+	return &tenant.Tenant{ID: id}
+}
+
+func errPresignNotSupported() error {
+	return types.NewAppError("Presigned URLs Not Supported", "The configured storage backend does not implement storage.Presigner", http.StatusNotImplemented, nil)
+}
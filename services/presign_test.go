@@ -0,0 +1,132 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// pngHeader is enough of a PNG file for filetype to recognise it.
+var pngHeader = []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52}
+
+func presignUpload(t *testing.T, mockFileStorage *storage.MockFileStorage, service PresignService, size int64) string {
+	t.Helper()
+	mockFileStorage.On("PresignUpload", context.Background(), mock.AnythingOfType("string"), http.MethodPut, "image/png", size, time.Minute).
+		Return(&types.PresignedRequest{Method: http.MethodPut, URL: "https://example.com/upload"}, nil).Once()
+
+	_, err := service.CreateUploadURL(context.Background(), &types.PresignedUploadRequest{Filename: "photo.png", Size: size, ContentType: "image/png"})
+	require.NoError(t, err)
+
+	return mockFileStorage.Calls[len(mockFileStorage.Calls)-1].Arguments.String(1)
+}
+
+func TestCreateUploadURL_Validation(t *testing.T) {
+	mockFileStorage := new(storage.MockFileStorage)
+	repository := metadata.NewMemoryRepository()
+	service := NewPresignService(mockFileStorage, repository, repository, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 1024, time.Minute, nil)
+
+	_, err := service.CreateUploadURL(context.Background(), &types.PresignedUploadRequest{Size: 2048, ContentType: "application/x-msdownload", Method: "PATCH"})
+
+	var badRequestErr *types.BadRequestError
+	require.ErrorAs(t, err, &badRequestErr)
+	assert.Len(t, badRequestErr.Details, 4)
+	mockFileStorage.AssertNotCalled(t, "PresignUpload")
+}
+
+func TestCompleteUpload_Success(t *testing.T) {
+	mockFileStorage := new(storage.MockFileStorage)
+	repository := metadata.NewMemoryRepository()
+	service := NewPresignService(mockFileStorage, repository, repository, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 1024, time.Minute, nil)
+
+	key := presignUpload(t, mockFileStorage, service, int64(len(pngHeader)))
+	assert.Equal(t, ".png", key[len(key)-4:])
+
+	mockFileStorage.On("Download", context.Background(), key).Return(&types.FileDownload{
+		FileID: key,
+		Size:   int64(len(pngHeader)),
+		Body:   io.NopCloser(bytes.NewReader(pngHeader)),
+	}, nil)
+
+	// Only the caller that asked for the URL can complete the upload.
+	_, err := service.CompleteUpload(auth.WithPrincipal(context.Background(), &auth.Principal{ID: "mallory"}), key)
+	var notFoundErr *types.NotFoundError
+	require.ErrorAs(t, err, &notFoundErr)
+
+	// Pending uploads are kept in the metadata store, so any instance can complete them.
+	other := NewPresignService(mockFileStorage, repository, repository, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 1024, time.Minute, nil)
+	response, err := other.CompleteUpload(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, key, response.FileID)
+
+	// A completed upload cannot be completed twice.
+	_, err = service.CompleteUpload(context.Background(), key)
+	assert.ErrorAs(t, err, &notFoundErr)
+
+	mockFileStorage.AssertExpectations(t)
+}
+
+func TestCompleteUpload_SizeMismatchDeletesObject(t *testing.T) {
+	mockFileStorage := new(storage.MockFileStorage)
+	repository := metadata.NewMemoryRepository()
+	service := NewPresignService(mockFileStorage, repository, repository, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 1024, time.Minute, nil)
+
+	key := presignUpload(t, mockFileStorage, service, 100)
+
+	mockFileStorage.On("Download", context.Background(), key).Return(&types.FileDownload{
+		FileID: key,
+		Size:   int64(len(pngHeader)),
+		Body:   io.NopCloser(bytes.NewReader(pngHeader)),
+	}, nil)
+	mockFileStorage.On("Delete", context.Background(), key).Return(nil)
+
+	_, err := service.CompleteUpload(context.Background(), key)
+
+	var appErr *types.AppError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, "File Size Mismatch", appErr.Message)
+	mockFileStorage.AssertExpectations(t)
+}
+
+func TestCreateUploadURL_DeletesExpiredUploads(t *testing.T) {
+	mockFileStorage := new(storage.MockFileStorage)
+	repository := metadata.NewMemoryRepository()
+	acme := &tenant.Tenant{ID: "acme", Bucket: "acme-uploads"}
+	service := NewPresignService(mockFileStorage, repository, repository, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 1024, time.Minute, []*tenant.Tenant{acme})
+
+	expired := &types.PendingUpload{FileID: "abandoned.png", Size: 10, Tenant: "acme", ExpiresAt: time.Now().Add(-time.Minute)}
+	require.NoError(t, repository.SavePendingUpload(context.Background(), expired))
+	inAcme := mock.MatchedBy(func(ctx context.Context) bool { return tenant.FromContext(ctx) == acme })
+	mockFileStorage.On("Delete", inAcme, "abandoned.png").Return(nil).Once()
+
+	presignUpload(t, mockFileStorage, service, 10)
+
+	var notFoundErr *types.NotFoundError
+	_, err := repository.GetPendingUpload(context.Background(), "abandoned.png")
+	assert.ErrorAs(t, err, &notFoundErr)
+	mockFileStorage.AssertExpectations(t)
+}
+
+func TestPresign_UnsupportedStorage(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	repository := metadata.NewMemoryRepository()
+	service := NewPresignService(fileStorage, repository, repository, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 1024, time.Minute, nil)
+
+	_, err = service.CreateDownloadURL(context.Background(), "file.png")
+
+	var appErr *types.AppError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, http.StatusNotImplemented, appErr.HTTPStatus)
+}
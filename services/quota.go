@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// QuotaService keeps track of how much each tenant, and each caller within a tenant,
+// stores, and refuses uploads that would take either past its quota.
+type QuotaService interface {
+	// Check returns a 413 AppError if a file of size bytes, or of unknown size when
+	// size is 0, cannot fit within the caller's quotas. It lets an upload that is
+	// bound to fail be refused before it is transferred; only Charge is atomic.
+	Check(ctx context.Context, size int64) error
+	// Limit returns body cut off at the bytes the caller may still store. Reading past
+	// them fails with a *types.QuotaExceededError, so an upload of unknown size that
+	// cannot fit is stopped while it is transferred rather than refused once stored.
+	Limit(ctx context.Context, body io.Reader) (io.Reader, error)
+	// Charge adds file to the usage of its tenant and owner, or returns a 413
+	// AppError and changes nothing if it does not fit within their quotas.
+	Charge(ctx context.Context, file *types.FileMetadata) error
+	// Release removes a deleted file from the usage of its tenant and owner.
+	Release(ctx context.Context, file *types.FileMetadata)
+	// Usage reports what the caller's tenant, and the caller, store.
+	Usage(ctx context.Context) (*types.UsageReport, error)
+}
+
+type QuotaServiceImpl struct {
+	store  metadata.UsageStore
+	quotas config.QuotaConfig
+}
+
+// NewQuotaService creates a QuotaService that keeps usage in store and applies
+// quotas, or the quotas of the tenant a request is made for.
+func NewQuotaService(store metadata.UsageStore, quotas config.QuotaConfig) QuotaService {
+	return &QuotaServiceImpl{store: store, quotas: quotas}
+}
+
+func (s *QuotaServiceImpl) Check(ctx context.Context, size int64) error {
+	// Any upload of unknown size holds at least one byte.
+	delta := types.Usage{Bytes: max(size, 1), Objects: 1}
+	for _, charge := range s.charges(ctx, tenant.ID(ctx), callerID(ctx)) {
+		usage, err := s.store.GetUsage(ctx, charge.Scope)
+		if err != nil {
+			return err
+		}
+		if usage.Exceeds(delta, charge.Quota) {
+			return errQuotaExceeded(&types.QuotaExceededError{Scope: charge.Scope, Quota: charge.Quota})
+		}
+	}
+	return nil
+}
+
+func (s *QuotaServiceImpl) Limit(ctx context.Context, body io.Reader) (io.Reader, error) {
+	var limited *quotaReader
+	for _, charge := range s.charges(ctx, tenant.ID(ctx), callerID(ctx)) {
+		if charge.Quota.Bytes <= 0 {
+			continue
+		}
+		usage, err := s.store.GetUsage(ctx, charge.Scope)
+		if err != nil {
+			return nil, err
+		}
+		if remaining := max(charge.Quota.Bytes-usage.Bytes, 0); limited == nil || remaining < limited.remaining {
+			limited = &quotaReader{r: body, remaining: remaining, err: &types.QuotaExceededError{Scope: charge.Scope, Quota: charge.Quota}}
+		}
+	}
+	if limited == nil {
+		return body, nil
+	}
+	return limited, nil
+}
+
+func (s *QuotaServiceImpl) Charge(ctx context.Context, file *types.FileMetadata) error {
+	err := s.store.AddUsage(ctx, types.Usage{Bytes: file.Size, Objects: 1}, s.charges(ctx, file.Tenant, file.Uploader))
+	var exceededErr *types.QuotaExceededError
+	if errors.As(err, &exceededErr) {
+		return errQuotaExceeded(exceededErr)
+	}
+	return err
+}
+
+func (s *QuotaServiceImpl) Release(ctx context.Context, file *types.FileMetadata) {
+	if err := s.store.AddUsage(ctx, types.Usage{Bytes: -file.Size, Objects: -1}, s.charges(ctx, file.Tenant, file.Uploader)); err != nil {
+		slog.ErrorContext(ctx, "Failed to release usage of deleted file", "error", err, "s3_key", file.FileID, "size", file.Size)
+	}
+}
+
+func (s *QuotaServiceImpl) Usage(ctx context.Context) (*types.UsageReport, error) {
+	owner := callerID(ctx)
+	charges := s.charges(ctx, tenant.ID(ctx), owner)
+
+	usages := make([]types.QuotaUsage, len(charges))
+	for i, charge := range charges {
+		usage, err := s.store.GetUsage(ctx, charge.Scope)
+		if err != nil {
+			return nil, err
+		}
+		usages[i] = types.QuotaUsage{Usage: usage, Quota: charge.Quota}
+	}
+
+	report := &types.UsageReport{Tenant: tenant.ID(ctx), TenantUsage: usages[0]}
+	if owner != "" {
+		report.Owner = owner
+		report.OwnerUsage = &usages[1]
+	}
+	return report, nil
+}
+
+// charges returns the usage scopes a file of owner in tenantID counts towards, with
+// their quotas: the tenant's, and the owner's unless the file was uploaded anonymously.
+func (s *QuotaServiceImpl) charges(ctx context.Context, tenantID, owner string) []types.UsageCharge {
+	quotas := tenant.Quotas(ctx, s.quotas)
+	charges := []types.UsageCharge{{
+		Scope: types.UsageScope{Tenant: tenantID},
+		Quota: types.Usage{Bytes: quotas.Tenant.MaxBytes, Objects: quotas.Tenant.MaxObjects},
+	}}
+	if owner != "" {
+		charges = append(charges, types.UsageCharge{
+			Scope: types.UsageScope{Tenant: tenantID, Owner: owner},
+			Quota: types.Usage{Bytes: quotas.User.MaxBytes, Objects: quotas.User.MaxObjects},
+		})
+	}
+	return charges
+}
+
+// quotaReader reads up to remaining bytes from r, and fails with err if r holds more.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	err       *types.QuotaExceededError
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.remaining < 0 {
+		return 0, q.err
+	}
+	// Read one byte more than remains, to tell a body that ends exactly at the quota
+	// from one that goes past it.
+	if int64(len(p)) > q.remaining+1 {
+		p = p[:q.remaining+1]
+	}
+	n, err := q.r.Read(p)
+	if int64(n) > q.remaining {
+		n = int(q.remaining)
+		q.remaining = -1
+		return n, q.err
+	}
+	q.remaining -= int64(n)
+	return n, err
+}
+
+func errQuotaExceeded(err *types.QuotaExceededError) error {
+	message := "Storage quota exceeded"
+	if err.Scope.Owner != "" {
+		message = "Your storage quota is exceeded"
+	} else if err.Scope.Tenant != "" {
+		message = fmt.Sprintf("Storage quota of tenant %s exceeded", err.Scope.Tenant)
+	}
+	return types.NewAppError(message, err.Error(), http.StatusRequestEntityTooLarge, err)
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unlimitedQuotas returns a QuotaService that keeps track of usage but limits nothing.
+func unlimitedQuotas() QuotaService {
+	return NewQuotaService(metadata.NewMemoryRepository(), config.QuotaConfig{})
+}
+
+func TestFileUploadService_EnforcesQuotas(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	repository := metadata.NewMemoryRepository()
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	size := int64(len(content))
+	quotas := NewQuotaService(repository, config.QuotaConfig{
+		Tenant: config.Quota{MaxBytes: 3 * size},
+		User:   config.Quota{MaxObjects: 2},
+	})
+	service := NewFileUploadService(fileStorage, repository, quotas, OwnershipPolicy{}, []string{"image/png"}, 2)
+
+	as := func(id, tenantID string) context.Context {
+		ctx := auth.WithPrincipal(context.Background(), &auth.Principal{ID: id})
+		return tenant.WithTenant(ctx, &tenant.Tenant{ID: tenantID})
+	}
+	upload := func(ctx context.Context) (*types.FileUploadResponse, error) {
+		return service.CreateFileUpload(ctx, bytes.NewReader(content), &types.FileUploadRequest{Filename: "photo.png"})
+	}
+	assertExceeded := func(err error, msgAndArgs ...any) {
+		var appErr *types.AppError
+		require.ErrorAs(t, err, &appErr, msgAndArgs...)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, appErr.HTTPStatus)
+	}
+
+	first, err := upload(as("alice", "acme"))
+	require.NoError(t, err)
+	_, err = upload(as("alice", "acme"))
+	require.NoError(t, err)
+	_, err = upload(as("alice", "acme"))
+	assertExceeded(err, "alice may store two files")
+	_, err = upload(as("bob", "acme"))
+	require.NoError(t, err)
+	_, err = upload(as("carol", "acme"))
+	assertExceeded(err, "acme may store three files' worth of bytes")
+	_, err = upload(as("carol", "globex"))
+	assert.NoError(t, err, "other tenants have quotas of their own")
+
+	report, err := quotas.Usage(as("alice", "acme"))
+	require.NoError(t, err)
+	assert.Equal(t, &types.UsageReport{
+		Tenant:      "acme",
+		TenantUsage: types.QuotaUsage{Usage: types.Usage{Bytes: 3 * size, Objects: 3}, Quota: types.Usage{Bytes: 3 * size}},
+		Owner:       "alice",
+		OwnerUsage:  &types.QuotaUsage{Usage: types.Usage{Bytes: 2 * size, Objects: 2}, Quota: types.Usage{Objects: 2}},
+	}, report)
+
+	require.NoError(t, service.DeleteFileUpload(as("alice", "acme"), first.FileID))
+	_, err = upload(as("carol", "acme"))
+	assert.NoError(t, err, "deleting a file frees its share of the quota")
+
+	objects, err := fileStorage.List(as("alice", "acme"), "", 10)
+	require.NoError(t, err)
+	assert.Len(t, objects, 3, "refused uploads are not kept")
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r    io.Reader
+	read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestFileUploadService_CutsOffUploadsPastQuota(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	repository := metadata.NewMemoryRepository()
+	quotas := NewQuotaService(repository, config.QuotaConfig{User: config.Quota{MaxBytes: 4096}})
+	service := NewFileUploadService(fileStorage, repository, quotas, OwnershipPolicy{}, []string{"image/png"}, 1)
+	ctx := auth.WithPrincipal(context.Background(), &auth.Principal{ID: "alice"})
+	require.NoError(t, quotas.Charge(ctx, &types.FileMetadata{FileID: "earlier.png", Uploader: "alice", Size: 3072}))
+
+	// A multipart part declares no size, so only the bytes read show it cannot fit.
+	content := append(append([]byte{}, pngHeader...), make([]byte, 1<<20)...)
+	body := &countingReader{r: bytes.NewReader(content)}
+	_, err = service.CreateFileUpload(ctx, body, &types.FileUploadRequest{Filename: "large.png"})
+	var appErr *types.AppError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, appErr.HTTPStatus)
+	assert.LessOrEqual(t, body.read, int64(1024+1), "the upload stops once the remaining quota is used")
+
+	objects, err := fileStorage.List(ctx, "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+
+	// A file that fits exactly is stored.
+	_, err = service.CreateFileUpload(ctx, bytes.NewReader(content[:1024]), &types.FileUploadRequest{Filename: "small.png"})
+	assert.NoError(t, err)
+}
+
+func TestQuotaService_ChargesAtomically(t *testing.T) {
+	quotas := NewQuotaService(metadata.NewMemoryRepository(), config.QuotaConfig{Tenant: config.Quota{MaxObjects: 5}})
+	ctx := tenant.WithTenant(context.Background(), &tenant.Tenant{ID: "acme"})
+
+	var charged atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if quotas.Charge(ctx, &types.FileMetadata{FileID: fmt.Sprintf("%d.png", i), Tenant: "acme", Size: 10}) == nil {
+				charged.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(5), charged.Load())
+
+	report, err := quotas.Usage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, types.Usage{Bytes: 50, Objects: 5}, report.TenantUsage.Usage)
+	assert.Nil(t, report.OwnerUsage)
+}
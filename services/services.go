@@ -1,65 +1,480 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"log/slog"
-	"mime/multipart"
+	"mime"
 	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/h2non/filetype"
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/metrics"
 	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/tracing"
 	"github.com/pizza-nz/file-uploader/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/pizza-nz/file-uploader/services")
+
 type FileUploadService interface {
-	CreateFileUpload(ctx context.Context, file multipart.File, handler *multipart.FileHeader) (*types.FileUploadResponse, error)
+	CreateFileUpload(ctx context.Context, body io.Reader, req *types.FileUploadRequest) (*types.FileUploadResponse, error)
+	CreateFileUploads(ctx context.Context, files iter.Seq[BatchFile]) []BatchResult
+	GetFileUpload(ctx context.Context, fileID string) (*types.FileDownload, error)
+	DeleteFileUpload(ctx context.Context, fileID string) error
+	ListFileUploads(ctx context.Context, query *types.FileListQuery) (*types.FileListPage, error)
 }
 
 type FileUploadServiceImpl struct {
-	fileStorage  storage.FileStorage
-	allowedTypes map[string]bool
+	fileStorage      storage.FileStorage
+	repository       metadata.Repository
+	quotas           QuotaService
+	policy           AccessPolicy
+	allowedTypes     map[string]bool
+	batchConcurrency int
+}
+
+// NewFileUploadService creates a FileUploadService that lets callers get, list and
+// delete the files policy allows, and store as much as quotas allow. batchConcurrency
+// is how many files of a batch are uploaded at once.
+func NewFileUploadService(fileStorage storage.FileStorage, repository metadata.Repository, quotas QuotaService, policy AccessPolicy, allowedTypes []string, batchConcurrency int) FileUploadService {
+	return &FileUploadServiceImpl{
+		fileStorage:      fileStorage,
+		repository:       repository,
+		quotas:           quotas,
+		policy:           policy,
+		allowedTypes:     newAllowedTypes(allowedTypes),
+		batchConcurrency: max(batchConcurrency, 1),
+	}
+}
+
+// BatchFile is one file of a batch upload. Body is closed once the file has been
+// stored or rejected.
+type BatchFile struct {
+	Filename string
+	Body     io.ReadCloser
+}
+
+// BatchResult is the outcome of uploading one BatchFile. Exactly one of Response and Err is set.
+type BatchResult struct {
+	Response *types.FileUploadResponse
+	Err      error
 }
 
-func NewFileUploadService(fileStorage storage.FileStorage, allowedTypes []string) FileUploadService {
+const (
+	// storageListBatch is how many objects are requested from storage at a time when listing.
+	storageListBatch = 1000
+
+	// maxStorageListScan bounds how many objects one listing request examines, so a
+	// filter that matches few objects returns a short page and a cursor instead of
+	// walking the whole bucket.
+	maxStorageListScan = 10 * storageListBatch
+)
+
+// fileTypeHeaderSize is the number of leading bytes filetype needs to match every type it supports.
+const fileTypeHeaderSize = 261
+
+func newAllowedTypes(allowedTypes []string) map[string]bool {
 	allowedTypesMap := make(map[string]bool)
 	for _, t := range allowedTypes {
 		allowedTypesMap[t] = true
 	}
-	return &FileUploadServiceImpl{fileStorage: fileStorage, allowedTypes: allowedTypesMap}
+	return allowedTypesMap
+}
+
+// allowedTypesFor returns the types the tenant in ctx may upload, or allowedTypes if
+// it has no list of its own.
+func allowedTypesFor(ctx context.Context, allowedTypes map[string]bool) map[string]bool {
+	if tenantTypes := tenant.AllowedTypes(ctx); tenantTypes != nil {
+		return newAllowedTypes(tenantTypes)
+	}
+	return allowedTypes
+}
+
+// detectFileType matches the magic numbers in head and returns the detected MIME type,
+// or an AppError if the type is unknown or not in allowedTypes.
+func detectFileType(head []byte, allowedTypes map[string]bool) (string, error) {
+	// Use filetype.Match to determine the file type based on magic numbers
+	kind, err := filetype.Match(head)
+	if err != nil {
+		return "", fmt.Errorf("failed to match file type: %w", err)
+	}
+
+	// Check if the detected file type is allowed
+	if kind == filetype.Unknown || !allowedTypes[kind.MIME.Value] {
+		return "", types.NewAppError("Invalid File Type", fmt.Sprintf("File type %s is not allowed", kind.MIME.Value), http.StatusBadRequest, nil)
+	}
+
+	return kind.MIME.Value, nil
+}
+
+// recordUpload saves the metadata of an object that has just been written to fileStorage,
+// owned by the caller whose principal is in ctx, and charges it to the caller's quotas.
+// The object is always written first, so if it does not fit within the quotas or its
+// metadata cannot be saved the object is deleted again rather than left in storage with
+// no record of what it is.
+func recordUpload(ctx context.Context, repository metadata.Repository, quotas QuotaService, fileStorage storage.FileStorage, file *types.FileMetadata) error {
+	if err := saveUpload(ctx, repository, quotas, fileStorage, file); err != nil {
+		discardObject(ctx, fileStorage, file.FileID)
+		return err
+	}
+	return nil
+}
+
+// saveUpload records an upload as recordUpload does, but leaves the object in place if
+// it fails, for callers that let the upload be recorded again.
+func saveUpload(ctx context.Context, repository metadata.Repository, quotas QuotaService, fileStorage storage.FileStorage, file *types.FileMetadata) error {
+	setOwner(ctx, file)
+	file.Tenant = tenant.ID(ctx)
+	now := time.Now().UTC()
+	file.StorageBackend = storage.BackendName(fileStorage)
+	file.CreatedAt = now
+	file.UpdatedAt = now
+
+	if err := quotas.Charge(ctx, file); err != nil {
+		return err
+	}
+	if err := repository.Create(ctx, file); err != nil {
+		quotas.Release(ctx, file)
+		return err
+	}
+	return nil
+}
+
+// discardObject deletes an object that has been written but must not be kept.
+func discardObject(ctx context.Context, fileStorage storage.FileStorage, key string) {
+	if err := fileStorage.Delete(ctx, key); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete discarded file", "error", err, "s3_key", key)
+	}
+}
+
+// formatChecksum returns a SHA-256 digest in the form stored in types.FileMetadata.
+func formatChecksum(sum []byte) string {
+	return "sha256:" + hex.EncodeToString(sum)
 }
 
-func (s *FileUploadServiceImpl) CreateFileUpload(ctx context.Context, file multipart.File, handler *multipart.FileHeader) (*types.FileUploadResponse, error) {
-	defer file.Close()
+// uploadReader remembers any error reading an upload as it streams through to storage,
+// so that error can be reported instead of the storage error it causes.
+type uploadReader struct {
+	r       io.Reader
+	readErr error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	metrics.UploadBytesReceived.Add(float64(n))
+	if err != nil && err != io.EOF {
+		u.readErr = err
+	}
+	return n, err
+}
+
+// CreateFileUpload streams body to storage. The file type is checked from the first
+// bytes before the rest of body is read, so a disallowed file, or one that is not the
+// declared content type, is rejected without being transferred. The declared size and
+// checksums are checked by storage, which keeps nothing if they do not match. Size limits
+// are left to the caller, which should wrap body in a reader that fails once the limit
+// is exceeded.
+func (s *FileUploadServiceImpl) CreateFileUpload(ctx context.Context, body io.Reader, req *types.FileUploadRequest) (response *types.FileUploadResponse, err error) {
+	ctx, span := tracer.Start(ctx, "FileUploadService.CreateFileUpload", trace.WithAttributes(attribute.String("file.name", req.Filename)))
+	var contentType string
+	defer func(start time.Time) {
+		var size int64
+		if response != nil {
+			size = response.Size
+			span.SetAttributes(attribute.String("file.id", response.FileID), attribute.Int64("file.size", size))
+		}
+		metrics.ObserveUpload(contentType, size, start, err)
+		tracing.EndSpan(span, err)
+	}(time.Now())
+
+	if err := s.quotas.Check(ctx, req.Size); err != nil {
+		return nil, err
+	}
+	body, err = s.quotas.Limit(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	upload := &uploadReader{r: body}
+	head, contentType, err := s.readFileType(ctx, upload)
+	if err != nil {
+		return nil, err
+	}
+	if !declaredTypeMatches(req.ContentType, contentType) {
+		return nil, types.NewAppError("File Type Mismatch", fmt.Sprintf("Declared %s but detected %s", req.ContentType, contentType), http.StatusBadRequest, nil)
+	}
+
+	meta := types.ObjectMetadata{
+		Size:        req.Size,
+		ContentType: contentType,
+		Checksums:   req.Checksums,
+	}
+	object, err := s.fileStorage.Upload(ctx, storage.NewObjectKey(req.Filename), io.MultiReader(bytes.NewReader(head), upload), meta)
+	if upload.readErr != nil {
+		// The storage backend has discarded the partial object.
+		return nil, readError(upload.readErr, "Upload failed part way through")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fileMetadata := &types.FileMetadata{
+		FileID:      object.Key,
+		Filename:    req.Filename,
+		ContentType: contentType,
+		Size:        object.Size,
+		Checksum:    formatChecksum(object.Checksums.SHA256),
+	}
+	if err := recordUpload(ctx, s.repository, s.quotas, s.fileStorage, fileMetadata); err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "File uploaded successfully", "filename", req.Filename, "s3_key", object.Key, "size", object.Size)
+	response = fileMetadata.UploadResponse()
+	response.MD5 = hex.EncodeToString(object.Checksums.MD5)
+	response.CRC32C = hex.EncodeToString(object.Checksums.CRC32C)
+	return response, nil
+}
+
+// readError describes an error reading an upload: a 413 AppError if it ran past the
+// caller's quota, otherwise a 400 AppError with the given internal message.
+func readError(err error, internal string) error {
+	var exceededErr *types.QuotaExceededError
+	if errors.As(err, &exceededErr) {
+		return errQuotaExceeded(exceededErr)
+	}
+	return types.NewAppError("Error Reading File", internal, http.StatusBadRequest, err)
+}
+
+// readFileType reads the first bytes of upload and detects the file type from them.
+// The span covers both, as a slow client shows up as a slow first read.
+func (s *FileUploadServiceImpl) readFileType(ctx context.Context, upload io.Reader) (_ []byte, contentType string, err error) {
+	_, span := tracer.Start(ctx, "detect file type")
+	defer func() { tracing.EndSpan(span, err) }()
 
 	// Read the first 261 bytes to determine the file type
-	head := make([]byte, 261)
-	if _, err := file.Read(head); err != nil && err != io.EOF {
-		return nil, fmt.Errorf("failed to read file header: %w", err)
+	head := make([]byte, fileTypeHeaderSize)
+	n, err := io.ReadFull(upload, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, "", readError(err, "Failed to read file header")
 	}
+	head = head[:n]
+	span.SetAttributes(attribute.Int("file.header_size", n))
 
-	// Reset the file reader so the full file can be read again later
-	if _, err := file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to reset file reader: %w", err)
+	contentType, err = detectFileType(head, allowedTypesFor(ctx, s.allowedTypes))
+	if err != nil {
+		return nil, "", err
 	}
+	span.SetAttributes(attribute.String("file.content_type", contentType))
+	return head, contentType, nil
+}
 
-	// Use filetype.Match to determine the file type based on magic numbers
-	kind, err := filetype.Match(head)
+// declaredTypeMatches reports whether a client-declared Content-Type agrees with the
+// detected type. Generic or missing declarations match anything.
+func declaredTypeMatches(declared, detected string) bool {
+	if declared == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(declared)
 	if err != nil {
-		return nil, fmt.Errorf("failed to match file type: %w", err)
+		return false
+	}
+	return mediaType == "application/octet-stream" || mediaType == detected
+}
+
+// CreateFileUploads uploads every file as CreateFileUpload would, running up to
+// batchConcurrency uploads at a time. files is only asked for its next file once an
+// upload is free to take it, so a caller reading them from a request holds few at once.
+// Results are returned in the order of files, and one file failing does not stop the
+// others.
+func (s *FileUploadServiceImpl) CreateFileUploads(ctx context.Context, files iter.Seq[BatchFile]) []BatchResult {
+	type job struct {
+		index int
+		file  BatchFile
 	}
+	jobs := make(chan job)
 
-	// Check if the detected file type is allowed
-	if kind == filetype.Unknown || !s.allowedTypes[kind.MIME.Value] {
-		return nil, types.NewAppError("Invalid File Type", fmt.Sprintf("File type %s is not allowed", kind.MIME.Value), http.StatusBadRequest, nil)
+	var mu sync.Mutex
+	var results []BatchResult
+	var wg sync.WaitGroup
+	for range s.batchConcurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				response, err := s.CreateFileUpload(ctx, job.file.Body, &types.FileUploadRequest{Filename: job.file.Filename})
+				job.file.Body.Close()
+
+				mu.Lock()
+				results[job.index] = BatchResult{Response: response, Err: err}
+				mu.Unlock()
+			}
+		}()
 	}
 
-	s3ObjectKey, err := s.fileStorage.Upload(ctx, file, handler)
+	var n int
+	for file := range files {
+		mu.Lock()
+		results = append(results, BatchResult{})
+		mu.Unlock()
+		jobs <- job{index: n, file: file}
+		n++
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func (s *FileUploadServiceImpl) GetFileUpload(ctx context.Context, fileID string) (*types.FileDownload, error) {
+	if fileID == "" {
+		return nil, types.NewAppError("Invalid File ID", "File ID is empty", http.StatusBadRequest, nil)
+	}
+
+	fileMetadata, err := s.authorize(ctx, ActionRead, fileID)
 	if err != nil {
 		return nil, err
 	}
 
-	slog.Info("File uploaded successfully", "filename", handler.Filename, "s3_key", s3ObjectKey)
-	return &types.FileUploadResponse{FileID: s3ObjectKey, Size: handler.Size}, nil
+	download, err := s.fileStorage.Download(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if fileMetadata.Filename != "" {
+		download.Filename = fileMetadata.Filename
+		download.ContentType = fileMetadata.ContentType
+	}
+
+	slog.InfoContext(ctx, "File download started", "s3_key", fileID, "size", download.Size)
+	return download, nil
+}
+
+func (s *FileUploadServiceImpl) DeleteFileUpload(ctx context.Context, fileID string) error {
+	if fileID == "" {
+		return types.NewAppError("Invalid File ID", "File ID is empty", http.StatusBadRequest, nil)
+	}
+
+	fileMetadata, err := s.authorize(ctx, ActionDelete, fileID)
+	if err != nil {
+		return err
+	}
+	if err := s.fileStorage.Delete(ctx, fileID); err != nil {
+		return err
+	}
+	var notFoundErr *types.NotFoundError
+	switch err := s.repository.Delete(ctx, fileID); {
+	case err == nil:
+		// Only files with metadata were charged to a quota.
+		s.quotas.Release(ctx, fileMetadata)
+	case !errors.As(err, &notFoundErr):
+		return err
+	}
+
+	slog.InfoContext(ctx, "File deleted successfully", "s3_key", fileID)
+	return nil
+}
+
+// authorize returns the metadata of the file, after checking the caller whose principal
+// is in ctx may perform action on it. Files stored before metadata was recorded are
+// described only by their file ID.
+func (s *FileUploadServiceImpl) authorize(ctx context.Context, action Action, fileID string) (*types.FileMetadata, error) {
+	return authorizeFile(ctx, s.repository, s.policy, action, fileID)
+}
+
+func authorizeFile(ctx context.Context, repository metadata.Repository, policy AccessPolicy, action Action, fileID string) (*types.FileMetadata, error) {
+	fileMetadata, err := repository.Get(ctx, fileID)
+	var notFoundErr *types.NotFoundError
+	if errors.As(err, &notFoundErr) {
+		// Storage is only searched under the caller's own tenant.
+		fileMetadata = &types.FileMetadata{FileID: fileID, Tenant: tenant.ID(ctx)}
+	} else if err != nil {
+		return nil, err
+	}
+	// Other tenants' files are not hidden by policy but do not exist for the caller.
+	if fileMetadata.Tenant != tenant.ID(ctx) {
+		return nil, types.NewNotFoundError(fileID)
+	}
+	if err := policy.Authorize(ctx, auth.PrincipalFromContext(ctx), action, fileMetadata); err != nil {
+		return nil, err
+	}
+	return fileMetadata, nil
+}
+
+// ListFileUploads lists the files from the metadata store that the caller may see.
+// Without a persistent store the in-memory repository only knows about files uploaded
+// since the last restart, so storage is listed instead, unless the listing is limited
+// to the caller's files; that listing is in file ID order, cannot filter by uploader,
+// and its content types are inferred from file extensions.
+func (s *FileUploadServiceImpl) ListFileUploads(ctx context.Context, query *types.FileListQuery) (*types.FileListPage, error) {
+	query.VisibleTo = s.policy.Visible(ctx, auth.PrincipalFromContext(ctx))
+	query.Tenant = tenant.ID(ctx)
+	// Objects in storage carry no owner, so only the metadata store can tell which the caller may see.
+	if _, inMemory := s.repository.(*metadata.MemoryRepository); !inMemory || query.VisibleTo != nil {
+		return s.repository.List(ctx, query)
+	}
+
+	var details []types.Details
+	if query.Sort != "" {
+		details = append(details, types.NewDetails("sort", "requires a metadata store; files are listed in file ID order"))
+	}
+	if query.Uploader != "" {
+		details = append(details, types.NewDetails("uploader", "requires a metadata store"))
+	}
+	startAfter, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		details = append(details, types.NewDetails("cursor", "is not a cursor returned for this listing"))
+	}
+	if len(details) > 0 {
+		return nil, types.NewBadRequestError(details)
+	}
+
+	// A page that ends exactly at the last object still carries a cursor, which
+	// leads to an empty page.
+	page := &types.FileListPage{Files: make([]types.FileMetadata, 0, query.Limit)}
+	lastKey := string(startAfter)
+	backend := storage.BackendName(s.fileStorage)
+	scanned := 0
+	for object, err := range storage.Objects(ctx, s.fileStorage, lastKey, storageListBatch) {
+		if err != nil {
+			return nil, err
+		}
+		if scanned == maxStorageListScan {
+			page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+			return page, nil
+		}
+		scanned++
+		lastKey = object.Key
+		file := types.FileMetadata{
+			FileID:         object.Key,
+			ContentType:    mime.TypeByExtension(filepath.Ext(object.Key)),
+			Size:           object.Size,
+			StorageBackend: backend,
+			Tenant:         query.Tenant,
+			CreatedAt:      object.LastModified,
+			UpdatedAt:      object.LastModified,
+		}
+		if !query.Matches(&file) {
+			continue
+		}
+		page.Files = append(page.Files, file)
+		if len(page.Files) == query.Limit {
+			page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+			return page, nil
+		}
+	}
+	return page, nil
 }
@@ -3,14 +3,25 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
-	"mime/multipart"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/pizza-nz/file-uploader/metadata"
 	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
 	"github.com/pizza-nz/file-uploader/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 // Mocking multipart.File
@@ -45,21 +56,29 @@ func TestCreateFileUpload_Success(t *testing.T) {
 		0xd2, 0xc2, 0x01, 0xff, 0xd9,
 	}
 	file := &mockMultipartFile{bytes.NewReader(fileContent)}
-	handler := &multipart.FileHeader{
+	req := &types.FileUploadRequest{
 		Filename: "test.jpg",
 		Size:     int64(len(fileContent)),
 	}
 
-	service := NewFileUploadService(mockFileStorage, allowedTypes)
+	service := NewFileUploadService(mockFileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, allowedTypes, 2)
 
-	mockFileStorage.On("Upload", context.Background(), file, handler).Return("some-object-key", nil)
+	var uploaded []byte
+	keyMatches := mock.MatchedBy(func(key string) bool { return strings.HasSuffix(key, ".jpg") })
+	mockFileStorage.On("Upload", mock.Anything, keyMatches, mock.Anything, mock.MatchedBy(func(meta types.ObjectMetadata) bool {
+		return meta.Size == int64(len(fileContent)) && meta.ContentType == "image/jpeg"
+	})).Run(func(args mock.Arguments) {
+		uploaded, _ = io.ReadAll(args.Get(2).(io.Reader))
+	}).Return(&types.ObjectInfo{Key: "some-object-key", Size: int64(len(fileContent))}, nil)
 
-	response, err := service.CreateFileUpload(context.Background(), file, handler)
+	response, err := service.CreateFileUpload(context.Background(), file, req)
 
 	assert.NoError(t, err)
 	assert.NotNil(t, response)
 	assert.Equal(t, "some-object-key", response.FileID)
 	assert.Equal(t, int64(len(fileContent)), response.Size)
+	// The bytes read to detect the file type are still passed on to storage.
+	assert.Equal(t, fileContent, uploaded)
 
 	mockFileStorage.AssertExpectations(t)
 }
@@ -83,16 +102,16 @@ func TestCreateFileUpload_StorageError(t *testing.T) {
 		0xd2, 0xc2, 0x01, 0xff, 0xd9,
 	}
 	file := &mockMultipartFile{bytes.NewReader(fileContent)}
-	handler := &multipart.FileHeader{
+	req := &types.FileUploadRequest{
 		Filename: "test.jpg",
 		Size:     int64(len(fileContent)),
 	}
 
-	service := NewFileUploadService(mockFileStorage, allowedTypes)
+	service := NewFileUploadService(mockFileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, allowedTypes, 2)
 
-	mockFileStorage.On("Upload", context.Background(), file, handler).Return("", errors.New("Storage error"))
+	mockFileStorage.On("Upload", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("Storage error"))
 
-	_, err := service.CreateFileUpload(context.Background(), file, handler)
+	_, err := service.CreateFileUpload(context.Background(), file, req)
 
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "Storage error")
@@ -119,18 +138,324 @@ func TestCreateFileUpload_InvalidFileType(t *testing.T) {
 		0xd2, 0xc2, 0x01, 0xff, 0xd9,
 	}
 	file := &mockMultipartFile{bytes.NewReader(fileContent)}
-	handler := &multipart.FileHeader{
+	req := &types.FileUploadRequest{
 		Filename: "test.jpg",
 		Size:     int64(len(fileContent)),
 	}
 
-	service := NewFileUploadService(mockFileStorage, allowedTypes)
+	service := NewFileUploadService(mockFileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, allowedTypes, 2)
 
-	_, err := service.CreateFileUpload(context.Background(), file, handler)
+	_, err := service.CreateFileUpload(context.Background(), file, req)
 
 	assert.Error(t, err)
 	appErr, ok := err.(*types.AppError)
 	assert.True(t, ok)
 	assert.Equal(t, http.StatusBadRequest, appErr.HTTPStatus)
 	assert.Equal(t, "Invalid File Type", appErr.Message)
-}
\ No newline at end of file
+}
+func TestGetFileUpload_Success(t *testing.T) {
+	mockFileStorage := new(storage.MockFileStorage)
+	service := NewFileUploadService(mockFileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, []string{"image/jpeg"}, 2)
+
+	download := &types.FileDownload{
+		FileID:      "some-object-key.jpg",
+		ContentType: "image/jpeg",
+		Size:        4,
+		Body:        io.NopCloser(strings.NewReader("data")),
+	}
+	mockFileStorage.On("Download", context.Background(), "some-object-key.jpg").Return(download, nil)
+
+	response, err := service.GetFileUpload(context.Background(), "some-object-key.jpg")
+
+	assert.NoError(t, err)
+	assert.Equal(t, download, response)
+
+	mockFileStorage.AssertExpectations(t)
+}
+
+func TestGetFileUpload_NotFound(t *testing.T) {
+	mockFileStorage := new(storage.MockFileStorage)
+	service := NewFileUploadService(mockFileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, []string{"image/jpeg"}, 2)
+
+	mockFileStorage.On("Download", context.Background(), "missing.jpg").Return(nil, types.NewNotFoundError("missing.jpg"))
+
+	_, err := service.GetFileUpload(context.Background(), "missing.jpg")
+
+	var notFoundErr *types.NotFoundError
+	assert.ErrorAs(t, err, &notFoundErr)
+
+	mockFileStorage.AssertExpectations(t)
+}
+
+func TestDeleteFileUpload(t *testing.T) {
+	mockFileStorage := new(storage.MockFileStorage)
+	service := NewFileUploadService(mockFileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, []string{"image/jpeg"}, 2)
+
+	mockFileStorage.On("Delete", context.Background(), "some-object-key.jpg").Return(nil).Once()
+	mockFileStorage.On("Delete", context.Background(), "some-object-key.jpg").Return(types.NewNotFoundError("some-object-key.jpg")).Once()
+
+	assert.NoError(t, service.DeleteFileUpload(context.Background(), "some-object-key.jpg"))
+
+	// A second delete of the same file reports it as missing rather than failing.
+	err := service.DeleteFileUpload(context.Background(), "some-object-key.jpg")
+	var notFoundErr *types.NotFoundError
+	assert.ErrorAs(t, err, &notFoundErr)
+
+	mockFileStorage.AssertExpectations(t)
+}
+
+// failingRepository is a metadata.Repository whose writes always fail.
+type failingRepository struct {
+	*metadata.MemoryRepository
+}
+
+func (f failingRepository) Create(ctx context.Context, file *types.FileMetadata) error {
+	return types.NewDBError("insert failed", errors.New("connection refused"))
+}
+
+func TestCreateFileUpload_RecordsMetadata(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	assert.NoError(t, err)
+	repository := metadata.NewMemoryRepository()
+	service := NewFileUploadService(fileStorage, repository, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 2)
+
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	file := &mockMultipartFile{bytes.NewReader(content)}
+	req := &types.FileUploadRequest{Filename: "holiday photo.png", Size: int64(len(content))}
+
+	response, err := service.CreateFileUpload(context.Background(), file, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "holiday photo.png", response.Filename)
+	assert.Equal(t, "image/png", response.ContentType)
+	assert.True(t, strings.HasPrefix(response.Checksum, "sha256:"))
+
+	stored, err := repository.Get(context.Background(), response.FileID)
+	assert.NoError(t, err)
+	assert.Equal(t, "local", stored.StorageBackend)
+	assert.Equal(t, int64(len(content)), stored.Size)
+
+	download, err := service.GetFileUpload(context.Background(), response.FileID)
+	assert.NoError(t, err)
+	download.Body.Close()
+	assert.Equal(t, "holiday photo.png", download.Filename)
+
+	assert.NoError(t, service.DeleteFileUpload(context.Background(), response.FileID))
+	_, err = repository.Get(context.Background(), response.FileID)
+	var notFoundErr *types.NotFoundError
+	assert.ErrorAs(t, err, &notFoundErr)
+}
+
+func TestCreateFileUpload_MetadataError(t *testing.T) {
+	storageDir := t.TempDir()
+	fileStorage, err := storage.NewLocalStorage(storageDir)
+	assert.NoError(t, err)
+	service := NewFileUploadService(fileStorage, failingRepository{metadata.NewMemoryRepository()}, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 2)
+
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	file := &mockMultipartFile{bytes.NewReader(content)}
+	req := &types.FileUploadRequest{Filename: "photo.png", Size: int64(len(content))}
+
+	_, err = service.CreateFileUpload(context.Background(), file, req)
+	var appErr *types.AppError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, "Database operation failed", appErr.Message)
+
+	// The object written before the failed insert must not be left behind.
+	var stored []string
+	err = filepath.WalkDir(storageDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			stored = append(stored, path)
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestListFileUploads_FromStorage(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	assert.NoError(t, err)
+	service := NewFileUploadService(fileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 2)
+	ctx := context.Background()
+
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	var uploaded []string
+	for i := 0; i < 3; i++ {
+		file := &mockMultipartFile{bytes.NewReader(content)}
+		response, err := service.CreateFileUpload(ctx, file, &types.FileUploadRequest{Filename: "photo.png"})
+		assert.NoError(t, err)
+		uploaded = append(uploaded, response.FileID)
+	}
+
+	var listed []string
+	query := &types.FileListQuery{ContentType: "image/png", Limit: 2}
+	for {
+		page, err := service.ListFileUploads(ctx, query)
+		assert.NoError(t, err)
+		for _, file := range page.Files {
+			listed = append(listed, file.FileID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	assert.ElementsMatch(t, uploaded, listed)
+
+	// Sorting and uploader filters need metadata that storage does not keep.
+	_, err = service.ListFileUploads(ctx, &types.FileListQuery{Sort: types.FileSortSize, Limit: 2})
+	var badRequestErr *types.BadRequestError
+	assert.ErrorAs(t, err, &badRequestErr)
+}
+
+// errReader fails every read, standing in for the part of an upload that must not be read.
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read past the file header")
+}
+
+func TestCreateFileUpload_RejectsBeforeReadingBody(t *testing.T) {
+	mockFileStorage := new(storage.MockFileStorage)
+	service := NewFileUploadService(mockFileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 2)
+
+	// A PDF header, padded to the size needed for type detection.
+	head := append([]byte("%PDF-1.4\n"), make([]byte, fileTypeHeaderSize)...)[:fileTypeHeaderSize]
+	_, err := service.CreateFileUpload(context.Background(), io.MultiReader(bytes.NewReader(head), errReader{}), &types.FileUploadRequest{Filename: "report.pdf"})
+
+	var appErr *types.AppError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, "Invalid File Type", appErr.Message)
+	mockFileStorage.AssertNotCalled(t, "Upload", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCreateFileUploads_PartialSuccess(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	assert.NoError(t, err)
+	repository := metadata.NewMemoryRepository()
+	service := NewFileUploadService(fileStorage, repository, unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 2)
+
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	files := []BatchFile{
+		{Filename: "receipt-1.png", Body: io.NopCloser(bytes.NewReader(content))},
+		{Filename: "notes.txt", Body: io.NopCloser(strings.NewReader("not an image"))},
+		{Filename: "receipt-2.png", Body: io.NopCloser(bytes.NewReader(content))},
+		{Filename: "receipt-3.png", Body: io.NopCloser(bytes.NewReader(content))},
+	}
+
+	results := service.CreateFileUploads(context.Background(), slices.Values(files))
+	assert.Len(t, results, len(files))
+	for i, result := range results {
+		if files[i].Filename == "notes.txt" {
+			var appErr *types.AppError
+			assert.ErrorAs(t, result.Err, &appErr)
+			assert.Equal(t, "Invalid File Type", appErr.Message)
+			assert.Nil(t, result.Response)
+			continue
+		}
+
+		assert.NoError(t, result.Err)
+		assert.Equal(t, files[i].Filename, result.Response.Filename)
+		_, err := repository.Get(context.Background(), result.Response.FileID)
+		assert.NoError(t, err)
+	}
+}
+
+func TestCreateFileUpload_DeclaredValues(t *testing.T) {
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	sum := md5.Sum(content)
+
+	tests := []struct {
+		name            string
+		req             *types.FileUploadRequest
+		expectedMessage string
+	}{
+		{
+			name: "Matching declarations",
+			req:  &types.FileUploadRequest{Filename: "photo.png", ContentType: "image/png", Size: int64(len(content)), Checksums: types.Checksums{MD5: sum[:]}},
+		},
+		{
+			name: "Generic content type",
+			req:  &types.FileUploadRequest{Filename: "photo.png", ContentType: "application/octet-stream"},
+		},
+		{
+			name:            "Content type mismatch",
+			req:             &types.FileUploadRequest{Filename: "photo.png", ContentType: "application/pdf"},
+			expectedMessage: "File Type Mismatch",
+		},
+		{
+			name:            "Size mismatch",
+			req:             &types.FileUploadRequest{Filename: "photo.png", Size: int64(len(content)) + 1},
+			expectedMessage: "Size Mismatch",
+		},
+		{
+			name:            "MD5 mismatch",
+			req:             &types.FileUploadRequest{Filename: "photo.png", Checksums: types.Checksums{MD5: make([]byte, md5.Size)}},
+			expectedMessage: "Checksum Mismatch",
+		},
+		{
+			name:            "CRC32C mismatch",
+			req:             &types.FileUploadRequest{Filename: "photo.png", Checksums: types.Checksums{CRC32C: make([]byte, 4)}},
+			expectedMessage: "Checksum Mismatch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileStorage, err := storage.NewLocalStorage(t.TempDir())
+			assert.NoError(t, err)
+			service := NewFileUploadService(fileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 2)
+
+			response, err := service.CreateFileUpload(context.Background(), bytes.NewReader(content), tt.req)
+			if tt.expectedMessage == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(len(content)), response.Size)
+				assert.Equal(t, hex.EncodeToString(sum[:]), response.MD5)
+				assert.Equal(t, fmt.Sprintf("%08x", crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli))), response.CRC32C)
+				return
+			}
+
+			var appErr *types.AppError
+			assert.ErrorAs(t, err, &appErr)
+			assert.Equal(t, tt.expectedMessage, appErr.Message)
+
+			// A file rejected after it was stored is deleted again.
+			objects, err := fileStorage.List(context.Background(), "", 10)
+			assert.NoError(t, err)
+			assert.Empty(t, objects)
+		})
+	}
+}
+
+func TestFileUploadService_KeepsTenantsApart(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	assert.NoError(t, err)
+	service := NewFileUploadService(fileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), OwnershipPolicy{}, []string{"image/png"}, 2)
+	acme := tenant.WithTenant(context.Background(), &tenant.Tenant{ID: "acme"})
+	globex := tenant.WithTenant(context.Background(), &tenant.Tenant{ID: "globex", AllowedTypes: []string{"application/pdf"}})
+
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	response, err := service.CreateFileUpload(acme, bytes.NewReader(content), &types.FileUploadRequest{Filename: "logo.png"})
+	assert.NoError(t, err)
+
+	var notFoundErr *types.NotFoundError
+	_, err = service.GetFileUpload(globex, response.FileID)
+	assert.ErrorAs(t, err, &notFoundErr)
+	assert.ErrorAs(t, service.DeleteFileUpload(context.Background(), response.FileID), &notFoundErr)
+
+	for ctx, want := range map[context.Context]int{acme: 1, globex: 0, context.Background(): 0} {
+		page, err := service.ListFileUploads(ctx, &types.FileListQuery{Limit: 10})
+		assert.NoError(t, err)
+		assert.Len(t, page.Files, want)
+	}
+
+	// globex only accepts PDFs.
+	_, err = service.CreateFileUpload(globex, bytes.NewReader(content), &types.FileUploadRequest{Filename: "logo.png"})
+	var appErr *types.AppError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, http.StatusBadRequest, appErr.HTTPStatus)
+
+	download, err := service.GetFileUpload(acme, response.FileID)
+	assert.NoError(t, err)
+	download.Body.Close()
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// UploadSession is the persisted state of a resumable upload.
+type UploadSession struct {
+	ID              string                     `json:"id"`
+	FileID          string                     `json:"fileId"`
+	Filename        string                     `json:"filename"`
+	ContentType     string                     `json:"contentType"`
+	Size            int64                      `json:"size"`
+	ChunkSize       int64                      `json:"chunkSize"`
+	StorageUploadID string                     `json:"storageUploadId"`
+	Parts           map[int]types.UploadedPart `json:"parts"`
+	// Completed is set once the parts have been assembled into the object stored
+	// under FileID, which is then kept until the file is recorded or the session discarded.
+	Completed bool      `json:"completed,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// TotalChunks returns how many chunks the upload is split into.
+func (u *UploadSession) TotalChunks() int {
+	return int((u.Size + u.ChunkSize - 1) / u.ChunkSize)
+}
+
+// ChunkLength returns the exact size of chunk index; only the last chunk may be short.
+func (u *UploadSession) ChunkLength(index int) int64 {
+	return min(u.ChunkSize, u.Size-int64(index)*u.ChunkSize)
+}
+
+func (u *UploadSession) clone() *UploadSession {
+	c := *u
+	c.Parts = make(map[int]types.UploadedPart, len(u.Parts))
+	for index, part := range u.Parts {
+		c.Parts[index] = part
+	}
+	return &c
+}
+
+// SessionStore persists upload sessions so an upload can be resumed after a dropped connection.
+type SessionStore interface {
+	Save(ctx context.Context, session *UploadSession) error
+	// Get returns a *types.NotFoundError if the session does not exist.
+	Get(ctx context.Context, id string) (*UploadSession, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// MemorySessionStore keeps sessions in memory. Sessions are lost on restart.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*UploadSession
+}
+
+var _ SessionStore = (*MemorySessionStore)(nil)
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*UploadSession)}
+}
+
+func (m *MemorySessionStore) Save(ctx context.Context, session *UploadSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[session.ID] = session.clone()
+	return nil
+}
+
+func (m *MemorySessionStore) Get(ctx context.Context, id string) (*UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, types.NewNotFoundError(id)
+	}
+	return session.clone(), nil
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// FileSessionStore keeps each session as a JSON file in a directory, so sessions
+// survive a restart of the service.
+type FileSessionStore struct {
+	dir string
+}
+
+var _ SessionStore = (*FileSessionStore)(nil)
+
+// NewFileSessionStore creates a FileSessionStore in dir, creating the directory if needed.
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+// Save atomically replaces the session's file, so a crash mid-write never leaves
+// a corrupt session behind.
+func (f *FileSessionStore) Save(ctx context.Context, session *UploadSession) error {
+	sessionPath, err := f.path(session.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	return writeFileAtomic(sessionPath, data)
+}
+
+func (f *FileSessionStore) Get(ctx context.Context, id string) (*UploadSession, error) {
+	sessionPath, err := f.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(sessionPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, types.NewNotFoundError(id)
+		}
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+
+	var session UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+	return &session, nil
+}
+
+func (f *FileSessionStore) Delete(ctx context.Context, id string) error {
+	sessionPath, err := f.path(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(sessionPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+// path only accepts UUIDs, so a session ID from a URL can never name another file.
+func (f *FileSessionStore) path(id string) (string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", types.NewNotFoundError(id)
+	}
+	return filepath.Join(f.dir, id+".json"), nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place.
+func writeFileAtomic(path string, data []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
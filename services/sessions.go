@@ -0,0 +1,413 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+const (
+	// sessionTTL is how long a client has to finish a resumable upload.
+	sessionTTL = 24 * time.Hour
+
+	// maxChunks is the largest number of parts S3 accepts in one multipart upload.
+	maxChunks = 10000
+)
+
+// UploadSessionService manages resumable uploads that are sent as a series of
+// fixed size chunks, each stored as one part of a storage multipart upload.
+type UploadSessionService interface {
+	CreateSession(ctx context.Context, req *types.UploadSessionRequest) (*types.UploadSessionStatus, error)
+	GetSession(ctx context.Context, sessionID string) (*types.UploadSessionStatus, error)
+	UploadChunk(ctx context.Context, sessionID string, index int, chunkRange types.ChunkRange, body io.Reader) (*types.UploadSessionStatus, error)
+	CompleteSession(ctx context.Context, sessionID string) (*types.FileUploadResponse, error)
+	AbortSession(ctx context.Context, sessionID string) error
+}
+
+type UploadSessionServiceImpl struct {
+	fileStorage  storage.FileStorage
+	uploader     storage.MultipartUploader
+	repository   metadata.Repository
+	quotas       QuotaService
+	store        SessionStore
+	allowedTypes map[string]bool
+	maxSize      int64
+	chunkSize    int64
+	chunkTimeout time.Duration
+
+	// locks serialises read-modify-write cycles on each stored session. A session's
+	// lock is never held while chunk data is transferred to storage, but is held for
+	// the whole of its completion.
+	locks sessionLocks
+}
+
+// NewUploadSessionService creates an UploadSessionService. If fileStorage does not
+// implement storage.MultipartUploader every call fails with a 501 AppError.
+func NewUploadSessionService(fileStorage storage.FileStorage, repository metadata.Repository, quotas QuotaService, store SessionStore, allowedTypes []string, maxSize int64, chunkSize int64, chunkTimeout time.Duration) UploadSessionService {
+	uploader, _ := fileStorage.(storage.MultipartUploader)
+	return &UploadSessionServiceImpl{
+		fileStorage:  fileStorage,
+		uploader:     uploader,
+		repository:   repository,
+		quotas:       quotas,
+		store:        store,
+		allowedTypes: newAllowedTypes(allowedTypes),
+		maxSize:      maxSize,
+		chunkSize:    chunkSize,
+		chunkTimeout: chunkTimeout,
+	}
+}
+
+func (s *UploadSessionServiceImpl) CreateSession(ctx context.Context, req *types.UploadSessionRequest) (*types.UploadSessionStatus, error) {
+	if s.uploader == nil {
+		return nil, errSessionsNotSupported()
+	}
+
+	var details []types.Details
+	if req.Filename == "" {
+		details = append(details, types.NewDetails("filename", "is required"))
+	}
+	if maxSize := tenant.MaxSize(ctx, s.maxSize); req.Size <= 0 {
+		details = append(details, types.NewDetails("size", "must be greater than zero"))
+	} else if req.Size > maxSize {
+		details = append(details, types.NewDetails("size", fmt.Sprintf("must not exceed %d bytes", maxSize)))
+	} else if (req.Size+s.chunkSize-1)/s.chunkSize > maxChunks {
+		details = append(details, types.NewDetails("size", fmt.Sprintf("must not need more than %d chunks", maxChunks)))
+	}
+	if !allowedTypesFor(ctx, s.allowedTypes)[req.ContentType] {
+		details = append(details, types.NewDetails("contentType", "is not an allowed file type"))
+	}
+	if len(details) > 0 {
+		return nil, types.NewBadRequestError(details)
+	}
+	if err := s.quotas.Check(ctx, req.Size); err != nil {
+		return nil, err
+	}
+
+	objectKey := storage.NewObjectKey(req.Filename)
+	uploadID, err := s.uploader.CreateMultipartUpload(ctx, objectKey, req.ContentType)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil, errSessionsNotSupported()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &UploadSession{
+		ID:              uuid.New().String(),
+		FileID:          objectKey,
+		Filename:        req.Filename,
+		ContentType:     req.ContentType,
+		Size:            req.Size,
+		ChunkSize:       s.chunkSize,
+		StorageUploadID: uploadID,
+		Parts:           make(map[int]types.UploadedPart),
+		Tenant:          tenant.ID(ctx),
+		Owner:           callerID(ctx),
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(sessionTTL),
+	}
+	if err := s.store.Save(ctx, session); err != nil {
+		s.abortStorageUpload(ctx, session)
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Upload session created", "sessionID", session.ID, "filename", req.Filename, "s3_key", objectKey, "chunks", session.TotalChunks())
+	return sessionStatus(session), nil
+}
+
+func (s *UploadSessionServiceImpl) GetSession(ctx context.Context, sessionID string) (*types.UploadSessionStatus, error) {
+	if s.uploader == nil {
+		return nil, errSessionsNotSupported()
+	}
+
+	session, err := s.loadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return sessionStatus(session), nil
+}
+
+// UploadChunk stores chunk index, which must lie exactly at chunkRange of an upload
+// of the session's size. The first chunk is checked against the declared content
+// type before anything is stored, so a disallowed file is rejected without waiting
+// for the rest of the upload.
+func (s *UploadSessionServiceImpl) UploadChunk(ctx context.Context, sessionID string, index int, chunkRange types.ChunkRange, body io.Reader) (*types.UploadSessionStatus, error) {
+	if s.uploader == nil {
+		return nil, errSessionsNotSupported()
+	}
+
+	session, err := s.loadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Completed {
+		return nil, errSessionCompleted(sessionID)
+	}
+
+	if index < 0 || index >= session.TotalChunks() {
+		return nil, types.NewBadRequestError([]types.Details{types.NewDetails("chunk", fmt.Sprintf("must be between 0 and %d", session.TotalChunks()-1))})
+	}
+	start := int64(index) * session.ChunkSize
+	end := start + session.ChunkLength(index) - 1
+	var details []types.Details
+	if chunkRange.Start != start {
+		details = append(details, types.NewDetails("offset", fmt.Sprintf("chunk %d must start at offset %d", index, start)))
+	}
+	if chunkRange.End != end {
+		details = append(details, types.NewDetails("Content-Range", fmt.Sprintf("chunk %d must end at byte %d", index, end)))
+	}
+	if chunkRange.Total != session.Size {
+		details = append(details, types.NewDetails("Content-Range", fmt.Sprintf("total must be the upload size of %d bytes", session.Size)))
+	}
+	if len(details) > 0 {
+		return nil, types.NewBadRequestError(details)
+	}
+
+	chunk := make([]byte, session.ChunkLength(index))
+	if _, err := io.ReadFull(body, chunk); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, types.NewAppError("Incomplete Chunk", fmt.Sprintf("Chunk %d must be %d bytes", index, len(chunk)), http.StatusBadRequest, err)
+		}
+		return nil, fmt.Errorf("failed to read chunk %d: %w", index, err)
+	}
+	if n, _ := io.CopyN(io.Discard, body, 1); n > 0 {
+		return nil, types.NewAppError("Chunk Too Large", fmt.Sprintf("Chunk %d must be %d bytes", index, len(chunk)), http.StatusBadRequest, nil)
+	}
+
+	if index == 0 {
+		if err := s.verifyFirstChunk(ctx, session, chunk); err != nil {
+			return nil, err
+		}
+	}
+
+	uploadCtx, cancel := context.WithTimeout(ctx, s.chunkTimeout)
+	defer cancel()
+	part, err := s.uploader.UploadPart(uploadCtx, session.FileID, session.StorageUploadID, int32(index+1), bytes.NewReader(chunk), int64(len(chunk)))
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := s.locks.lock(sessionID)
+	defer unlock()
+	// Reload so parts recorded by concurrent chunk uploads are not overwritten.
+	session, err = s.loadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Completed {
+		return nil, errSessionCompleted(sessionID)
+	}
+	session.Parts[index] = *part
+	if err := s.store.Save(ctx, session); err != nil {
+		return nil, err
+	}
+
+	slog.DebugContext(ctx, "Upload chunk stored", "sessionID", sessionID, "chunk", index, "size", len(chunk))
+	return sessionStatus(session), nil
+}
+
+// CompleteSession assembles the stored chunks into the file and records it. The
+// assembled object is kept with the session until it is recorded, so a completion
+// that fails to record the file, for example because it does not fit within a quota,
+// can be retried.
+func (s *UploadSessionServiceImpl) CompleteSession(ctx context.Context, sessionID string) (*types.FileUploadResponse, error) {
+	if s.uploader == nil {
+		return nil, errSessionsNotSupported()
+	}
+
+	// Concurrent completions of one session wait for each other, so the file is
+	// assembled and recorded once.
+	unlock := s.locks.lock(sessionID)
+	defer unlock()
+	session, err := s.loadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !session.Completed {
+		if received, total := len(session.Parts), session.TotalChunks(); received != total {
+			return nil, types.NewAppError("Upload Incomplete", fmt.Sprintf("Received %d of %d chunks", received, total), http.StatusConflict, nil)
+		}
+
+		parts := make([]types.UploadedPart, 0, len(session.Parts))
+		for _, part := range session.Parts {
+			parts = append(parts, part)
+		}
+		sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+
+		if err := s.uploader.CompleteMultipartUpload(ctx, session.FileID, session.StorageUploadID, parts); err != nil {
+			return nil, err
+		}
+		session.Completed = true
+		if err := s.store.Save(ctx, session); err != nil {
+			s.discardSession(ctx, session)
+			return nil, err
+		}
+	}
+
+	fileMetadata := &types.FileMetadata{
+		FileID:      session.FileID,
+		Filename:    session.Filename,
+		ContentType: session.ContentType,
+		Size:        session.Size,
+	}
+	if err := saveUpload(ctx, s.repository, s.quotas, s.fileStorage, fileMetadata); err != nil {
+		return nil, err
+	}
+	if err := s.store.Delete(ctx, sessionID); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete completed upload session", "error", err, "sessionID", sessionID)
+	}
+
+	slog.InfoContext(ctx, "File uploaded successfully", "filename", session.Filename, "s3_key", session.FileID, "sessionID", sessionID)
+	return fileMetadata.UploadResponse(), nil
+}
+
+func (s *UploadSessionServiceImpl) AbortSession(ctx context.Context, sessionID string) error {
+	if s.uploader == nil {
+		return errSessionsNotSupported()
+	}
+
+	session, err := s.loadSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+
+	s.discardSession(ctx, session)
+	slog.InfoContext(ctx, "Upload session aborted", "sessionID", sessionID)
+	return nil
+}
+
+// loadSession fetches a session started by the caller in ctx, in its tenant, discarding
+// it if it has expired.
+func (s *UploadSessionServiceImpl) loadSession(ctx context.Context, sessionID string) (*UploadSession, error) {
+	session, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Tenant != tenant.ID(ctx) || session.Owner != callerID(ctx) {
+		return nil, types.NewNotFoundError(sessionID)
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		s.discardSession(ctx, session)
+		return nil, types.NewNotFoundError(sessionID)
+	}
+	return session, nil
+}
+
+// verifyFirstChunk detects the file type from the first chunk and discards the
+// whole session if it is not allowed or does not match the declared type.
+func (s *UploadSessionServiceImpl) verifyFirstChunk(ctx context.Context, session *UploadSession, chunk []byte) error {
+	detected, err := detectFileType(chunk[:min(len(chunk), fileTypeHeaderSize)], allowedTypesFor(ctx, s.allowedTypes))
+	if err == nil && detected != session.ContentType {
+		err = types.NewAppError("File Type Mismatch", fmt.Sprintf("Declared %s but detected %s", session.ContentType, detected), http.StatusBadRequest, nil)
+	}
+	if err != nil {
+		s.discardSession(ctx, session)
+		return err
+	}
+	return nil
+}
+
+// discardSession deletes session along with its stored chunks, or the object they were
+// assembled into.
+func (s *UploadSessionServiceImpl) discardSession(ctx context.Context, session *UploadSession) {
+	if session.Completed {
+		discardObject(ctx, s.fileStorage, session.FileID)
+	} else {
+		s.abortStorageUpload(ctx, session)
+	}
+	if err := s.store.Delete(ctx, session.ID); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete upload session", "error", err, "sessionID", session.ID)
+	}
+}
+
+func (s *UploadSessionServiceImpl) abortStorageUpload(ctx context.Context, session *UploadSession) {
+	err := s.uploader.AbortMultipartUpload(ctx, session.FileID, session.StorageUploadID)
+	var notFoundErr *types.NotFoundError
+	if err != nil && !errors.As(err, &notFoundErr) {
+		slog.ErrorContext(ctx, "Failed to abort multipart upload", "error", err, "sessionID", session.ID, "s3_key", session.FileID)
+	}
+}
+
+func sessionStatus(session *UploadSession) *types.UploadSessionStatus {
+	received := make([]int, 0, len(session.Parts))
+	var bytesReceived int64
+	for index, part := range session.Parts {
+		received = append(received, index)
+		bytesReceived += part.Size
+	}
+	sort.Ints(received)
+
+	return &types.UploadSessionStatus{
+		SessionID:      session.ID,
+		FileID:         session.FileID,
+		Filename:       session.Filename,
+		Size:           session.Size,
+		ChunkSize:      session.ChunkSize,
+		TotalChunks:    session.TotalChunks(),
+		ReceivedChunks: received,
+		BytesReceived:  bytesReceived,
+		ExpiresAt:      session.ExpiresAt,
+	}
+}
+
+func errSessionCompleted(sessionID string) error {
+	return types.NewAppError("Upload Already Completed", fmt.Sprintf("Upload session %s has been assembled and takes no more chunks", sessionID), http.StatusConflict, nil)
+}
+
+// sessionLocks holds a mutex for each session in use, so work on one session never
+// waits for another.
+type sessionLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sessionLock
+}
+
+type sessionLock struct {
+	sync.Mutex
+	holders int
+}
+
+// lock locks the session with the given ID and returns the function that unlocks it.
+func (l *sessionLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sessionLock)
+	}
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &sessionLock{}
+		l.locks[id] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		if lock.holders--; lock.holders == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func errSessionsNotSupported() error {
+	return types.NewAppError("Resumable Uploads Not Supported", "The configured storage backend does not implement storage.MultipartUploader", http.StatusNotImplemented, nil)
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSessionService(t *testing.T, store SessionStore) (UploadSessionService, storage.FileStorage) {
+	t.Helper()
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+
+	return NewUploadSessionService(fileStorage, metadata.NewMemoryRepository(), unlimitedQuotas(), store, []string{"image/png"}, 1024, 16, time.Second), fileStorage
+}
+
+// chunkRange returns the range of a chunk of length bytes at start of an upload of total bytes.
+func chunkRange(start, length, total int) types.ChunkRange {
+	return types.ChunkRange{Start: int64(start), End: int64(start + length - 1), Total: int64(total)}
+}
+
+func TestUploadSession_ResumeAndComplete(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	require.NoError(t, err)
+	service, fileStorage := newTestSessionService(t, store)
+	ctx := context.Background()
+
+	content := append(append([]byte{}, pngHeader...), []byte("the rest of the image data")...)
+	status, err := service.CreateSession(ctx, &types.UploadSessionRequest{Filename: "photo.png", Size: int64(len(content)), ContentType: "image/png"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, status.TotalChunks)
+
+	// Chunks can arrive in any order, and resending one replaces it.
+	_, err = service.UploadChunk(ctx, status.SessionID, 2, chunkRange(32, len(content)-32, len(content)), bytes.NewReader(content[32:]))
+	require.NoError(t, err)
+	_, err = service.UploadChunk(ctx, status.SessionID, 0, chunkRange(0, 16, len(content)), bytes.NewReader(content[:16]))
+	require.NoError(t, err)
+	_, err = service.UploadChunk(ctx, status.SessionID, 0, chunkRange(0, 16, len(content)), bytes.NewReader(content[:16]))
+	require.NoError(t, err)
+
+	_, err = service.CompleteSession(ctx, status.SessionID)
+	var appErr *types.AppError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, "Upload Incomplete", appErr.Message)
+
+	status, err = service.GetSession(ctx, status.SessionID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 2}, status.ReceivedChunks)
+	assert.Equal(t, int64(16+len(content)-32), status.BytesReceived)
+
+	_, err = service.UploadChunk(ctx, status.SessionID, 1, chunkRange(16, 16, len(content)), bytes.NewReader(content[16:32]))
+	require.NoError(t, err)
+
+	response, err := service.CompleteSession(ctx, status.SessionID)
+	require.NoError(t, err)
+	assert.Equal(t, status.FileID, response.FileID)
+
+	download, err := fileStorage.Download(ctx, response.FileID)
+	require.NoError(t, err)
+	stored, err := io.ReadAll(download.Body)
+	download.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, stored)
+
+	var notFoundErr *types.NotFoundError
+	_, err = service.GetSession(ctx, status.SessionID)
+	assert.ErrorAs(t, err, &notFoundErr)
+}
+
+func TestUploadSession_OnlyOwnerContinues(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	require.NoError(t, err)
+	service, _ := newTestSessionService(t, store)
+	as := func(id string) context.Context {
+		return auth.WithPrincipal(context.Background(), &auth.Principal{ID: id})
+	}
+
+	content := append(append([]byte{}, pngHeader...), []byte("the rest")...)
+	status, err := service.CreateSession(as("alice"), &types.UploadSessionRequest{Filename: "photo.png", Size: int64(len(content)), ContentType: "image/png"})
+	require.NoError(t, err)
+
+	var notFoundErr *types.NotFoundError
+	_, err = service.GetSession(as("mallory"), status.SessionID)
+	assert.ErrorAs(t, err, &notFoundErr)
+	_, err = service.UploadChunk(as("mallory"), status.SessionID, 0, chunkRange(0, 16, len(content)), bytes.NewReader(content[:16]))
+	assert.ErrorAs(t, err, &notFoundErr)
+	assert.ErrorAs(t, service.AbortSession(as("mallory"), status.SessionID), &notFoundErr)
+
+	_, err = service.GetSession(as("alice"), status.SessionID)
+	assert.NoError(t, err)
+}
+
+func TestUploadSession_RejectsInvalidChunks(t *testing.T) {
+	service, _ := newTestSessionService(t, NewMemorySessionStore())
+	ctx := context.Background()
+
+	status, err := service.CreateSession(ctx, &types.UploadSessionRequest{Filename: "photo.png", Size: 40, ContentType: "image/png"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		index      int
+		chunkRange types.ChunkRange
+		body       []byte
+	}{
+		{name: "Chunk out of range", index: 3, chunkRange: chunkRange(48, 16, 40), body: make([]byte, 16)},
+		{name: "Offset does not match chunk", index: 1, chunkRange: chunkRange(10, 16, 40), body: make([]byte, 16)},
+		{name: "Range shorter than chunk", index: 1, chunkRange: chunkRange(16, 10, 40), body: make([]byte, 16)},
+		{name: "Total does not match session", index: 1, chunkRange: chunkRange(16, 16, 50), body: make([]byte, 16)},
+		{name: "Short chunk", index: 1, chunkRange: chunkRange(16, 16, 40), body: make([]byte, 10)},
+		{name: "Long chunk", index: 1, chunkRange: chunkRange(16, 16, 40), body: make([]byte, 20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.UploadChunk(ctx, status.SessionID, tt.index, tt.chunkRange, bytes.NewReader(tt.body))
+			assert.Error(t, err)
+		})
+	}
+
+	// A first chunk that is not the declared type discards the whole session.
+	_, err = service.UploadChunk(ctx, status.SessionID, 0, chunkRange(0, 16, 40), bytes.NewReader(make([]byte, 16)))
+	var appErr *types.AppError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, "Invalid File Type", appErr.Message)
+
+	var notFoundErr *types.NotFoundError
+	_, err = service.GetSession(ctx, status.SessionID)
+	assert.ErrorAs(t, err, &notFoundErr)
+}
+
+func TestUploadSession_CompletesOnceAndCanBeRetried(t *testing.T) {
+	fileStorage, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	repository := metadata.NewMemoryRepository()
+	quotas := NewQuotaService(repository, config.QuotaConfig{Tenant: config.Quota{MaxObjects: 1}})
+	service := NewUploadSessionService(fileStorage, repository, quotas, NewMemorySessionStore(), []string{"image/png"}, 1024, 16, time.Second)
+	ctx := context.Background()
+
+	content := append(append([]byte{}, pngHeader...), []byte("the rest")...)
+	status, err := service.CreateSession(ctx, &types.UploadSessionRequest{Filename: "photo.png", Size: int64(len(content)), ContentType: "image/png"})
+	require.NoError(t, err)
+	_, err = service.UploadChunk(ctx, status.SessionID, 0, chunkRange(0, 16, len(content)), bytes.NewReader(content[:16]))
+	require.NoError(t, err)
+	_, err = service.UploadChunk(ctx, status.SessionID, 1, chunkRange(16, len(content)-16, len(content)), bytes.NewReader(content[16:]))
+	require.NoError(t, err)
+
+	// A completion that cannot be recorded keeps the session and the assembled file.
+	earlier := &types.FileMetadata{FileID: "earlier.png", Size: 1}
+	require.NoError(t, quotas.Charge(ctx, earlier))
+	_, err = service.CompleteSession(ctx, status.SessionID)
+	var appErr *types.AppError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, appErr.HTTPStatus)
+	_, err = service.UploadChunk(ctx, status.SessionID, 0, chunkRange(0, 16, len(content)), bytes.NewReader(content[:16]))
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, http.StatusConflict, appErr.HTTPStatus, "an assembled upload takes no more chunks")
+
+	// Concurrent retries record the file once.
+	quotas.Release(ctx, earlier)
+	var wg sync.WaitGroup
+	var completed atomic.Int32
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := service.CompleteSession(ctx, status.SessionID); err == nil {
+				completed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), completed.Load())
+
+	download, err := fileStorage.Download(ctx, status.FileID)
+	require.NoError(t, err)
+	stored, err := io.ReadAll(download.Body)
+	download.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, stored)
+}
@@ -0,0 +1,386 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pizza-nz/file-uploader/metadata"
+	"github.com/pizza-nz/file-uploader/storage"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// StatusChecksumMismatch is the tus checksum extension's status for a chunk whose
+// checksum does not match its content.
+const StatusChecksumMismatch = 460
+
+// TusChecksumAlgorithms lists the Upload-Checksum algorithms WriteChunk supports.
+var TusChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// TusUpload is the persisted state of a tus upload. FileID is set once every byte
+// has been received and the file has been stored.
+type TusUpload struct {
+	ID          string            `json:"id"`
+	Length      int64             `json:"length"`
+	Offset      int64             `json:"offset"`
+	Metadata    map[string]string `json:"metadata"`
+	ContentType string            `json:"contentType,omitempty"`
+	FileID      string            `json:"fileId,omitempty"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+}
+
+// TusService implements the storage side of the tus 1.0 resumable upload protocol.
+// Bytes are collected in a local staging file and written through
+// storage.FileStorage once the upload is complete.
+type TusService interface {
+	CreateUpload(ctx context.Context, length int64, metadata map[string]string) (*TusUpload, error)
+	GetUpload(ctx context.Context, id string) (*TusUpload, error)
+	// WriteChunk appends body at offset. If checksumAlgorithm is set the chunk is
+	// only kept when its digest matches checksum.
+	WriteChunk(ctx context.Context, id string, offset int64, body io.Reader, checksumAlgorithm string, checksum []byte) (*TusUpload, error)
+	TerminateUpload(ctx context.Context, id string) error
+}
+
+type TusServiceImpl struct {
+	fileStorage  storage.FileStorage
+	repository   metadata.Repository
+	quotas       QuotaService
+	dir          string
+	allowedTypes map[string]bool
+	maxSize      int64
+
+	mu sync.Mutex
+	// writing holds the IDs of uploads with a chunk in flight; tus does not allow
+	// concurrent writes to the same upload.
+	writing map[string]bool
+}
+
+// NewTusService creates a TusService that stages uploads in dir.
+func NewTusService(fileStorage storage.FileStorage, repository metadata.Repository, quotas QuotaService, dir string, allowedTypes []string, maxSize int64) (TusService, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create tus directory: %w", err)
+	}
+
+	return &TusServiceImpl{
+		fileStorage:  fileStorage,
+		repository:   repository,
+		quotas:       quotas,
+		dir:          dir,
+		allowedTypes: newAllowedTypes(allowedTypes),
+		maxSize:      maxSize,
+		writing:      make(map[string]bool),
+	}, nil
+}
+
+func (s *TusServiceImpl) CreateUpload(ctx context.Context, length int64, metadata map[string]string) (*TusUpload, error) {
+	if length < 0 {
+		return nil, types.NewBadRequestError([]types.Details{types.NewDetails("Upload-Length", "must not be negative")})
+	}
+	if maxSize := tenant.MaxSize(ctx, s.maxSize); length > maxSize {
+		return nil, types.NewAppError("File Too Large", fmt.Sprintf("Upload-Length %d exceeds the maximum of %d bytes", length, maxSize), http.StatusRequestEntityTooLarge, nil)
+	}
+	if err := s.quotas.Check(ctx, length); err != nil {
+		return nil, err
+	}
+
+	s.removeExpired(ctx)
+
+	upload := &TusUpload{
+		ID:        uuid.New().String(),
+		Length:    length,
+		Metadata:  metadata,
+		Tenant:    tenant.ID(ctx),
+		Owner:     callerID(ctx),
+		ExpiresAt: time.Now().Add(sessionTTL),
+	}
+
+	dataFile, err := os.OpenFile(s.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tus data file: %w", err)
+	}
+	dataFile.Close()
+
+	if err := s.save(upload); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return nil, err
+	}
+
+	// An empty upload is complete as soon as it is created.
+	if length == 0 {
+		if err := s.finish(ctx, upload); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.InfoContext(ctx, "Tus upload created", "uploadID", upload.ID, "length", length, "filename", metadata["filename"])
+	return upload, nil
+}
+
+func (s *TusServiceImpl) GetUpload(ctx context.Context, id string) (*TusUpload, error) {
+	return s.load(ctx, id)
+}
+
+func (s *TusServiceImpl) WriteChunk(ctx context.Context, id string, offset int64, body io.Reader, checksumAlgorithm string, checksum []byte) (*TusUpload, error) {
+	var digest hash.Hash
+	if checksumAlgorithm != "" {
+		newHash, ok := TusChecksumAlgorithms[checksumAlgorithm]
+		if !ok {
+			return nil, types.NewBadRequestError([]types.Details{types.NewDetails("Upload-Checksum", fmt.Sprintf("algorithm %s is not supported", checksumAlgorithm))})
+		}
+		digest = newHash()
+	}
+
+	if !s.lock(id) {
+		return nil, types.NewAppError("Upload Locked", fmt.Sprintf("Tus upload %s already has a chunk in progress", id), http.StatusConflict, nil)
+	}
+	defer s.unlock(id)
+
+	upload, err := s.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.FileID != "" || offset != upload.Offset {
+		return nil, types.NewAppError("Offset Mismatch", fmt.Sprintf("Upload-Offset %d does not match current offset %d", offset, upload.Offset), http.StatusConflict, nil)
+	}
+
+	dataFile, err := os.OpenFile(s.dataPath(id), os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tus data file: %w", err)
+	}
+	defer dataFile.Close()
+	if _, err := dataFile.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek tus data file: %w", err)
+	}
+
+	// Read one byte past the remaining length to detect a chunk that overruns the upload.
+	var writer io.Writer = dataFile
+	if digest != nil {
+		writer = io.MultiWriter(dataFile, digest)
+	}
+	written, copyErr := io.Copy(writer, io.LimitReader(body, upload.Length-offset+1))
+
+	var rejectErr error
+	switch {
+	case offset+written > upload.Length:
+		rejectErr = types.NewAppError("Chunk Too Large", fmt.Sprintf("Chunk would exceed Upload-Length %d", upload.Length), http.StatusBadRequest, nil)
+	case digest != nil && copyErr != nil:
+		rejectErr = fmt.Errorf("failed to read checksummed chunk: %w", copyErr)
+	case digest != nil && subtle.ConstantTimeCompare(digest.Sum(nil), checksum) != 1:
+		rejectErr = types.NewAppError("Checksum Mismatch", fmt.Sprintf("Upload-Checksum did not match chunk at offset %d", offset), StatusChecksumMismatch, nil)
+	}
+	if rejectErr != nil {
+		// Discard everything written by this chunk.
+		if err := dataFile.Truncate(offset); err != nil {
+			return nil, fmt.Errorf("failed to discard rejected chunk: %w", err)
+		}
+		return nil, rejectErr
+	}
+
+	// Without a checksum, keep whatever arrived before a dropped connection so the
+	// client can resume from the new offset.
+	if err := dataFile.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to flush tus data file: %w", err)
+	}
+	upload.Offset += written
+	if err := s.save(upload); err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", copyErr)
+	}
+
+	if err := s.checkFileType(ctx, upload); err != nil {
+		return nil, err
+	}
+	if upload.Offset == upload.Length {
+		if err := s.finish(ctx, upload); err != nil {
+			return nil, err
+		}
+	}
+
+	return upload, nil
+}
+
+func (s *TusServiceImpl) TerminateUpload(ctx context.Context, id string) error {
+	if !s.lock(id) {
+		return types.NewAppError("Upload Locked", fmt.Sprintf("Tus upload %s already has a chunk in progress", id), http.StatusConflict, nil)
+	}
+	defer s.unlock(id)
+
+	if _, err := s.load(ctx, id); err != nil {
+		return err
+	}
+
+	s.remove(id)
+	slog.InfoContext(ctx, "Tus upload terminated", "uploadID", id)
+	return nil
+}
+
+// checkFileType rejects the upload as soon as enough bytes have arrived to detect its type.
+func (s *TusServiceImpl) checkFileType(ctx context.Context, upload *TusUpload) error {
+	if upload.ContentType != "" || (upload.Offset < fileTypeHeaderSize && upload.Offset < upload.Length) {
+		return nil
+	}
+
+	head := make([]byte, fileTypeHeaderSize)
+	dataFile, err := os.Open(s.dataPath(upload.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open tus data file: %w", err)
+	}
+	n, err := io.ReadFull(dataFile, head)
+	dataFile.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	detected, err := detectFileType(head[:n], allowedTypesFor(ctx, s.allowedTypes))
+	if err != nil {
+		s.remove(upload.ID)
+		return err
+	}
+
+	upload.ContentType = detected
+	return s.save(upload)
+}
+
+// finish writes the completed upload through to storage and removes the staged bytes.
+func (s *TusServiceImpl) finish(ctx context.Context, upload *TusUpload) error {
+	if err := s.checkFileType(ctx, upload); err != nil {
+		return err
+	}
+
+	dataFile, err := os.Open(s.dataPath(upload.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open tus data file: %w", err)
+	}
+	defer dataFile.Close()
+
+	filename := upload.Metadata["filename"]
+	meta := types.ObjectMetadata{Size: upload.Length, ContentType: upload.ContentType}
+	object, err := s.fileStorage.Upload(ctx, storage.NewObjectKey(filename), dataFile, meta)
+	if err != nil {
+		return err
+	}
+
+	fileMetadata := &types.FileMetadata{
+		FileID:      object.Key,
+		Filename:    filename,
+		ContentType: upload.ContentType,
+		Size:        object.Size,
+		Checksum:    formatChecksum(object.Checksums.SHA256),
+	}
+	if err := recordUpload(ctx, s.repository, s.quotas, s.fileStorage, fileMetadata); err != nil {
+		return err
+	}
+
+	upload.FileID = object.Key
+	if err := s.save(upload); err != nil {
+		return err
+	}
+	os.Remove(s.dataPath(upload.ID))
+
+	slog.InfoContext(ctx, "File uploaded successfully", "filename", filename, "s3_key", object.Key, "uploadID", upload.ID)
+	return nil
+}
+
+func (s *TusServiceImpl) load(ctx context.Context, id string) (*TusUpload, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, types.NewNotFoundError(id)
+	}
+
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, types.NewNotFoundError(id)
+		}
+		return nil, fmt.Errorf("failed to read tus upload: %w", err)
+	}
+
+	var upload TusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("failed to decode tus upload: %w", err)
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		s.remove(id)
+		return nil, types.NewNotFoundError(id)
+	}
+	if upload.Tenant != tenant.ID(ctx) || upload.Owner != callerID(ctx) {
+		return nil, types.NewNotFoundError(id)
+	}
+	return &upload, nil
+}
+
+func (s *TusServiceImpl) save(upload *TusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to encode tus upload: %w", err)
+	}
+	return writeFileAtomic(s.infoPath(upload.ID), data)
+}
+
+func (s *TusServiceImpl) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// removeExpired deletes the staged files of uploads that were abandoned.
+func (s *TusServiceImpl) removeExpired(ctx context.Context) {
+	infoFiles, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, infoFile := range infoFiles {
+		id := filepath.Base(infoFile[:len(infoFile)-len(".json")])
+		if s.lock(id) {
+			// load removes the upload if it has expired.
+			s.load(ctx, id)
+			s.unlock(id)
+		}
+	}
+}
+
+func (s *TusServiceImpl) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writing[id] {
+		return false
+	}
+	s.writing[id] = true
+	return true
+}
+
+func (s *TusServiceImpl) unlock(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.writing, id)
+}
+
+func (s *TusServiceImpl) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *TusServiceImpl) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
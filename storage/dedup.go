@@ -0,0 +1,371 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// blobKeyPrefix is where DedupStorage keeps blobs in the storage it wraps.
+const blobKeyPrefix = "blobs/"
+
+// BlobDeleteLease is how long a BlobIndex holds back new references to a blob whose
+// last reference has been removed, while the blob is deleted. An index gives up on a
+// deletion that has not finished by then, so deleteBlob is given half of it.
+const BlobDeleteLease = time.Minute
+
+// ErrBlobDeleting is returned by BlobIndex.AddBlobRef while the blob is being deleted.
+var ErrBlobDeleting = errors.New("blob is being deleted")
+
+// blobDeleteWait is how long Upload waits between attempts to refer to a blob that is
+// being deleted.
+const blobDeleteWait = 100 * time.Millisecond
+
+// BlobIndex records which content-addressed blob each object key refers to, and keeps
+// count of the keys that refer to each blob. Counts change atomically, and a blob
+// gains no reference while it is deleted, so instances sharing an index never delete
+// a blob while a key refers to it.
+type BlobIndex interface {
+	// AddBlobRef records ref and reports whether its blob still has to be stored: no
+	// other key refers to it, or the upload that first did has not stored it yet. The
+	// blob is not deleted while ref exists. It fails if ref.Key already refers to a blob,
+	// and returns ErrBlobDeleting, recording nothing, while the blob is being deleted.
+	AddBlobRef(ctx context.Context, ref *types.BlobRef) (bool, error)
+	// MarkBlobStored records that the blob with the given hash has been stored.
+	MarkBlobStored(ctx context.Context, hash string) error
+	// GetBlobRef returns a *types.NotFoundError if key does not refer to a blob.
+	GetBlobRef(ctx context.Context, key string) (*types.BlobRef, error)
+	// RemoveBlobRef forgets what key refers to and returns the removed reference. If no
+	// other key refers to its blob, deleteBlob is called with it once the removal is
+	// committed, and no new reference to the blob can be added until it returns or
+	// BlobDeleteLease passes. It returns a *types.NotFoundError if key does not refer
+	// to a blob.
+	RemoveBlobRef(ctx context.Context, key string, deleteBlob func(ctx context.Context, ref *types.BlobRef)) (*types.BlobRef, error)
+	// ListBlobRefs returns up to limit references in ascending key order, starting after
+	// the key startAfter.
+	ListBlobRefs(ctx context.Context, startAfter string, limit int) ([]types.BlobRef, error)
+}
+
+// DedupStorage stores identical content once. Each upload is written to the wrapped
+// storage as a blob keyed by its SHA-256, unless that blob is already there, and the
+// index records which blob the upload's key refers to. A blob is deleted along with
+// the last key that refers to it.
+//
+// Uploads are spooled to a temporary file, as the hash is needed before anything is
+// written. Presigned and multipart uploads are written to the wrapped storage under
+// their own key, and taken in as a blob once they are complete. Objects written to the
+// wrapped storage before deduplication was enabled are still downloaded and deleted by
+// their own key, but are not listed.
+type DedupStorage struct {
+	inner     FileStorage
+	presigner Presigner
+	uploader  MultipartUploader
+	index     BlobIndex
+	tempDir   string
+}
+
+var (
+	_ FileStorage       = (*DedupStorage)(nil)
+	_ Presigner         = (*DedupStorage)(nil)
+	_ MultipartUploader = (*DedupStorage)(nil)
+	_ Adopter           = (*DedupStorage)(nil)
+	_ HealthChecker     = (*DedupStorage)(nil)
+)
+
+// NewDedupStorage wraps inner, recording references in index and spooling uploads to
+// tempDir, which is created if needed. Presigned and multipart uploads fail with an
+// error wrapping errors.ErrUnsupported unless inner supports them.
+func NewDedupStorage(inner FileStorage, index BlobIndex, tempDir string) (*DedupStorage, error) {
+	if err := os.MkdirAll(tempDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create dedup spool directory: %w", err)
+	}
+	presigner, _ := inner.(Presigner)
+	uploader, _ := inner.(MultipartUploader)
+	return &DedupStorage{inner: inner, presigner: presigner, uploader: uploader, index: index, tempDir: tempDir}, nil
+}
+
+func blobKey(hash string) string {
+	return blobKeyPrefix + hash
+}
+
+// blobHash returns the hash of the blob ref refers to. The index is shared by every
+// tenant, so it records keys and hashes under the prefix of the tenant in ctx, and
+// each tenant's blobs are stored and counted apart from every other tenant's.
+func blobHash(ctx context.Context, ref *types.BlobRef) string {
+	return strings.TrimPrefix(ref.Hash, tenantKey(ctx, ""))
+}
+
+func (d *DedupStorage) Upload(ctx context.Context, key string, body io.Reader, meta types.ObjectMetadata) (*types.ObjectInfo, error) {
+	spool, err := os.CreateTemp(d.tempDir, "dedup-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	object := newObjectReader(body)
+	if _, err := io.Copy(spool, object); err != nil {
+		return nil, fmt.Errorf("failed to spool upload for %s: %w", key, err)
+	}
+	if err := object.verify(meta); err != nil {
+		return nil, err
+	}
+	checksums := object.checksums()
+	hash := hex.EncodeToString(checksums.SHA256)
+	indexHash := tenantKey(ctx, hash)
+
+	// The reference is recorded before the blob is written, so the blob cannot be
+	// deleted along with another key's reference while it is being written.
+	now := time.Now().UTC()
+	ref := &types.BlobRef{Key: tenantKey(ctx, key), Hash: indexHash, Size: object.size, ContentType: meta.ContentType, CreatedAt: now}
+	store, err := d.addBlobRef(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if store {
+		if err := d.storeBlob(ctx, hash, spool, types.ObjectMetadata{Size: object.size, ContentType: meta.ContentType, Checksums: checksums}); err != nil {
+			if _, removeErr := d.index.RemoveBlobRef(ctx, ref.Key, d.deleteBlob); removeErr != nil {
+				slog.ErrorContext(ctx, "Failed to remove reference to unstored blob", "key", key, "hash", hash, "error", removeErr)
+			}
+			return nil, err
+		}
+	} else {
+		slog.DebugContext(ctx, "Upload matches a stored blob", "key", key, "hash", hash)
+	}
+
+	return &types.ObjectInfo{
+		Key:          key,
+		Size:         object.size,
+		LastModified: now,
+		ContentType:  meta.ContentType,
+		ETag:         hex.EncodeToString(checksums.MD5),
+		Checksums:    checksums,
+	}, nil
+}
+
+// addBlobRef adds ref to the index, waiting for a deletion of its blob to finish so the
+// upload is not stored just before the deletion removes it. It gives up after a few
+// attempts, as a deletion that has stalled holds the blob for BlobDeleteLease.
+func (d *DedupStorage) addBlobRef(ctx context.Context, ref *types.BlobRef) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		store, err := d.index.AddBlobRef(ctx, ref)
+		if !errors.Is(err, ErrBlobDeleting) || attempt == 10 {
+			return store, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(blobDeleteWait):
+		}
+	}
+}
+
+// storeBlob writes the spooled upload as the blob with the given hash. A blob is only
+// stored by uploads of identical content, so uploads that store it at once do no harm.
+func (d *DedupStorage) storeBlob(ctx context.Context, hash string, spool *os.File, meta types.ObjectMetadata) error {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	if _, err := d.inner.Upload(ctx, blobKey(hash), spool, meta); err != nil {
+		return err
+	}
+	// Until it is marked, later uploads store the blob again, which costs a transfer
+	// but loses nothing.
+	if err := d.index.MarkBlobStored(ctx, tenantKey(ctx, hash)); err != nil {
+		slog.WarnContext(ctx, "Failed to mark blob as stored", "hash", hash, "error", err)
+	}
+	return nil
+}
+
+func (d *DedupStorage) Download(ctx context.Context, key string) (*types.FileDownload, error) {
+	ref, err := d.index.GetBlobRef(ctx, tenantKey(ctx, key))
+	var notFoundErr *types.NotFoundError
+	if errors.As(err, &notFoundErr) {
+		return d.inner.Download(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	download, err := d.inner.Download(ctx, blobKey(blobHash(ctx, ref)))
+	if errors.As(err, &notFoundErr) {
+		return nil, types.NewNotFoundError(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	download.FileID = key
+	download.ContentType = ref.ContentType
+	if download.ContentType == "" {
+		download.ContentType = mime.TypeByExtension(filepath.Ext(key))
+	}
+	return download, nil
+}
+
+func (d *DedupStorage) Delete(ctx context.Context, key string) error {
+	ref, err := d.index.GetBlobRef(ctx, tenantKey(ctx, key))
+	var notFoundErr *types.NotFoundError
+	if errors.As(err, &notFoundErr) {
+		return d.inner.Delete(ctx, key)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = d.index.RemoveBlobRef(ctx, ref.Key, d.deleteBlob)
+	return err
+}
+
+// deleteBlob removes the blob ref referred to, once nothing refers to it. A failure
+// only leaks storage, so it is logged rather than returned.
+func (d *DedupStorage) deleteBlob(ctx context.Context, ref *types.BlobRef) {
+	hash := blobHash(ctx, ref)
+	var notFoundErr *types.NotFoundError
+	if err := d.inner.Delete(ctx, blobKey(hash)); err != nil && !errors.As(err, &notFoundErr) {
+		slog.ErrorContext(ctx, "Failed to delete unreferenced blob", "hash", hash, "error", err)
+	}
+}
+
+// PresignDownload presigns a download of the blob key refers to, or of key itself if
+// it was stored before deduplication was enabled.
+func (d *DedupStorage) PresignDownload(ctx context.Context, key string, expiry time.Duration) (*types.PresignedRequest, error) {
+	if d.presigner == nil {
+		return nil, fmt.Errorf("storage does not presign downloads: %w", errors.ErrUnsupported)
+	}
+	ref, err := d.index.GetBlobRef(ctx, tenantKey(ctx, key))
+	var notFoundErr *types.NotFoundError
+	if errors.As(err, &notFoundErr) {
+		return d.presigner.PresignDownload(ctx, key, expiry)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	presigned, err := d.presigner.PresignDownload(ctx, blobKey(blobHash(ctx, ref)), expiry)
+	if err != nil {
+		return nil, err
+	}
+	presigned.FileID = key
+	return presigned, nil
+}
+
+// PresignUpload presigns an upload to key in the wrapped storage. The object is only
+// deduplicated once it is adopted.
+func (d *DedupStorage) PresignUpload(ctx context.Context, key string, method string, contentType string, size int64, expiry time.Duration) (*types.PresignedRequest, error) {
+	if d.presigner == nil {
+		return nil, fmt.Errorf("storage does not presign uploads: %w", errors.ErrUnsupported)
+	}
+	return d.presigner.PresignUpload(ctx, key, method, contentType, size, expiry)
+}
+
+func (d *DedupStorage) CreateMultipartUpload(ctx context.Context, key string, contentType string) (string, error) {
+	if d.uploader == nil {
+		return "", fmt.Errorf("storage does not support multipart uploads: %w", errors.ErrUnsupported)
+	}
+	return d.uploader.CreateMultipartUpload(ctx, key, contentType)
+}
+
+func (d *DedupStorage) UploadPart(ctx context.Context, key string, uploadID string, partNumber int32, body io.ReadSeeker, size int64) (*types.UploadedPart, error) {
+	if d.uploader == nil {
+		return nil, fmt.Errorf("storage does not support multipart uploads: %w", errors.ErrUnsupported)
+	}
+	return d.uploader.UploadPart(ctx, key, uploadID, partNumber, body, size)
+}
+
+// CompleteMultipartUpload assembles the parts under key in the wrapped storage and
+// then adopts the object, so it is stored as a blob like any other upload.
+func (d *DedupStorage) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []types.UploadedPart) error {
+	if d.uploader == nil {
+		return fmt.Errorf("storage does not support multipart uploads: %w", errors.ErrUnsupported)
+	}
+	if err := d.uploader.CompleteMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		return err
+	}
+	if err := d.Adopt(ctx, key); err != nil {
+		d.deleteObject(ctx, key)
+		return err
+	}
+	return nil
+}
+
+func (d *DedupStorage) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	if d.uploader == nil {
+		return fmt.Errorf("storage does not support multipart uploads: %w", errors.ErrUnsupported)
+	}
+	return d.uploader.AbortMultipartUpload(ctx, key, uploadID)
+}
+
+// Adopt hashes the object written directly under key in the wrapped storage, records
+// it as a reference to the blob with that hash, storing the blob if it is new, and
+// deletes the object. It returns a *types.NotFoundError if there is no such object.
+func (d *DedupStorage) Adopt(ctx context.Context, key string) error {
+	download, err := d.inner.Download(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer download.Body.Close()
+
+	if _, err := d.Upload(ctx, key, download.Body, types.ObjectMetadata{Size: download.Size, ContentType: download.ContentType}); err != nil {
+		return err
+	}
+	d.deleteObject(ctx, key)
+	return nil
+}
+
+// deleteObject deletes what is stored under key itself in the wrapped storage. A
+// failure only leaks storage, so it is logged rather than returned.
+func (d *DedupStorage) deleteObject(ctx context.Context, key string) {
+	var notFoundErr *types.NotFoundError
+	if err := d.inner.Delete(ctx, key); err != nil && !errors.As(err, &notFoundErr) {
+		slog.ErrorContext(ctx, "Failed to delete adopted object", "key", key, "error", err)
+	}
+}
+
+// List pages through the index, skipping the references of other tenants.
+func (d *DedupStorage) List(ctx context.Context, startAfter string, limit int) ([]types.ObjectInfo, error) {
+	objects := make([]types.ObjectInfo, 0, limit)
+	after := tenantKey(ctx, startAfter)
+	for len(objects) < limit {
+		refs, err := d.index.ListBlobRefs(ctx, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			key, ok := listedKey(ctx, ref.Key)
+			if !ok && tenant.FromContext(ctx) != nil {
+				// Every later key sorts after the tenant's prefix.
+				return objects, nil
+			}
+			if ok && len(objects) < limit {
+				objects = append(objects, types.ObjectInfo{Key: key, Size: ref.Size, LastModified: ref.CreatedAt})
+			}
+		}
+		if len(refs) < limit {
+			break
+		}
+		after = refs[len(refs)-1].Key
+	}
+	return objects, nil
+}
+
+// CheckHealth checks the wrapped storage, if it can be checked. The index is checked
+// along with the rest of the metadata store.
+func (d *DedupStorage) CheckHealth(ctx context.Context) error {
+	if checker, ok := d.inner.(HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryBlobIndex is a BlobIndex for tests.
+type memoryBlobIndex struct {
+	mu     sync.Mutex
+	refs   map[string]types.BlobRef
+	stored map[string]bool
+}
+
+func newMemoryBlobIndex() *memoryBlobIndex {
+	return &memoryBlobIndex{refs: make(map[string]types.BlobRef), stored: make(map[string]bool)}
+}
+
+func (m *memoryBlobIndex) count(hash string) int {
+	refs := 0
+	for _, ref := range m.refs {
+		if ref.Hash == hash {
+			refs++
+		}
+	}
+	return refs
+}
+
+func (m *memoryBlobIndex) AddBlobRef(ctx context.Context, ref *types.BlobRef) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.refs[ref.Key]; ok {
+		return false, fmt.Errorf("blob reference for %s already exists", ref.Key)
+	}
+	m.refs[ref.Key] = *ref
+	return !m.stored[ref.Hash], nil
+}
+
+func (m *memoryBlobIndex) MarkBlobStored(ctx context.Context, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.count(hash) > 0 {
+		m.stored[hash] = true
+	}
+	return nil
+}
+
+func (m *memoryBlobIndex) GetBlobRef(ctx context.Context, key string) (*types.BlobRef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ref, ok := m.refs[key]
+	if !ok {
+		return nil, types.NewNotFoundError(key)
+	}
+	return &ref, nil
+}
+
+func (m *memoryBlobIndex) RemoveBlobRef(ctx context.Context, key string, deleteBlob func(ctx context.Context, ref *types.BlobRef)) (*types.BlobRef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ref, ok := m.refs[key]
+	if !ok {
+		return nil, types.NewNotFoundError(key)
+	}
+	delete(m.refs, key)
+	if m.count(ref.Hash) == 0 {
+		deleteBlob(ctx, &ref)
+		delete(m.stored, ref.Hash)
+	}
+	return &ref, nil
+}
+
+func (m *memoryBlobIndex) ListBlobRefs(ctx context.Context, startAfter string, limit int) ([]types.BlobRef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var refs []types.BlobRef
+	for _, ref := range m.refs {
+		if ref.Key > startAfter {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Key < refs[j].Key })
+	return refs[:min(limit, len(refs))], nil
+}
+
+func newTestDedupStorage(t *testing.T) (*DedupStorage, FileStorage) {
+	t.Helper()
+	inner, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	dedup, err := NewDedupStorage(inner, newMemoryBlobIndex(), filepath.Join(t.TempDir(), "spool"))
+	require.NoError(t, err)
+	return dedup, inner
+}
+
+func readObject(t *testing.T, ctx context.Context, fileStorage FileStorage, key string) string {
+	t.Helper()
+	download, err := fileStorage.Download(ctx, key)
+	require.NoError(t, err)
+	defer download.Body.Close()
+	content, err := io.ReadAll(download.Body)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestDedupStorage_StoresIdenticalContentOnce(t *testing.T) {
+	ctx := context.Background()
+	dedup, inner := newTestDedupStorage(t)
+
+	first, err := dedup.Upload(ctx, "first.pdf", strings.NewReader("brochure"), types.ObjectMetadata{ContentType: "application/pdf"})
+	require.NoError(t, err)
+	second, err := dedup.Upload(ctx, "second.pdf", strings.NewReader("brochure"), types.ObjectMetadata{ContentType: "application/pdf"})
+	require.NoError(t, err)
+	assert.Equal(t, first.Checksums, second.Checksums)
+	assert.Equal(t, "second.pdf", second.Key)
+
+	stored, err := inner.List(ctx, "", 10)
+	require.NoError(t, err)
+	require.Len(t, stored, 1, "one blob holds both uploads")
+	assert.True(t, strings.HasPrefix(stored[0].Key, blobKeyPrefix))
+
+	listed, err := dedup.List(ctx, "", 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	assert.Equal(t, "first.pdf", listed[0].Key)
+	assert.Equal(t, int64(len("brochure")), listed[1].Size)
+
+	download, err := dedup.Download(ctx, "second.pdf")
+	require.NoError(t, err)
+	download.Body.Close()
+	assert.Equal(t, "second.pdf", download.FileID)
+	assert.Equal(t, "application/pdf", download.ContentType)
+
+	// The blob survives until its last reference is deleted.
+	require.NoError(t, dedup.Delete(ctx, "first.pdf"))
+	assert.Equal(t, "brochure", readObject(t, ctx, dedup, "second.pdf"))
+	require.NoError(t, dedup.Delete(ctx, "second.pdf"))
+	stored, err = inner.List(ctx, "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	var notFoundErr *types.NotFoundError
+	_, err = dedup.Download(ctx, "second.pdf")
+	assert.ErrorAs(t, err, &notFoundErr)
+	assert.ErrorAs(t, dedup.Delete(ctx, "second.pdf"), &notFoundErr)
+}
+
+func TestDedupStorage_ReplaceAndReject(t *testing.T) {
+	ctx := context.Background()
+	dedup, inner := newTestDedupStorage(t)
+
+	_, err := dedup.Upload(ctx, "notes.txt", strings.NewReader("draft"), types.ObjectMetadata{})
+	require.NoError(t, err)
+	_, err = dedup.Upload(ctx, "notes.txt", strings.NewReader("final"), types.ObjectMetadata{})
+	assert.Error(t, err, "a key in use is not replaced")
+	assert.Equal(t, "draft", readObject(t, ctx, dedup, "notes.txt"))
+	stored, err := inner.List(ctx, "", 10)
+	require.NoError(t, err)
+	assert.Len(t, stored, 1, "the rejected upload stores no blob")
+
+	_, err = dedup.Upload(ctx, "short.txt", strings.NewReader("abc"), types.ObjectMetadata{Size: 4})
+	var appErr *types.AppError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, "Size Mismatch", appErr.Message)
+	var notFoundErr *types.NotFoundError
+	_, err = dedup.Download(ctx, "short.txt")
+	assert.ErrorAs(t, err, &notFoundErr)
+}
+
+func TestDedupStorage_FallsBackToUnindexedObjects(t *testing.T) {
+	ctx := context.Background()
+	dedup, inner := newTestDedupStorage(t)
+
+	_, err := inner.Upload(ctx, "legacy.txt", strings.NewReader("old"), types.ObjectMetadata{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "old", readObject(t, ctx, dedup, "legacy.txt"))
+	require.NoError(t, dedup.Delete(ctx, "legacy.txt"))
+	var notFoundErr *types.NotFoundError
+	_, err = inner.Download(ctx, "legacy.txt")
+	assert.ErrorAs(t, err, &notFoundErr)
+}
+
+func TestDedupStorage_KeepsTenantsApart(t *testing.T) {
+	dedup, inner := newTestDedupStorage(t)
+	acme := tenant.WithTenant(context.Background(), &tenant.Tenant{ID: "acme"})
+	globex := tenant.WithTenant(context.Background(), &tenant.Tenant{ID: "globex"})
+
+	for _, ctx := range []context.Context{acme, globex} {
+		_, err := dedup.Upload(ctx, "logo.png", strings.NewReader("logo"), types.ObjectMetadata{})
+		require.NoError(t, err)
+	}
+	for _, ctx := range []context.Context{acme, globex} {
+		stored, err := inner.List(ctx, "", 10)
+		require.NoError(t, err)
+		assert.Len(t, stored, 1, "each tenant stores its own blob")
+
+		listed, err := dedup.List(ctx, "", 10)
+		require.NoError(t, err)
+		require.Len(t, listed, 1)
+		assert.Equal(t, "logo.png", listed[0].Key)
+	}
+	listed, err := dedup.List(context.Background(), "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, listed)
+
+	require.NoError(t, dedup.Delete(acme, "logo.png"))
+	assert.Equal(t, "logo", readObject(t, globex, dedup, "logo.png"))
+	var notFoundErr *types.NotFoundError
+	_, err = dedup.Download(acme, "logo.png")
+	assert.ErrorAs(t, err, &notFoundErr)
+}
+
+func TestDedupStorage_PresignsAndAdoptsDirectUploads(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMockFileStorage()
+	index := newMemoryBlobIndex()
+	dedup, err := NewDedupStorage(inner, index, filepath.Join(t.TempDir(), "spool"))
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte("photo"))
+	blob := blobKey(hex.EncodeToString(sum[:]))
+	directUpload := func(key string) *types.FileDownload {
+		return &types.FileDownload{FileID: key, ContentType: "image/png", Size: int64(len("photo")), Body: io.NopCloser(strings.NewReader("photo"))}
+	}
+
+	// A presigned upload is written under its own key, then adopted as a blob.
+	inner.On("PresignUpload", ctx, "direct.png", http.MethodPut, "image/png", int64(5), time.Minute).Return(&types.PresignedRequest{FileID: "direct.png"}, nil)
+	inner.On("Download", ctx, "direct.png").Return(directUpload("direct.png"), nil).Once()
+	inner.On("Upload", ctx, blob, mock.Anything, mock.Anything).Return(&types.ObjectInfo{Key: blob}, nil).Once()
+	inner.On("Delete", ctx, "direct.png").Return(nil).Once()
+	_, err = dedup.PresignUpload(ctx, "direct.png", http.MethodPut, "image/png", 5, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, dedup.Adopt(ctx, "direct.png"))
+
+	// A multipart upload is adopted once complete, and its content is already stored.
+	inner.On("CompleteMultipartUpload", ctx, "parts.png", "upload-1", []types.UploadedPart(nil)).Return(nil)
+	inner.On("Download", ctx, "parts.png").Return(directUpload("parts.png"), nil).Once()
+	inner.On("Delete", ctx, "parts.png").Return(nil).Once()
+	require.NoError(t, dedup.CompleteMultipartUpload(ctx, "parts.png", "upload-1", nil))
+	assert.Len(t, index.refs, 2)
+
+	// Downloads are presigned for the blob, unless the object was never deduplicated.
+	inner.On("PresignDownload", ctx, blob, time.Minute).Return(&types.PresignedRequest{FileID: blob}, nil)
+	inner.On("PresignDownload", ctx, "legacy.png", time.Minute).Return(&types.PresignedRequest{FileID: "legacy.png"}, nil)
+	presigned, err := dedup.PresignDownload(ctx, "parts.png", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "parts.png", presigned.FileID)
+	_, err = dedup.PresignDownload(ctx, "legacy.png", time.Minute)
+	require.NoError(t, err)
+	inner.AssertExpectations(t)
+
+	// Backends that cannot presign are reported as such rather than failing later.
+	local, _ := newTestDedupStorage(t)
+	_, err = local.PresignDownload(ctx, "parts.png", time.Minute)
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pizza-nz/file-uploader/metrics"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// tempDirName is the directory under the base path that holds partially written
+// objects. It lives on the same filesystem as the objects so renames are atomic.
+const tempDirName = ".tmp"
+
+// multipartDirName is the directory under tempDirName holding the parts of unfinished
+// multipart uploads, one subdirectory per upload ID.
+const multipartDirName = "multipart"
+
+// LocalStorage implements the FileStorage interface on the local filesystem.
+// Objects are sharded into two levels of subdirectories derived from a hash of
+// their key, so no single directory grows unbounded.
+type LocalStorage struct {
+	basePath string
+}
+
+var (
+	_ FileStorage       = (*LocalStorage)(nil)
+	_ MultipartUploader = (*LocalStorage)(nil)
+	_ ObjectIterator    = (*LocalStorage)(nil)
+	_ HealthChecker     = (*LocalStorage)(nil)
+)
+
+// NewLocalStorage creates a new LocalStorage rooted at basePath, creating the
+// directory if it does not exist.
+func NewLocalStorage(basePath string) (FileStorage, error) {
+	absPath, err := filepath.Abs(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve storage path: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(absPath, tempDirName), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return &LocalStorage{basePath: absPath}, nil
+}
+
+// CheckHealth creates and removes a temporary file, to check the base path is still
+// there and writable.
+func (s *LocalStorage) CheckHealth(ctx context.Context) error {
+	file, err := os.CreateTemp(filepath.Join(s.basePath, tempDirName), "health-*")
+	if err != nil {
+		return fmt.Errorf("local storage is not writable: %w", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Upload writes a file to a temporary file and renames it into place once it is
+// complete and matches meta, so readers never observe a partially written object.
+// The content type is derived from the key's extension when the object is read back,
+// and UserMetadata is not kept.
+func (s *LocalStorage) Upload(ctx context.Context, key string, body io.Reader, meta types.ObjectMetadata) (_ *types.ObjectInfo, err error) {
+	defer metrics.ObserveStorage("local", "upload", time.Now(), &err)
+
+	object := newObjectReader(body)
+	if err := s.writeObject(ctx, key, object, func() error { return object.verify(meta) }); err != nil {
+		return nil, err
+	}
+
+	objectPath, _ := s.objectPath(ctx, key)
+	info, err := os.Stat(objectPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat stored file: %w", err)
+	}
+
+	checksums := object.checksums()
+	return &types.ObjectInfo{
+		Key:          key,
+		Size:         object.size,
+		LastModified: info.ModTime(),
+		ContentType:  meta.ContentType,
+		ETag:         hex.EncodeToString(checksums.MD5),
+		Checksums:    checksums,
+	}, nil
+}
+
+// writeObject atomically stores everything read from body under key. If check is not
+// nil it is called once body has been read, and the object is only stored if it succeeds.
+func (s *LocalStorage) writeObject(ctx context.Context, key string, body io.Reader, check func() error) error {
+	objectPath, err := s.objectPath(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Join(s.basePath, tempDirName), "upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	// Removing the temporary file fails harmlessly once it has been renamed.
+	defer os.Remove(tempFile.Name())
+
+	if _, err := io.Copy(tempFile, body); err != nil {
+		tempFile.Close()
+		slog.ErrorContext(ctx, "Error writing file to local storage", "error", err)
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			tempFile.Close()
+			return err
+		}
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to flush file: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0o750); err != nil {
+		return fmt.Errorf("failed to create shard directory: %w", err)
+	}
+	if err := os.Rename(tempFile.Name(), objectPath); err != nil {
+		slog.ErrorContext(ctx, "Error moving file into local storage", "error", err)
+		return fmt.Errorf("failed to store file: %w", err)
+	}
+
+	return nil
+}
+
+// Download opens a stored object. The content type is derived from the key's extension.
+func (s *LocalStorage) Download(ctx context.Context, key string) (_ *types.FileDownload, err error) {
+	defer metrics.ObserveStorage("local", "download", time.Now(), &err)
+
+	objectPath, err := s.objectPath(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(objectPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, types.NewNotFoundError(key)
+		}
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	return &types.FileDownload{
+		FileID:      key,
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		Size:        info.Size(),
+		Body:        file,
+	}, nil
+}
+
+// Delete removes a stored object.
+func (s *LocalStorage) Delete(ctx context.Context, key string) (err error) {
+	defer metrics.ObserveStorage("local", "delete", time.Now(), &err)
+
+	objectPath, err := s.objectPath(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(objectPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return types.NewNotFoundError(key)
+		}
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	return nil
+}
+
+// List walks every shard directory, so its cost grows with the number of stored
+// objects rather than with limit.
+func (s *LocalStorage) List(ctx context.Context, startAfter string, limit int) ([]types.ObjectInfo, error) {
+	objects, err := s.walk(ctx, startAfter)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) > limit {
+		objects = objects[:limit]
+	}
+	return objects, nil
+}
+
+// Objects walks the shards once and yields every object after startAfter, as listing
+// any page costs a walk of every shard.
+func (s *LocalStorage) Objects(ctx context.Context, startAfter string) iter.Seq2[types.ObjectInfo, error] {
+	return func(yield func(types.ObjectInfo, error) bool) {
+		objects, err := s.walk(ctx, startAfter)
+		if err != nil {
+			yield(types.ObjectInfo{}, err)
+			return
+		}
+		for _, object := range objects {
+			if !yield(object, nil) {
+				return
+			}
+		}
+	}
+}
+
+// walk returns every object after startAfter in ascending key order.
+func (s *LocalStorage) walk(ctx context.Context, startAfter string) (_ []types.ObjectInfo, err error) {
+	defer metrics.ObserveStorage("local", "list", time.Now(), &err)
+
+	var objects []types.ObjectInfo
+	err = filepath.WalkDir(s.basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.basePath, path)
+		if err != nil {
+			return err
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		// Only descend into shard directories; the base path also holds the
+		// temporary directory and anything else that shares file.path.
+		if d.IsDir() {
+			if (rel != "." && !isShardSegment(segments[0])) || (len(segments) == 2 && !isShardSegment(segments[1])) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(segments) < 3 || !d.Type().IsRegular() {
+			return nil
+		}
+
+		storedKey := strings.Join(segments[2:], "/")
+		key, ok := listedKey(ctx, storedKey)
+		if !ok || key <= startAfter {
+			return nil
+		}
+		// Skip stray files that are not where their key would be stored.
+		if objectPath, err := s.storedPath(storedKey); err != nil || objectPath != path {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, types.ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// CreateMultipartUpload creates a directory to collect the parts of a new upload.
+func (s *LocalStorage) CreateMultipartUpload(ctx context.Context, key string, contentType string) (_ string, err error) {
+	defer metrics.ObserveStorage("local", "create_multipart_upload", time.Now(), &err)
+
+	if _, err := s.objectPath(ctx, key); err != nil {
+		return "", err
+	}
+
+	uploadID := uuid.New().String()
+	if err := os.MkdirAll(filepath.Join(s.basePath, tempDirName, multipartDirName, uploadID), 0o750); err != nil {
+		return "", fmt.Errorf("failed to create multipart upload directory: %w", err)
+	}
+
+	return uploadID, nil
+}
+
+// UploadPart atomically writes one part into the upload's directory.
+func (s *LocalStorage) UploadPart(ctx context.Context, key string, uploadID string, partNumber int32, body io.ReadSeeker, size int64) (_ *types.UploadedPart, err error) {
+	defer metrics.ObserveStorage("local", "upload_part", time.Now(), &err)
+
+	uploadDir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	tempFile, err := os.CreateTemp(uploadDir, "part-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary part file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	written, err := io.Copy(tempFile, body)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write part: %w", err)
+	}
+	if written != size {
+		return nil, fmt.Errorf("part %d is %d bytes, expected %d", partNumber, written, size)
+	}
+
+	if err := os.Rename(tempFile.Name(), s.partPath(uploadDir, partNumber)); err != nil {
+		return nil, fmt.Errorf("failed to store part: %w", err)
+	}
+
+	return &types.UploadedPart{PartNumber: partNumber, ETag: fmt.Sprintf("%d-%d", partNumber, size), Size: size}, nil
+}
+
+// CompleteMultipartUpload concatenates the parts into the final object and removes them.
+func (s *LocalStorage) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []types.UploadedPart) (err error) {
+	defer metrics.ObserveStorage("local", "complete_multipart_upload", time.Now(), &err)
+
+	uploadDir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		partFile, err := os.Open(s.partPath(uploadDir, part.PartNumber))
+		if err != nil {
+			return fmt.Errorf("failed to open part %d: %w", part.PartNumber, err)
+		}
+		defer partFile.Close()
+		readers = append(readers, partFile)
+	}
+
+	if err := s.writeObject(ctx, key, io.MultiReader(readers...), nil); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(uploadDir)
+}
+
+// AbortMultipartUpload removes every part stored for the upload.
+func (s *LocalStorage) AbortMultipartUpload(ctx context.Context, key string, uploadID string) (err error) {
+	defer metrics.ObserveStorage("local", "abort_multipart_upload", time.Now(), &err)
+
+	uploadDir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(uploadDir)
+}
+
+// multipartDir returns the directory for an existing multipart upload.
+func (s *LocalStorage) multipartDir(uploadID string) (string, error) {
+	if _, err := uuid.Parse(uploadID); err != nil {
+		return "", types.NewNotFoundError(uploadID)
+	}
+
+	uploadDir := filepath.Join(s.basePath, tempDirName, multipartDirName, uploadID)
+	if _, err := os.Stat(uploadDir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", types.NewNotFoundError(uploadID)
+		}
+		return "", fmt.Errorf("failed to stat multipart upload: %w", err)
+	}
+
+	return uploadDir, nil
+}
+
+func (s *LocalStorage) partPath(uploadDir string, partNumber int32) string {
+	return filepath.Join(uploadDir, fmt.Sprintf("%05d.part", partNumber))
+}
+
+// objectPath maps key, as known to the tenant in ctx, to its location on disk.
+func (s *LocalStorage) objectPath(ctx context.Context, key string) (string, error) {
+	return s.storedPath(tenantKey(ctx, key))
+}
+
+// storedPath maps a stored key to its sharded location on disk. Keys may contain "/"
+// separated segments, but any segment that could escape the base directory is rejected.
+func (s *LocalStorage) storedPath(key string) (string, error) {
+	if !validLocalKey(key) {
+		return "", types.NewAppError("Invalid File ID", fmt.Sprintf("Object key %q is not a valid local storage key", key), http.StatusBadRequest, nil)
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	shard := hex.EncodeToString(sum[:2])
+	objectPath := filepath.Join(s.basePath, shard[:2], shard[2:], filepath.FromSlash(key))
+
+	// Defence in depth: the validated key must still resolve inside the base path.
+	rel, err := filepath.Rel(s.basePath, objectPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", types.NewAppError("Invalid File ID", fmt.Sprintf("Object key %q resolves outside of storage", key), http.StatusBadRequest, nil)
+	}
+
+	return objectPath, nil
+}
+
+// isShardSegment reports whether name is a two character lowercase hex shard directory.
+func isShardSegment(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+func validLocalKey(key string) bool {
+	if key == "" || len(key) > 1024 || strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
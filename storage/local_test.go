@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalStorage_UploadDownloadDelete(t *testing.T) {
+	basePath := t.TempDir()
+	fileStorage, err := NewLocalStorage(basePath)
+	require.NoError(t, err)
+
+	key := NewObjectKey("report.pdf")
+	assert.Equal(t, ".pdf", filepath.Ext(key))
+	object, err := fileStorage.Upload(context.Background(), key, strings.NewReader("pdf content"), types.ObjectMetadata{Size: int64(len("pdf content")), ContentType: "application/pdf"})
+	require.NoError(t, err)
+	assert.Equal(t, key, object.Key)
+	assert.Equal(t, int64(len("pdf content")), object.Size)
+	sum := sha256.Sum256([]byte("pdf content"))
+	assert.Equal(t, sum[:], object.Checksums.SHA256)
+
+	download, err := fileStorage.Download(context.Background(), key)
+	require.NoError(t, err)
+	content, err := io.ReadAll(download.Body)
+	download.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "pdf content", string(content))
+	assert.Equal(t, int64(len("pdf content")), download.Size)
+	assert.Equal(t, "application/pdf", download.ContentType)
+
+	// No temporary files are left behind once the upload has been renamed into place.
+	entries, err := os.ReadDir(filepath.Join(basePath, tempDirName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	require.NoError(t, fileStorage.Delete(context.Background(), key))
+
+	var notFoundErr *types.NotFoundError
+	_, err = fileStorage.Download(context.Background(), key)
+	assert.ErrorAs(t, err, &notFoundErr)
+	assert.ErrorAs(t, fileStorage.Delete(context.Background(), key), &notFoundErr)
+}
+
+func TestLocalStorage_UploadRejectsMismatch(t *testing.T) {
+	basePath := t.TempDir()
+	fileStorage, err := NewLocalStorage(basePath)
+	require.NoError(t, err)
+
+	wrongMD5 := md5.Sum([]byte("other content"))
+	tests := []struct {
+		name string
+		meta types.ObjectMetadata
+	}{
+		{name: "Size", meta: types.ObjectMetadata{Size: 100}},
+		{name: "MD5", meta: types.ObjectMetadata{Checksums: types.Checksums{MD5: wrongMD5[:]}}},
+		{name: "SHA-256", meta: types.ObjectMetadata{Checksums: types.Checksums{SHA256: make([]byte, sha256.Size)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := fileStorage.Upload(context.Background(), "report.pdf", strings.NewReader("pdf content"), tt.meta)
+			var appErr *types.AppError
+			require.ErrorAs(t, err, &appErr)
+			assert.Equal(t, http.StatusBadRequest, appErr.HTTPStatus)
+
+			// Nothing is stored, and no temporary file is left behind.
+			var notFoundErr *types.NotFoundError
+			_, err = fileStorage.Download(context.Background(), "report.pdf")
+			assert.ErrorAs(t, err, &notFoundErr)
+			entries, err := os.ReadDir(filepath.Join(basePath, tempDirName))
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func TestLocalStorage_ShardsObjects(t *testing.T) {
+	basePath := t.TempDir()
+	fileStorage, err := NewLocalStorage(basePath)
+	require.NoError(t, err)
+
+	objectPath, err := fileStorage.(*LocalStorage).objectPath(context.Background(), "abc.png")
+	require.NoError(t, err)
+
+	rel, err := filepath.Rel(basePath, objectPath)
+	require.NoError(t, err)
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	require.Len(t, segments, 3)
+	assert.Len(t, segments[0], 2)
+	assert.Len(t, segments[1], 2)
+	assert.Equal(t, "abc.png", segments[2])
+}
+
+func TestLocalStorage_RejectsUnsafeKeys(t *testing.T) {
+	fileStorage, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+
+	for _, key := range []string{"", "..", "../etc/passwd", "a/../../b", "/absolute", "a//b", `..\windows`, "nul\x00byte"} {
+		t.Run(key, func(t *testing.T) {
+			_, err := fileStorage.Download(context.Background(), key)
+
+			var appErr *types.AppError
+			assert.ErrorAs(t, err, &appErr)
+		})
+	}
+}
+
+func TestLocalStorage_List(t *testing.T) {
+	basePath := t.TempDir()
+	fileStorage, err := NewLocalStorage(basePath)
+	require.NoError(t, err)
+	local := fileStorage.(*LocalStorage)
+
+	for _, key := range []string{"c.png", "a.pdf", "nested/b.png"} {
+		require.NoError(t, local.writeObject(context.Background(), key, strings.NewReader(key), nil))
+	}
+	// Files that share the base path but are not objects are never listed.
+	require.NoError(t, os.MkdirAll(filepath.Join(basePath, ".sessions"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(basePath, ".sessions", "session.json"), []byte("{}"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(basePath, "metadata.db"), nil, 0o600))
+
+	objects, err := fileStorage.List(context.Background(), "", 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "a.pdf", objects[0].Key)
+	assert.Equal(t, int64(len("a.pdf")), objects[0].Size)
+	assert.Equal(t, "c.png", objects[1].Key)
+
+	objects, err = fileStorage.List(context.Background(), "c.png", 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "nested/b.png", objects[0].Key)
+
+	// Iterating walks the shards once for every remaining object.
+	var keys []string
+	for object, err := range Objects(context.Background(), fileStorage, "a.pdf", 1) {
+		require.NoError(t, err)
+		keys = append(keys, object.Key)
+	}
+	assert.Equal(t, []string{"c.png", "nested/b.png"}, keys)
+}
+
+func TestLocalStorage_KeepsTenantsApart(t *testing.T) {
+	fileStorage, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	acme := tenant.WithTenant(context.Background(), &tenant.Tenant{ID: "acme"})
+	globex := tenant.WithTenant(context.Background(), &tenant.Tenant{ID: "globex"})
+
+	_, err = fileStorage.Upload(acme, "report.pdf", strings.NewReader("acme"), types.ObjectMetadata{})
+	require.NoError(t, err)
+	_, err = fileStorage.Upload(context.Background(), "report.pdf", strings.NewReader("shared"), types.ObjectMetadata{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "acme", readObject(t, acme, fileStorage, "report.pdf"))
+	assert.Equal(t, "shared", readObject(t, context.Background(), fileStorage, "report.pdf"))
+	var notFoundErr *types.NotFoundError
+	_, err = fileStorage.Download(globex, "report.pdf")
+	assert.ErrorAs(t, err, &notFoundErr)
+	assert.ErrorAs(t, fileStorage.Delete(globex, "report.pdf"), &notFoundErr)
+
+	for ctx, want := range map[context.Context]int{acme: 1, globex: 0, context.Background(): 1} {
+		objects, err := fileStorage.List(ctx, "", 10)
+		require.NoError(t, err)
+		require.Len(t, objects, want)
+		if want > 0 {
+			assert.Equal(t, "report.pdf", objects[0].Key)
+		}
+	}
+}
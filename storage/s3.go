@@ -2,26 +2,47 @@ package storage
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"mime/multipart"
-	"path/filepath"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/google/uuid"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/metrics"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/tracing"
+	"github.com/pizza-nz/file-uploader/types"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // S3Storage implements the FileStorage interface for AWS S3.
 type S3Storage struct {
-	client     *s3.Client
-	bucketName string
+	client        *s3.Client
+	presignClient *s3.PresignClient
+	uploader      *manager.Uploader
+	bucketName    string
 }
 
-var _ FileStorage = (*S3Storage)(nil)
+var (
+	_ FileStorage       = (*S3Storage)(nil)
+	_ Presigner         = (*S3Storage)(nil)
+	_ MultipartUploader = (*S3Storage)(nil)
+	_ HealthChecker     = (*S3Storage)(nil)
+)
 
 // NewS3Storage creates a new S3Storage instance.
 func NewS3Storage(ctx context.Context, cfg config.AWSConfig) (FileStorage, error) {
@@ -31,32 +52,394 @@ func NewS3Storage(ctx context.Context, cfg config.AWSConfig) (FileStorage, error
 		awsConfig.WithCredentialsProvider(creds),
 	)
 	if err != nil {
-		slog.Error("failed to load AWS config", "error", err)
+		slog.ErrorContext(ctx, "failed to load AWS config", "error", err)
 		return nil, err
 	}
 
+	// Trace every S3 request, and pass the trace context on in its headers.
+	otelaws.AppendMiddlewares(&awsCfg.APIOptions, otelaws.WithTextMapPropagator(otel.GetTextMapPropagator()))
+
+	client := s3.NewFromConfig(awsCfg)
 	return &S3Storage{
-		client:     s3.NewFromConfig(awsCfg),
-		bucketName: cfg.S3.BucketName,
+		client:        client,
+		presignClient: s3.NewPresignClient(client),
+		uploader:      manager.NewUploader(client),
+		bucketName:    cfg.S3.BucketName,
+	}, nil
+}
+
+// Upload uploads a file to S3 under key. The upload manager sends bodies of unknown
+// length as a multipart upload, buffering only a few parts at a time, and aborts the
+// multipart upload if body fails part way through.
+//
+// Every request carries a SHA-256 checksum that S3 verifies as it receives the data.
+// A file small enough to be sent in a single request is also sent with the MD5 and
+// SHA-256 in meta, so S3 itself refuses a file that does not match them. S3 only
+// keeps checksums of each part of a multipart upload, so larger files are compared
+// with meta once they have been sent, and deleted again if they do not match. By then
+// S3 has replaced any object that was already under key, so that object is lost too.
+func (s *S3Storage) Upload(ctx context.Context, key string, body io.Reader, meta types.ObjectMetadata) (_ *types.ObjectInfo, err error) {
+	defer metrics.ObserveStorage("s3", "upload", time.Now(), &err)
+
+	bucket, objectKey := s.location(ctx, key)
+	ctx, span := tracer.Start(ctx, "S3Storage.PutObject", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", bucket),
+		attribute.String("aws.s3.key", objectKey),
+		attribute.Int64("file.declared_size", meta.Size),
+	))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	object := newObjectReader(body)
+	input := &s3.PutObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(objectKey),
+		Body:              object,
+		ContentType:       aws.String(meta.ContentType),
+		Metadata:          meta.UserMetadata,
+		ChecksumAlgorithm: s3types.ChecksumAlgorithmSha256,
+	}
+	if meta.Size > 0 && meta.Size < s.uploader.PartSize {
+		if meta.Checksums.MD5 != nil {
+			input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(meta.Checksums.MD5))
+		}
+		if meta.Checksums.SHA256 != nil {
+			input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(meta.Checksums.SHA256))
+		}
+	}
+
+	out, err := s.uploader.Upload(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "BadDigest" || apiErr.ErrorCode() == "InvalidDigest") {
+			return nil, types.NewAppError("Checksum Mismatch", apiErr.ErrorMessage(), http.StatusBadRequest, err)
+		}
+		slog.ErrorContext(ctx, "Error uploading file to S3", "error", err, "s3_key", objectKey)
+		return nil, fmt.Errorf("failed to upload file to S3: %w", err)
+	}
+
+	if err := object.verify(meta); err != nil {
+		if _, deleteErr := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(objectKey)}); deleteErr != nil {
+			slog.ErrorContext(ctx, "Error deleting mismatched upload from S3", "error", deleteErr, "s3_key", objectKey)
+		}
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int64("file.size", object.size))
+	return &types.ObjectInfo{
+		Key:          key,
+		Size:         object.size,
+		ContentType:  meta.ContentType,
+		ETag:         strings.Trim(aws.ToString(out.ETag), `"`),
+		Checksums:    object.checksums(),
+		UserMetadata: meta.UserMetadata,
+	}, nil
+}
+
+// Download fetches an object from S3. The returned body streams directly from S3
+// and must be closed by the caller.
+func (s *S3Storage) Download(ctx context.Context, key string) (_ *types.FileDownload, err error) {
+	defer metrics.ObserveStorage("s3", "download", time.Now(), &err)
+
+	bucket, objectKey := s.location(ctx, key)
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, types.NewNotFoundError(key)
+		}
+		slog.ErrorContext(ctx, "Error downloading file from S3", "error", err, "s3_key", objectKey)
+		return nil, fmt.Errorf("failed to download file from S3: %w", err)
+	}
+
+	return &types.FileDownload{
+		FileID:      key,
+		ContentType: aws.ToString(out.ContentType),
+		Size:        aws.ToInt64(out.ContentLength),
+		Body:        out.Body,
 	}, nil
 }
 
-// Upload uploads a file to S3 and returns the object key.
-func (s *S3Storage) Upload(ctx context.Context, file multipart.File, handler *multipart.FileHeader) (string, error) {
-	fileID := uuid.New().String()
-	fileExtension := filepath.Ext(handler.Filename)
-	s3ObjectKey := fmt.Sprintf("%s%s", fileID, fileExtension)
+// Delete removes an object from S3. S3 itself treats deletes of missing keys as a
+// success, so the object is looked up first to report a NotFoundError instead.
+func (s *S3Storage) Delete(ctx context.Context, key string) (err error) {
+	defer metrics.ObserveStorage("s3", "delete", time.Now(), &err)
 
-	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(s.bucketName),
-		Key:         aws.String(s3ObjectKey),
-		Body:        file,
-		ContentType: aws.String(handler.Header.Get("Content-Type")),
+	bucket, objectKey := s.location(ctx, key)
+	_, err = s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
 	})
 	if err != nil {
-		slog.Error("Error uploading file to S3", "error", err)
-		return "", fmt.Errorf("failed to upload file to S3: %w", err)
+		var notFound *s3types.NotFound
+		if errors.As(err, &notFound) {
+			return types.NewNotFoundError(key)
+		}
+		slog.ErrorContext(ctx, "Error looking up file in S3", "error", err, "s3_key", objectKey)
+		return fmt.Errorf("failed to look up file in S3: %w", err)
 	}
 
-	return s3ObjectKey, nil
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting file from S3", "error", err, "s3_key", objectKey)
+		return fmt.Errorf("failed to delete file from S3: %w", err)
+	}
+
+	return nil
+}
+
+// location returns the bucket and S3 key of the object stored under key for the
+// tenant in ctx. A tenant with a bucket of its own has it to itself; other tenants
+// share the configured bucket, each under its own prefix.
+func (s *S3Storage) location(ctx context.Context, key string) (string, string) {
+	if t := tenant.FromContext(ctx); t != nil && t.Bucket != "" {
+		return t.Bucket, key
+	}
+	return s.bucketName, tenantKey(ctx, key)
+}
+
+// List returns one page of ListObjectsV2 results, which S3 already orders by key.
+// Only the objects of the tenant in ctx are listed.
+func (s *S3Storage) List(ctx context.Context, startAfter string, limit int) (_ []types.ObjectInfo, err error) {
+	defer metrics.ObserveStorage("s3", "list", time.Now(), &err)
+
+	bucket, prefix := s.location(ctx, "")
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		MaxKeys: aws.Int32(int32(limit)),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(prefix + startAfter)
+	}
+	// A tenant's own bucket holds nothing but its objects.
+	t := tenant.FromContext(ctx)
+	owned := t != nil && t.Bucket != ""
+
+	objects := make([]types.ObjectInfo, 0, limit)
+	// S3 may return fewer keys than asked for, so keep paging until limit is reached.
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+	for paginator.HasMorePages() && len(objects) < limit {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error listing files in S3", "error", err)
+			return nil, fmt.Errorf("failed to list files in S3: %w", err)
+		}
+		for _, object := range out.Contents {
+			if len(objects) == limit {
+				break
+			}
+			key := aws.ToString(object.Key)
+			if !owned {
+				var ok bool
+				if key, ok = listedKey(ctx, key); !ok {
+					continue
+				}
+			}
+			objects = append(objects, types.ObjectInfo{
+				Key:          key,
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+// CheckHealth checks the bucket of the tenant in ctx, or the shared bucket, exists and
+// the service's credentials may access it.
+func (s *S3Storage) CheckHealth(ctx context.Context) (err error) {
+	defer metrics.ObserveStorage("s3", "head_bucket", time.Now(), &err)
+
+	bucket, _ := s.location(ctx, "")
+	if _, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return fmt.Errorf("failed to reach S3 bucket %s: %w", bucket, err)
+	}
+	return nil
+}
+
+// PresignDownload returns a presigned GetObject request for key.
+func (s *S3Storage) PresignDownload(ctx context.Context, key string, expiry time.Duration) (*types.PresignedRequest, error) {
+	bucket, objectKey := s.location(ctx, key)
+	req, err := s.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error presigning S3 download", "error", err, "s3_key", objectKey)
+		return nil, fmt.Errorf("failed to presign S3 download: %w", err)
+	}
+
+	return &types.PresignedRequest{
+		FileID:    key,
+		Method:    req.Method,
+		URL:       req.URL,
+		ExpiresAt: time.Now().Add(expiry),
+	}, nil
+}
+
+// PresignUpload returns a presigned PutObject request, or a presigned POST policy when
+// method is POST. Both pin the content type and size so the client cannot store
+// anything other than what was declared.
+func (s *S3Storage) PresignUpload(ctx context.Context, key string, method string, contentType string, size int64, expiry time.Duration) (*types.PresignedRequest, error) {
+	bucket, objectKey := s.location(ctx, key)
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(objectKey),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	}
+
+	if method == http.MethodPost {
+		req, err := s.presignClient.PresignPostObject(ctx, input, func(opts *s3.PresignPostOptions) {
+			opts.Expires = expiry
+			opts.Conditions = []interface{}{
+				[]interface{}{"content-length-range", size, size},
+				map[string]string{"Content-Type": contentType},
+			}
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error presigning S3 POST upload", "error", err, "s3_key", objectKey)
+			return nil, fmt.Errorf("failed to presign S3 upload: %w", err)
+		}
+
+		fields := req.Values
+		fields["Content-Type"] = contentType
+		return &types.PresignedRequest{
+			FileID:    key,
+			Method:    http.MethodPost,
+			URL:       req.URL,
+			Fields:    fields,
+			ExpiresAt: time.Now().Add(expiry),
+		}, nil
+	}
+
+	req, err := s.presignClient.PresignPutObject(ctx, input, s3.WithPresignExpires(expiry))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error presigning S3 PUT upload", "error", err, "s3_key", objectKey)
+		return nil, fmt.Errorf("failed to presign S3 upload: %w", err)
+	}
+
+	// Every signed header other than Host must be sent exactly as signed.
+	headers := make(map[string]string)
+	for name, values := range req.SignedHeader {
+		if http.CanonicalHeaderKey(name) != "Host" && len(values) > 0 {
+			headers[http.CanonicalHeaderKey(name)] = values[0]
+		}
+	}
+
+	return &types.PresignedRequest{
+		FileID:    key,
+		Method:    req.Method,
+		URL:       req.URL,
+		Headers:   headers,
+		ExpiresAt: time.Now().Add(expiry),
+	}, nil
+}
+
+// CreateMultipartUpload starts an S3 multipart upload. Every part except the last
+// must be at least 5MB.
+func (s *S3Storage) CreateMultipartUpload(ctx context.Context, key string, contentType string) (_ string, err error) {
+	defer metrics.ObserveStorage("s3", "create_multipart_upload", time.Now(), &err)
+
+	bucket, objectKey := s.location(ctx, key)
+	out, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(objectKey),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating S3 multipart upload", "error", err, "s3_key", objectKey)
+		return "", fmt.Errorf("failed to create S3 multipart upload: %w", err)
+	}
+
+	return aws.ToString(out.UploadId), nil
+}
+
+// UploadPart uploads a single part of an S3 multipart upload.
+func (s *S3Storage) UploadPart(ctx context.Context, key string, uploadID string, partNumber int32, body io.ReadSeeker, size int64) (_ *types.UploadedPart, err error) {
+	defer metrics.ObserveStorage("s3", "upload_part", time.Now(), &err)
+
+	bucket, objectKey := s.location(ctx, key)
+	out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(objectKey),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(partNumber),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		if isNoSuchUpload(err) {
+			return nil, types.NewNotFoundError(uploadID)
+		}
+		slog.ErrorContext(ctx, "Error uploading part to S3", "error", err, "s3_key", objectKey, "part", partNumber)
+		return nil, fmt.Errorf("failed to upload part to S3: %w", err)
+	}
+
+	return &types.UploadedPart{PartNumber: partNumber, ETag: aws.ToString(out.ETag), Size: size}, nil
+}
+
+// CompleteMultipartUpload assembles the uploaded parts into the final S3 object.
+func (s *S3Storage) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []types.UploadedPart) (err error) {
+	defer metrics.ObserveStorage("s3", "complete_multipart_upload", time.Now(), &err)
+
+	bucket, objectKey := s.location(ctx, key)
+	completed := make([]s3types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, s3types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int32(part.PartNumber),
+		})
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(objectKey),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		if isNoSuchUpload(err) {
+			return types.NewNotFoundError(uploadID)
+		}
+		slog.ErrorContext(ctx, "Error completing S3 multipart upload", "error", err, "s3_key", objectKey)
+		return fmt.Errorf("failed to complete S3 multipart upload: %w", err)
+	}
+
+	return nil
+}
+
+// AbortMultipartUpload aborts an S3 multipart upload and frees its stored parts.
+func (s *S3Storage) AbortMultipartUpload(ctx context.Context, key string, uploadID string) (err error) {
+	defer metrics.ObserveStorage("s3", "abort_multipart_upload", time.Now(), &err)
+
+	bucket, objectKey := s.location(ctx, key)
+	_, err = s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(objectKey),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		if isNoSuchUpload(err) {
+			return types.NewNotFoundError(uploadID)
+		}
+		slog.ErrorContext(ctx, "Error aborting S3 multipart upload", "error", err, "s3_key", objectKey)
+		return fmt.Errorf("failed to abort S3 multipart upload: %w", err)
+	}
+
+	return nil
+}
+
+func isNoSuchUpload(err error) bool {
+	var noSuchUpload *s3types.NoSuchUpload
+	return errors.As(err, &noSuchUpload)
 }
@@ -1,11 +1,213 @@
 package storage
 
 import (
+	"bytes"
 	"context"
-	"mime/multipart"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"iter"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pizza-nz/file-uploader/tenant"
+	"github.com/pizza-nz/file-uploader/types"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/pizza-nz/file-uploader/storage")
+
 // FileStorage defines the interface for file storage operations.
 type FileStorage interface {
-	Upload(ctx context.Context, file multipart.File, handler *multipart.FileHeader) (string, error)
+	// Upload streams body into the object stored under key. body may be of unknown
+	// length and is read exactly once. The returned ObjectInfo always carries the size
+	// and the MD5, SHA-256 and CRC32C checksums of what was stored. If body does not
+	// match meta's Size or Checksums, no object is left under key and a 400
+	// *types.AppError is returned. Not every backend can keep an object already stored
+	// under key when the upload fails, so callers upload to keys that are not in use,
+	// such as those from NewObjectKey.
+	Upload(ctx context.Context, key string, body io.Reader, meta types.ObjectMetadata) (*types.ObjectInfo, error)
+
+	// Download opens the object stored under key. It returns a *types.NotFoundError
+	// when the key does not exist.
+	Download(ctx context.Context, key string) (*types.FileDownload, error)
+
+	// Delete removes the object stored under key. It returns a *types.NotFoundError
+	// when the key does not exist, so repeating a delete never has further side effects.
+	Delete(ctx context.Context, key string) error
+
+	// List returns up to limit objects in ascending key order, starting after the key
+	// startAfter. Fewer than limit objects are returned only once the listing is exhausted.
+	List(ctx context.Context, startAfter string, limit int) ([]types.ObjectInfo, error)
+}
+
+// Presigner is implemented by backends that can hand out time-limited URLs, letting
+// clients transfer objects directly instead of proxying the bytes through the service.
+type Presigner interface {
+	// PresignDownload returns a GET request for the object stored under key.
+	PresignDownload(ctx context.Context, key string, expiry time.Duration) (*types.PresignedRequest, error)
+
+	// PresignUpload returns a PUT or POST request that stores exactly one object of
+	// the given size and content type under key.
+	PresignUpload(ctx context.Context, key string, method string, contentType string, size int64, expiry time.Duration) (*types.PresignedRequest, error)
+}
+
+// MultipartUploader is implemented by backends that can assemble an object from
+// separately uploaded parts, so a large upload can be resumed part by part.
+// Part numbers start at 1.
+type MultipartUploader interface {
+	// CreateMultipartUpload starts a multipart upload for key and returns its upload ID.
+	CreateMultipartUpload(ctx context.Context, key string, contentType string) (string, error)
+
+	// UploadPart stores one part of size bytes, replacing any earlier part with the same number.
+	UploadPart(ctx context.Context, key string, uploadID string, partNumber int32, body io.ReadSeeker, size int64) (*types.UploadedPart, error)
+
+	// CompleteMultipartUpload assembles parts, in order, into the object stored under key.
+	CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []types.UploadedPart) error
+
+	// AbortMultipartUpload discards an unfinished upload and every part stored for it.
+	AbortMultipartUpload(ctx context.Context, key string, uploadID string) error
+}
+
+// Adopter is implemented by backends that keep objects in a layout of their own, and
+// must take in an object a client wrote directly under key with a presigned upload
+// before it is served.
+type Adopter interface {
+	// Adopt takes in the object written under key. It returns a *types.NotFoundError
+	// if there is no such object.
+	Adopt(ctx context.Context, key string) error
+}
+
+// ObjectIterator is implemented by backends that list every object in one pass more
+// cheaply than page by page, such as LocalStorage, which walks every shard for any page.
+type ObjectIterator interface {
+	// Objects yields objects in ascending key order, starting after the key startAfter.
+	Objects(ctx context.Context, startAfter string) iter.Seq2[types.ObjectInfo, error]
+}
+
+// Objects yields the objects in fileStorage in ascending key order, starting after the
+// key startAfter. Objects are listed pageSize at a time as they are needed, unless
+// fileStorage is an ObjectIterator.
+func Objects(ctx context.Context, fileStorage FileStorage, startAfter string, pageSize int) iter.Seq2[types.ObjectInfo, error] {
+	if iterator, ok := fileStorage.(ObjectIterator); ok {
+		return iterator.Objects(ctx, startAfter)
+	}
+	return func(yield func(types.ObjectInfo, error) bool) {
+		for {
+			objects, err := fileStorage.List(ctx, startAfter, pageSize)
+			if err != nil {
+				yield(types.ObjectInfo{}, err)
+				return
+			}
+			for _, object := range objects {
+				if !yield(object, nil) {
+					return
+				}
+			}
+			if len(objects) < pageSize {
+				return
+			}
+			startAfter = objects[len(objects)-1].Key
+		}
+	}
+}
+
+// HealthChecker is implemented by backends that can check they are usable, so the
+// service only receives traffic once it can reach its storage.
+type HealthChecker interface {
+	// CheckHealth returns an error if objects of the tenant in ctx cannot currently be
+	// stored or read.
+	CheckHealth(ctx context.Context) error
+}
+
+// objectReader counts and checksums an object's body as a backend writes it, so the
+// backend can describe what it stored and check it against the uploaded metadata.
+type objectReader struct {
+	r      io.Reader
+	size   int64
+	md5    hash.Hash
+	sha256 hash.Hash
+	crc32c hash.Hash
+}
+
+func newObjectReader(r io.Reader) *objectReader {
+	return &objectReader{r: r, md5: md5.New(), sha256: sha256.New(), crc32c: crc32.New(crc32.MakeTable(crc32.Castagnoli))}
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.size += int64(n)
+	o.md5.Write(p[:n])
+	o.sha256.Write(p[:n])
+	o.crc32c.Write(p[:n])
+	return n, err
+}
+
+func (o *objectReader) checksums() types.Checksums {
+	return types.Checksums{MD5: o.md5.Sum(nil), SHA256: o.sha256.Sum(nil), CRC32C: o.crc32c.Sum(nil)}
+}
+
+// verify compares everything read so far with the size and checksums in meta.
+func (o *objectReader) verify(meta types.ObjectMetadata) error {
+	if meta.Size > 0 && o.size != meta.Size {
+		return types.NewAppError("Size Mismatch", fmt.Sprintf("Declared %d bytes but received %d", meta.Size, o.size), http.StatusBadRequest, nil)
+	}
+
+	checksums := o.checksums()
+	if meta.Checksums.MD5 != nil && !bytes.Equal(checksums.MD5, meta.Checksums.MD5) {
+		return types.NewAppError("Checksum Mismatch", "MD5 checksum does not match the received file", http.StatusBadRequest, nil)
+	}
+	if meta.Checksums.SHA256 != nil && !bytes.Equal(checksums.SHA256, meta.Checksums.SHA256) {
+		return types.NewAppError("Checksum Mismatch", "SHA-256 checksum does not match the received file", http.StatusBadRequest, nil)
+	}
+	if meta.Checksums.CRC32C != nil && !bytes.Equal(checksums.CRC32C, meta.Checksums.CRC32C) {
+		return types.NewAppError("Checksum Mismatch", "CRC32C checksum does not match the received file", http.StatusBadRequest, nil)
+	}
+	return nil
+}
+
+// NewObjectKey generates a unique object key that keeps the extension of the uploaded filename.
+func NewObjectKey(filename string) string {
+	return fmt.Sprintf("%s%s", uuid.New().String(), filepath.Ext(filename))
+}
+
+// tenantKey returns the key an object is stored under: key itself, or key under the
+// prefix of the tenant in ctx. Keys given to and returned by every backend are the
+// keys a tenant knows its files by, so tenants can never name each other's objects.
+func tenantKey(ctx context.Context, key string) string {
+	if t := tenant.FromContext(ctx); t != nil {
+		return t.Prefix() + key
+	}
+	return key
+}
+
+// listedKey reverses tenantKey for a listed object. It returns false for objects
+// that belong to another tenant, or to any tenant when ctx carries none.
+func listedKey(ctx context.Context, storedKey string) (string, bool) {
+	if t := tenant.FromContext(ctx); t != nil {
+		return strings.CutPrefix(storedKey, t.Prefix())
+	}
+	return storedKey, !strings.HasPrefix(storedKey, tenant.KeyPrefix)
+}
+
+// BackendName returns the storage_type name of fileStorage, for recording where a file is kept.
+func BackendName(fileStorage FileStorage) string {
+	switch s := fileStorage.(type) {
+	case *S3Storage:
+		return "s3"
+	case *LocalStorage:
+		return "local"
+	case *MockFileStorage:
+		return "mock"
+	case *DedupStorage:
+		return BackendName(s.inner)
+	default:
+		return fmt.Sprintf("%T", fileStorage)
+	}
 }
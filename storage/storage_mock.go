@@ -2,8 +2,10 @@ package storage
 
 import (
 	"context"
-	"mime/multipart"
+	"io"
+	"time"
 
+	"github.com/pizza-nz/file-uploader/types"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -18,7 +20,58 @@ func NewMockFileStorage() *MockFileStorage {
 	return &MockFileStorage{}
 }
 
-func (m *MockFileStorage) Upload(ctx context.Context, file multipart.File, handler *multipart.FileHeader) (string, error) {
-	args := m.Called(ctx, file, handler)
+func (m *MockFileStorage) Upload(ctx context.Context, key string, body io.Reader, meta types.ObjectMetadata) (*types.ObjectInfo, error) {
+	args := m.Called(ctx, key, body, meta)
+	object, _ := args.Get(0).(*types.ObjectInfo)
+	return object, args.Error(1)
+}
+
+func (m *MockFileStorage) Download(ctx context.Context, key string) (*types.FileDownload, error) {
+	args := m.Called(ctx, key)
+	download, _ := args.Get(0).(*types.FileDownload)
+	return download, args.Error(1)
+}
+
+func (m *MockFileStorage) Delete(ctx context.Context, key string) error {
+	args := m.Called(ctx, key)
+	return args.Error(0)
+}
+
+func (m *MockFileStorage) List(ctx context.Context, startAfter string, limit int) ([]types.ObjectInfo, error) {
+	args := m.Called(ctx, startAfter, limit)
+	objects, _ := args.Get(0).([]types.ObjectInfo)
+	return objects, args.Error(1)
+}
+
+func (m *MockFileStorage) PresignDownload(ctx context.Context, key string, expiry time.Duration) (*types.PresignedRequest, error) {
+	args := m.Called(ctx, key, expiry)
+	req, _ := args.Get(0).(*types.PresignedRequest)
+	return req, args.Error(1)
+}
+
+func (m *MockFileStorage) PresignUpload(ctx context.Context, key string, method string, contentType string, size int64, expiry time.Duration) (*types.PresignedRequest, error) {
+	args := m.Called(ctx, key, method, contentType, size, expiry)
+	req, _ := args.Get(0).(*types.PresignedRequest)
+	return req, args.Error(1)
+}
+
+func (m *MockFileStorage) CreateMultipartUpload(ctx context.Context, key string, contentType string) (string, error) {
+	args := m.Called(ctx, key, contentType)
 	return args.String(0), args.Error(1)
-}
\ No newline at end of file
+}
+
+func (m *MockFileStorage) UploadPart(ctx context.Context, key string, uploadID string, partNumber int32, body io.ReadSeeker, size int64) (*types.UploadedPart, error) {
+	args := m.Called(ctx, key, uploadID, partNumber, body, size)
+	part, _ := args.Get(0).(*types.UploadedPart)
+	return part, args.Error(1)
+}
+
+func (m *MockFileStorage) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []types.UploadedPart) error {
+	args := m.Called(ctx, key, uploadID, parts)
+	return args.Error(0)
+}
+
+func (m *MockFileStorage) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	args := m.Called(ctx, key, uploadID)
+	return args.Error(0)
+}
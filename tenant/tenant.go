@@ -0,0 +1,181 @@
+// Package tenant identifies the customer a request is made for, so that one
+// deployment can keep each customer's files apart and apply its own upload limits.
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/types"
+)
+
+// KeyPrefix is the prefix of every object key that belongs to a tenant.
+const KeyPrefix = "tenant/"
+
+// validID matches tenant IDs that are safe to use in object keys and bucket paths.
+var validID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is a customer whose files are kept apart from everyone else's.
+type Tenant struct {
+	ID string
+	// Bucket is the S3 bucket holding only this tenant's files, or empty if they are
+	// kept under Prefix in the shared bucket.
+	Bucket string
+	// AllowedTypes, MaxSize and the limits in Quotas replace the deployment's
+	// defaults when set.
+	AllowedTypes []string
+	MaxSize      int64
+	Quotas       config.QuotaConfig
+}
+
+// Prefix returns the prefix of the keys the tenant's objects are stored under.
+func (t *Tenant) Prefix() string {
+	return KeyPrefix + t.ID + "/"
+}
+
+// ValidID reports whether id can name a tenant.
+func ValidID(id string) bool {
+	return validID.MatchString(id)
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx that carries tenant.
+func WithTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// FromContext returns the tenant carried by ctx, or nil if the request was not
+// made for a tenant.
+func FromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return tenant
+}
+
+// ID returns the ID of the tenant carried by ctx, or "" if there is none.
+func ID(ctx context.Context) string {
+	if tenant := FromContext(ctx); tenant != nil {
+		return tenant.ID
+	}
+	return ""
+}
+
+// MaxSize returns the largest file the tenant in ctx may upload, or defaultSize if
+// there is no tenant or it has no limit of its own.
+func MaxSize(ctx context.Context, defaultSize int64) int64 {
+	if tenant := FromContext(ctx); tenant != nil && tenant.MaxSize > 0 {
+		return tenant.MaxSize
+	}
+	return defaultSize
+}
+
+// AllowedTypes returns the file types the tenant in ctx may upload, or nil if
+// there is no tenant or it uses the deployment's defaults.
+func AllowedTypes(ctx context.Context) []string {
+	if tenant := FromContext(ctx); tenant != nil && len(tenant.AllowedTypes) > 0 {
+		return tenant.AllowedTypes
+	}
+	return nil
+}
+
+// Quotas returns the quotas of the tenant in ctx: defaults, with any limits the
+// tenant sets for itself replacing them.
+func Quotas(ctx context.Context, defaults config.QuotaConfig) config.QuotaConfig {
+	tenant := FromContext(ctx)
+	if tenant == nil {
+		return defaults
+	}
+	return config.QuotaConfig{
+		Tenant: overrideQuota(defaults.Tenant, tenant.Quotas.Tenant),
+		User:   overrideQuota(defaults.User, tenant.Quotas.User),
+	}
+}
+
+func overrideQuota(quota, override config.Quota) config.Quota {
+	if override.MaxBytes > 0 {
+		quota.MaxBytes = override.MaxBytes
+	}
+	if override.MaxObjects > 0 {
+		quota.MaxObjects = override.MaxObjects
+	}
+	return quota
+}
+
+// Resolver works out which tenant a request is made for.
+type Resolver struct {
+	header   string
+	required bool
+	tenants  map[string]config.TenantConfig
+}
+
+// NewResolver creates a Resolver for the tenants described by cfg.
+func NewResolver(cfg config.TenancyConfig) (*Resolver, error) {
+	for id := range cfg.Tenants {
+		if !ValidID(id) {
+			return nil, fmt.Errorf("tenant ID '%s' must be 1 to 63 lowercase letters, digits or dashes, starting with a letter or digit", id)
+		}
+	}
+	return &Resolver{header: cfg.Header, required: cfg.Required, tenants: cfg.Tenants}, nil
+}
+
+// Resolve returns the tenant r is made for, or nil if it is made for none. The
+// tenant of an authenticated caller is the one its credentials belong to. Callers
+// whose credentials belong to no tenant may name one of the configured tenants in
+// the configured header if they hold auth.ScopeTenantsSelect, as may every caller
+// when authentication is disabled.
+func (res *Resolver) Resolve(r *http.Request) (*Tenant, error) {
+	var requested string
+	if res.header != "" {
+		requested = r.Header.Get(res.header)
+	}
+
+	id := requested
+	principal := auth.PrincipalFromContext(r.Context())
+	switch {
+	case principal != nil && principal.Tenant != "":
+		if requested != "" && requested != principal.Tenant {
+			return nil, types.NewAuthorizationError(fmt.Sprintf("%s of tenant %s asked for tenant %s", principal.ID, principal.Tenant, requested), nil)
+		}
+		id = principal.Tenant
+	case requested == "":
+	case principal != nil && !principal.HasScope(auth.ScopeTenantsSelect):
+		return nil, types.NewAuthorizationError(fmt.Sprintf("%s does not hold scope %s to ask for tenant %s", principal.ID, auth.ScopeTenantsSelect, requested), nil)
+	default:
+		// Naming an unknown tenant must not open a fresh namespace with fresh quotas.
+		if _, ok := res.tenants[requested]; !ok {
+			return nil, types.NewBadRequestError([]types.Details{types.NewDetails("tenant", "is not a configured tenant")})
+		}
+	}
+
+	if id == "" {
+		if res.required {
+			return nil, types.NewAppError("A tenant is required", "request named no tenant", http.StatusBadRequest, nil)
+		}
+		return nil, nil
+	}
+	if !ValidID(id) {
+		return nil, types.NewBadRequestError([]types.Details{types.NewDetails("tenant", "must be 1 to 63 lowercase letters, digits or dashes")})
+	}
+
+	return newTenant(id, res.tenants[id]), nil
+}
+
+// Tenants returns every configured tenant, in ID order.
+func (res *Resolver) Tenants() []*Tenant {
+	ids := slices.Sorted(maps.Keys(res.tenants))
+	tenants := make([]*Tenant, len(ids))
+	for i, id := range ids {
+		tenants[i] = newTenant(id, res.tenants[id])
+	}
+	return tenants
+}
+
+func newTenant(id string, cfg config.TenantConfig) *Tenant {
+	return &Tenant{ID: id, Bucket: cfg.Bucket, AllowedTypes: cfg.AllowedTypes, MaxSize: cfg.MaxSize, Quotas: cfg.Quotas}
+}
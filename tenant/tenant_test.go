@@ -0,0 +1,114 @@
+package tenant
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/auth"
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_Resolve(t *testing.T) {
+	cfg := config.TenancyConfig{
+		Header: "X-Tenant-ID",
+		Tenants: map[string]config.TenantConfig{
+			"acme": {AllowedTypes: []string{"application/pdf"}, MaxSize: 1024},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		required  bool
+		principal *auth.Principal
+		header    string
+		want      string
+		status    int
+	}{
+		{name: "no tenant"},
+		{name: "no tenant when one is required", required: true, status: http.StatusBadRequest},
+		{name: "named in the header", header: "acme", want: "acme"},
+		{name: "unlisted tenant in the header", header: "globex", status: http.StatusBadRequest},
+		{name: "invalid tenant ID", header: "../acme", status: http.StatusBadRequest},
+		{name: "from credentials", principal: &auth.Principal{ID: "apikey:1", Tenant: "acme"}, want: "acme"},
+		{name: "credentials and header agree", principal: &auth.Principal{ID: "apikey:1", Tenant: "acme"}, header: "acme", want: "acme"},
+		{name: "credentials of another tenant", principal: &auth.Principal{ID: "apikey:1", Tenant: "globex"}, header: "acme", status: http.StatusForbidden},
+		{name: "unlisted tenant from credentials uses the defaults", principal: &auth.Principal{ID: "apikey:1", Tenant: "globex"}, want: "globex"},
+		{name: "credentials without a tenant", principal: &auth.Principal{ID: "apikey:2"}, header: "acme", status: http.StatusForbidden},
+		{name: "credentials that may select a tenant", principal: &auth.Principal{ID: "apikey:2", Scopes: []string{auth.ScopeTenantsSelect}}, header: "acme", want: "acme"},
+		{name: "credentials without a tenant and no header", principal: &auth.Principal{ID: "apikey:2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Required = tt.required
+			resolver, err := NewResolver(cfg)
+			require.NoError(t, err)
+
+			r := httptest.NewRequest(http.MethodGet, "/files", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Tenant-ID", tt.header)
+			}
+			if tt.principal != nil {
+				r = r.WithContext(auth.WithPrincipal(r.Context(), tt.principal))
+			}
+
+			got, err := resolver.Resolve(r)
+			if tt.status != 0 {
+				require.Error(t, err)
+				status, _, _ := utils.DescribeError(r.Context(), err)
+				assert.Equal(t, tt.status, status)
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.Equal(t, tt.want, got.ID)
+			assert.Equal(t, "tenant/"+tt.want+"/", got.Prefix())
+		})
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, int64(100), MaxSize(ctx, 100))
+	assert.Nil(t, AllowedTypes(ctx))
+	assert.Equal(t, "", ID(ctx))
+
+	ctx = WithTenant(ctx, &Tenant{ID: "acme", AllowedTypes: []string{"application/pdf"}, MaxSize: 10})
+	assert.Equal(t, int64(10), MaxSize(ctx, 100))
+	assert.Equal(t, []string{"application/pdf"}, AllowedTypes(ctx))
+	assert.Equal(t, "acme", ID(ctx))
+
+	ctx = WithTenant(ctx, &Tenant{ID: "globex"})
+	assert.Equal(t, int64(100), MaxSize(ctx, 100), "a tenant without a limit of its own uses the default")
+	assert.Nil(t, AllowedTypes(ctx))
+}
+
+func TestQuotas(t *testing.T) {
+	defaults := config.QuotaConfig{
+		Tenant: config.Quota{MaxBytes: 1000, MaxObjects: 10},
+		User:   config.Quota{MaxBytes: 100},
+	}
+	assert.Equal(t, defaults, Quotas(context.Background(), defaults))
+
+	ctx := WithTenant(context.Background(), &Tenant{ID: "acme", Quotas: config.QuotaConfig{
+		Tenant: config.Quota{MaxBytes: 5000},
+		User:   config.Quota{MaxObjects: 3},
+	}})
+	assert.Equal(t, config.QuotaConfig{
+		Tenant: config.Quota{MaxBytes: 5000, MaxObjects: 10},
+		User:   config.Quota{MaxBytes: 100, MaxObjects: 3},
+	}, Quotas(ctx, defaults), "limits the tenant does not set keep the defaults")
+}
+
+func TestNewResolver_RejectsInvalidTenantIDs(t *testing.T) {
+	_, err := NewResolver(config.TenancyConfig{Tenants: map[string]config.TenantConfig{"Acme Corp": {}}})
+	assert.Error(t, err)
+}
@@ -47,7 +47,7 @@ resource "aws_lb_target_group" "main" {
   target_type = "ip"
 
   health_check {
-    path                = "/health"
+    path                = "/readyz" # 503 until storage, the metadata store and disk space are usable
     protocol            = "HTTP"
     port                = "traffic-port" # This tells the health check to use the main target group port (2131)
     matcher             = "200"
@@ -57,3 +57,34 @@ resource "aws_s3_bucket_policy" "main" {
 
 # Gets the current AWS account ID to create a unique bucket name.
 data "aws_caller_identity" "current" {}
+
+# Allows browsers on the configured origins to upload and download objects directly
+# with presigned URLs.
+resource "aws_s3_bucket_cors_configuration" "main" {
+  count  = length(var.cors_allowed_origins) > 0 ? 1 : 0
+  bucket = aws_s3_bucket.main.id
+
+  cors_rule {
+    allowed_methods = ["GET", "PUT", "POST"]
+    allowed_origins = var.cors_allowed_origins
+    allowed_headers = ["*"]
+    expose_headers  = ["ETag"]
+    max_age_seconds = 3000
+  }
+}
+
+# Cleans up the parts of resumable uploads that were never completed or aborted.
+resource "aws_s3_bucket_lifecycle_configuration" "main" {
+  bucket = aws_s3_bucket.main.id
+
+  rule {
+    id     = "abort-incomplete-multipart-uploads"
+    status = "Enabled"
+
+    filter {}
+
+    abort_incomplete_multipart_upload {
+      days_after_initiation = 2
+    }
+  }
+}
@@ -20,4 +20,14 @@ variable "ingress_cidr_blocks" {
   description = "The list of CIDR blocks to allow for inbound traffic to the security group."
   type        = list(string)
   default     = ["0.0.0.0/0"]
-}
\ No newline at end of file
+}
+variable "cors_allowed_origins" {
+  description = "The list of origins allowed to use presigned URLs against the uploads bucket from a browser. Browsers cannot use them until this is set."
+  type        = list(string)
+  default     = []
+
+  validation {
+    condition     = !contains(var.cors_allowed_origins, "*")
+    error_message = "List the web origins that may use presigned URLs rather than allowing every origin."
+  }
+}
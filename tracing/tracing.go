@@ -0,0 +1,109 @@
+// Package tracing configures OpenTelemetry tracing for the service.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pizza-nz/file-uploader/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName identifies the service in exported spans.
+const ServiceName = "file-uploader"
+
+// Setup installs the W3C trace context propagator and, unless cfg.Exporter is "none",
+// a global tracer provider that exports spans as cfg describes. The returned function
+// flushes any buffered spans and stops the exporter. With no exporter, spans are not
+// recorded but incoming trace context is still passed on to outgoing requests.
+func Setup(ctx context.Context, cfg config.TracingConfig, environment string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	closeOutput := func() error { return nil }
+	switch cfg.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		var err error
+		exporter, err = stdouttrace.New()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout span exporter: %w", err)
+		}
+	case "file":
+		if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create span file directory: %w", err)
+		}
+		file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open span file: %w", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to create file span exporter: %w", err)
+		}
+		closeOutput = file.Close
+	case "otlp":
+		var options []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		var err error
+		exporter, err = otlptracehttp.New(ctx, options...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP span exporter: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("tracing exporter '%s' is not supported", cfg.Exporter)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(ServiceName), semconv.DeploymentEnvironment(environment)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		exporter.Shutdown(ctx)
+		closeOutput()
+		return nil, fmt.Errorf("failed to describe tracing resource: %w", err)
+	}
+
+	sampleRatio := 1.0
+	if cfg.SampleRatio != nil {
+		sampleRatio = *cfg.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		return errors.Join(provider.Shutdown(ctx), closeOutput())
+	}, nil
+}
+
+// EndSpan ends span, first marking it as failed if err is set.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
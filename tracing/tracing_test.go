@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pizza-nz/file-uploader/config"
+	"github.com/pizza-nz/file-uploader/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestSetup_FileExporterContinuesIncomingTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces", "spans.json")
+	shutdown, err := Setup(context.Background(), config.TracingConfig{Exporter: "file", Path: path}, "test")
+	require.NoError(t, err)
+
+	var outgoing http.Header
+	handler := middleware.RequestIDMiddleware(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// What a downstream call made with the request context would carry.
+		outgoing = http.Header{}
+		otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(outgoing))
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, shutdown(context.Background()))
+
+	assert.Contains(t, outgoing.Get("traceparent"), "4bf92f3577b34da6a3ce929d0e0e4736")
+	spans, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(spans), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Contains(t, string(spans), `"Name":"POST"`)
+	assert.Contains(t, string(spans), "request.id")
+}
+
+func TestSetup_RejectsUnknownExporter(t *testing.T) {
+	_, err := Setup(context.Background(), config.TracingConfig{Exporter: "zipkin"}, "test")
+	assert.Error(t, err)
+}
@@ -43,6 +43,17 @@ func NewNotFoundError(key string) *NotFoundError {
 	return &NotFoundError{key: key}
 }
 
+// QuotaExceededError is returned when storing more would take Scope past its Quota.
+type QuotaExceededError struct {
+	Scope UsageScope
+	Quota Usage
+}
+
+// Error implements the error interface for QuotaExceededError.
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota of %d bytes in %d objects exceeded for tenant '%s' owner '%s'", e.Quota.Bytes, e.Quota.Objects, e.Scope.Tenant, e.Scope.Owner)
+}
+
 // BadRequestError is used for validation errors, providing detailed feedback
 // on which fields were incorrect.
 type BadRequestError struct {
@@ -77,7 +88,7 @@ func NewBadRequestError(details []Details) *BadRequestError {
 // AppError is a generic error type for the application.
 // It wraps underlying errors while adding context like an HTTP status code and user-facing messages.
 type AppError struct {
-	Underlying      error `json:"-"`
+	Underlying      error  `json:"-"`
 	HTTPStatus      int    `json:"-"`
 	Message         string `json:"message"`
 	InternalMessage string `json:"-"`
@@ -136,4 +147,15 @@ func NewAuthorizationError(internalMessage string, underlying error) *AppError {
 		http.StatusForbidden,
 		underlying,
 	)
-}
\ No newline at end of file
+}
+
+// NewAuthenticationError creates an AppError for requests that did not prove who
+// sent them, such as a missing, unknown or revoked API key.
+func NewAuthenticationError(internalMessage string, underlying error) *AppError {
+	return NewAppError(
+		"Authentication is required",
+		internalMessage,
+		http.StatusUnauthorized,
+		underlying,
+	)
+}
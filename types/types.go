@@ -1,6 +1,339 @@
 package types
 
+import (
+	"io"
+	"slices"
+	"time"
+)
+
 type FileUploadResponse struct {
-	FileID string `json:"fileId"`
-	Size   int64  `json:"size"`
+	FileID      string `json:"fileId"`
+	Size        int64  `json:"size"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	// MD5 and CRC32C are hex encoded, and are only reported when the file is uploaded.
+	MD5    string `json:"md5,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// BatchUploadResult is the outcome of one file in a batch upload. File is set when the
+// file was stored; otherwise Message, and Details for validation errors, say why not.
+type BatchUploadResult struct {
+	Filename string              `json:"filename"`
+	Status   int                 `json:"status"`
+	File     *FileUploadResponse `json:"file,omitempty"`
+	Message  string              `json:"message,omitempty"`
+	Details  []Details           `json:"details,omitempty"`
+}
+
+// BatchUploadResponse lists the result of every file in a batch upload, in the order
+// the files were sent. If the form could not be read to its end, Message and Details
+// say why, and the files after that point are not listed.
+type BatchUploadResponse struct {
+	Files   []BatchUploadResult `json:"files"`
+	Message string              `json:"message,omitempty"`
+	Details []Details           `json:"details,omitempty"`
+}
+
+// FileUploadRequest is what a client declared about a file it is uploading. Only
+// Filename is required; any other field that is set is checked against the file.
+type FileUploadRequest struct {
+	Filename    string
+	ContentType string
+	// Size is the declared length in bytes, or zero or less when it is not known.
+	Size      int64
+	Checksums Checksums
+}
+
+// FileDownload is a stored file ready to be streamed back to a client.
+// The caller is responsible for closing Body. Filename is the name the file was
+// uploaded with, if it is known.
+type FileDownload struct {
+	FileID      string
+	Filename    string
+	ContentType string
+	Size        int64
+	Body        io.ReadCloser
+}
+
+// ObjectMetadata describes an object being written to storage.
+type ObjectMetadata struct {
+	// Size, when greater than zero, is the exact length of the body. Storage rejects a
+	// body of any other length.
+	Size        int64
+	ContentType string
+	// Checksums that are set are compared with the body, which is rejected if they differ.
+	Checksums Checksums
+	// UserMetadata is stored with the object by backends that support it, such as S3.
+	UserMetadata map[string]string
+}
+
+// Checksums holds raw digests of an object's content. A nil field is not known.
+type Checksums struct {
+	MD5    []byte
+	SHA256 []byte
+	// CRC32C uses the Castagnoli polynomial and is stored big-endian, as S3 reports it.
+	CRC32C []byte
+}
+
+// ObjectInfo describes a stored object. Objects returned by List only carry Key,
+// Size and LastModified. An uploaded object carries the rest, and its LastModified
+// is zero if the backend does not report it.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ContentType  string
+	ETag         string
+	Checksums    Checksums
+	UserMetadata map[string]string
+}
+
+// BlobRef records that the object stored under Key is the content-addressed blob
+// with the hex encoded SHA-256 Hash. Several keys may refer to the same blob.
+type BlobRef struct {
+	Key         string
+	Hash        string
+	Size        int64
+	ContentType string
+	CreatedAt   time.Time
+}
+
+// FileMetadata is what is recorded about a stored file. Checksum is the hex
+// encoded SHA-256 of the content prefixed with "sha256:", when it was computed.
+// Uploader is the ID of the principal that owns the file, and Group the group it
+// is shared with; both are empty for files uploaded anonymously.
+type FileMetadata struct {
+	FileID         string    `json:"fileId"`
+	Filename       string    `json:"filename"`
+	ContentType    string    `json:"contentType"`
+	Size           int64     `json:"size"`
+	Checksum       string    `json:"checksum,omitempty"`
+	Uploader       string    `json:"uploader,omitempty"`
+	Group          string    `json:"group,omitempty"`
+	Tenant         string    `json:"tenant,omitempty"`
+	StorageBackend string    `json:"storageBackend"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// UploadResponse describes the stored file to the client that uploaded it.
+func (m *FileMetadata) UploadResponse() *FileUploadResponse {
+	return &FileUploadResponse{
+		FileID:      m.FileID,
+		Size:        m.Size,
+		Filename:    m.Filename,
+		ContentType: m.ContentType,
+		Checksum:    m.Checksum,
+	}
+}
+
+// PresignedUploadRequest describes a file a client intends to upload directly to storage.
+type PresignedUploadRequest struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	// Method is either "PUT" (the default) or "POST" for browser form uploads.
+	Method string `json:"method"`
+}
+
+// PendingUpload is a direct upload that has been presigned but not yet verified.
+// FileID is the key the client was told to upload to.
+type PendingUpload struct {
+	FileID    string
+	Filename  string
+	Size      int64
+	Tenant    string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// PresignedRequest is a time-limited request a client can send straight to storage.
+// For POST uploads, Fields must be sent as form fields before the file itself.
+type PresignedRequest struct {
+	FileID    string            `json:"fileId"`
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// UploadedPart is one part of a multipart upload that storage has accepted.
+type UploadedPart struct {
+	PartNumber int32  `json:"partNumber"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+}
+
+// UploadSessionRequest starts a resumable, chunked upload.
+type UploadSessionRequest struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
+
+// ChunkRange is where a chunk lies in a resumable upload, as sent in a
+// "Content-Range: bytes Start-End/Total" header. End is inclusive.
+type ChunkRange struct {
+	Start int64
+	End   int64
+	Total int64
+}
+
+// UploadSessionStatus reports the progress of a resumable upload. Chunks are
+// numbered from 0 and every chunk except the last is exactly ChunkSize bytes.
+type UploadSessionStatus struct {
+	SessionID      string    `json:"sessionId"`
+	FileID         string    `json:"fileId"`
+	Filename       string    `json:"filename"`
+	Size           int64     `json:"size"`
+	ChunkSize      int64     `json:"chunkSize"`
+	TotalChunks    int       `json:"totalChunks"`
+	ReceivedChunks []int     `json:"receivedChunks"`
+	BytesReceived  int64     `json:"bytesReceived"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+}
+
+// Sort orders accepted by FileListQuery.
+const (
+	FileSortCreatedAt = "createdAt"
+	FileSortSize      = "size"
+	FileSortFilename  = "filename"
+)
+
+// FileAccess selects the files owned by Owner or shared with any of Groups.
+type FileAccess struct {
+	Owner  string
+	Groups []string
+}
+
+// FileListQuery selects a page of files. Zero values mean no filter; MaxSize 0 means
+// no upper bound. UploadedAfter is inclusive and UploadedBefore is exclusive.
+// Cursor is the NextCursor of the previous page, and must be used with the same
+// Sort and Descending values. VisibleTo, when set, limits the page to the files a
+// caller may see. Tenant is always applied: files are only listed for one tenant,
+// and "" selects the files that belong to none.
+type FileListQuery struct {
+	ContentType    string
+	MinSize        int64
+	MaxSize        int64
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+	Uploader       string
+	Sort           string
+	Descending     bool
+	Limit          int
+	Cursor         string
+	VisibleTo      *FileAccess
+	Tenant         string
+}
+
+// FileListPage is one page of a file listing. NextCursor is empty on the last page.
+type FileListPage struct {
+	Files      []FileMetadata `json:"files"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// Matches reports whether file passes every filter in q.
+func (q *FileListQuery) Matches(file *FileMetadata) bool {
+	switch {
+	case file.Tenant != q.Tenant:
+		return false
+	case q.ContentType != "" && file.ContentType != q.ContentType:
+		return false
+	case file.Size < q.MinSize:
+		return false
+	case q.MaxSize > 0 && file.Size > q.MaxSize:
+		return false
+	case !q.UploadedAfter.IsZero() && file.CreatedAt.Before(q.UploadedAfter):
+		return false
+	case !q.UploadedBefore.IsZero() && !file.CreatedAt.Before(q.UploadedBefore):
+		return false
+	case q.Uploader != "" && file.Uploader != q.Uploader:
+		return false
+	case q.VisibleTo != nil && !q.VisibleTo.Allows(file):
+		return false
+	}
+	return true
+}
+
+// Allows reports whether file is owned by a.Owner or shared with one of a.Groups.
+func (a *FileAccess) Allows(file *FileMetadata) bool {
+	if file.Uploader != "" && file.Uploader == a.Owner {
+		return true
+	}
+	return file.Group != "" && slices.Contains(a.Groups, file.Group)
+}
+
+// DependencyCheck is the outcome of checking one dependency for readiness. Status is
+// "ok" or "failed". Only Status is sent to clients; Error and LatencyMs are logged.
+type DependencyCheck struct {
+	Status    string `json:"status"`
+	Error     string `json:"-"`
+	LatencyMs int64  `json:"-"`
+}
+
+// ReadinessReport is the response of GET /readyz. Status is "ok" only when every
+// dependency check passed.
+type ReadinessReport struct {
+	Status    string                     `json:"status"`
+	CheckedAt time.Time                  `json:"-"`
+	Checks    map[string]DependencyCheck `json:"checks"`
+}
+
+// APIKey is what is stored about an API key. The key itself is shown once when it
+// is minted and never stored; Hash is the hex encoded SHA-256 of it. A key is
+// revoked once RevokedAt is set.
+type APIKey struct {
+	ID        string     `json:"id" yaml:"id"`
+	Name      string     `json:"name" yaml:"name"`
+	Hash      string     `json:"-" yaml:"hash"`
+	Scopes    []string   `json:"scopes" yaml:"scopes"`
+	Groups    []string   `json:"groups,omitempty" yaml:"groups,omitempty"`
+	Tenant    string     `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+	CreatedAt time.Time  `json:"createdAt" yaml:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty" yaml:"revokedAt,omitempty"`
+}
+
+// UsageScope names whose files a Usage counts: those of Tenant or, when Owner is
+// set, only those Owner uploaded for Tenant. Tenant is "" for files that belong to
+// no tenant.
+type UsageScope struct {
+	Tenant string
+	Owner  string
+}
+
+// Usage is how much a scope stores. Used as a quota, a zero field is not limited.
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// Exceeds reports whether adding delta to u takes it past quota. Reductions never do.
+func (u Usage) Exceeds(delta, quota Usage) bool {
+	return (delta.Bytes > 0 && quota.Bytes > 0 && u.Bytes+delta.Bytes > quota.Bytes) ||
+		(delta.Objects > 0 && quota.Objects > 0 && u.Objects+delta.Objects > quota.Objects)
+}
+
+// UsageCharge is a change of usage to apply to Scope, which must not take it past Quota.
+type UsageCharge struct {
+	Scope UsageScope
+	Quota Usage
+}
+
+// QuotaUsage is how much a scope stores, and how much it may store.
+type QuotaUsage struct {
+	Usage
+	Quota Usage `json:"quota"`
+}
+
+// UsageReport is the response of GET /usage: what the caller's tenant, and the
+// caller itself, store. Owner and OwnerUsage are omitted for anonymous callers.
+type UsageReport struct {
+	Tenant      string      `json:"tenant,omitempty"`
+	TenantUsage QuotaUsage  `json:"tenantUsage"`
+	Owner       string      `json:"owner,omitempty"`
+	OwnerUsage  *QuotaUsage `json:"ownerUsage,omitempty"`
 }
@@ -1,12 +1,14 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log/slog"
 	"net/http"
 	"path/filepath"
 
+	"github.com/pizza-nz/file-uploader/metrics"
 	"github.com/pizza-nz/file-uploader/types"
 )
 
@@ -15,28 +17,58 @@ func JSONResponse(w http.ResponseWriter, r *http.Request, status int, data inter
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
-		slog.Error("Failed to encode JSON response", "error", err, "requestID", r.Header.Get("X-Request-ID"))
+		slog.ErrorContext(r.Context(), "Failed to encode JSON response", "error", err)
 		http.Error(w, `{"message":"Failed to encode response"}`, http.StatusInternalServerError)
 	}
 }
 
+// badRequestResponse is the body returned for a *types.BadRequestError.
+type badRequestResponse struct {
+	Message string          `json:"message"`
+	Details []types.Details `json:"details"`
+}
+
 // HandleError is a utility function to handle errors in HTTP handlers.
 // It logs the error and sends an appropriate JSON response to the client.
 func HandleError(w http.ResponseWriter, r *http.Request, err error) {
-	var appErr *types.AppError
-	if errors.As(err, &appErr) {
-		// This is our custom error type, we can trust its fields.
-		slog.Error("Handle Error", "error", appErr.Error(), "requestID", r.Header.Get("X-Request-ID")) // Log the detailed error
+	status, message, details := DescribeError(r.Context(), err)
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(appErr.HTTPStatus)
-		json.NewEncoder(w).Encode(appErr)
+	var badRequestErr *types.BadRequestError
+	if errors.As(err, &badRequestErr) {
+		JSONResponse(w, r, status, badRequestResponse{Message: message, Details: details})
 		return
 	}
+	JSONResponse(w, r, status, map[string]string{"message": message})
+}
+
+// DescribeError logs err and counts it in the error metrics as HandleError does, and
+// returns the status code, message and validation details HandleError responds with,
+// for responses that report several outcomes at once.
+func DescribeError(ctx context.Context, err error) (int, string, []types.Details) {
+	var appErr *types.AppError
+	var notFoundErr *types.NotFoundError
+	var badRequestErr *types.BadRequestError
+	switch {
+	case errors.As(err, &appErr):
+	case errors.As(err, &notFoundErr):
+		appErr = types.NewAppError("Resource Not Found", notFoundErr.Error(), http.StatusNotFound, err)
+	case errors.As(err, &badRequestErr):
+		slog.WarnContext(ctx, "Bad request", "error", badRequestErr.Error())
+		metrics.ObserveError(http.StatusBadRequest)
+		return http.StatusBadRequest, "Invalid Request", badRequestErr.Details
+	}
+
+	if appErr != nil {
+		// This is our custom error type, we can trust its fields.
+		slog.ErrorContext(ctx, "Handle Error", "error", appErr.Error()) // Log the detailed error
+		metrics.ObserveError(appErr.HTTPStatus)
+		return appErr.HTTPStatus, appErr.Message, nil
+	}
 
-	// For any other error, return a generic 500.
-	slog.Error("An unexpected error occurred", "error", err.Error(), "requestID", r.Header.Get("X-Request-ID"))
-	http.Error(w, `{"message":"An internal server error occurred."}`, http.StatusInternalServerError)
+	// For any other error, report a generic 500.
+	slog.ErrorContext(ctx, "An unexpected error occurred", "error", err.Error())
+	metrics.ObserveError(http.StatusInternalServerError)
+	return http.StatusInternalServerError, "An internal server error occurred.", nil
 }
 
 // FileNameWithoutExtension returns the filename without its extension.
@@ -44,4 +76,4 @@ func HandleError(w http.ResponseWriter, r *http.Request, err error) {
 // For example, "document.txt" becomes "document".
 func FileNameWithoutExtension(filename string) string {
 	return filename[:len(filename)-len(filepath.Ext(filename))]
-}
\ No newline at end of file
+}